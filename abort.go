@@ -0,0 +1,140 @@
+package fasthttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/domsolutions/xk6-fasthttp/tracer"
+	http "github.com/valyala/fasthttp"
+)
+
+// sendAborts holds the abort of every request sent by sendAbortable, keyed by the copy sent
+var sendAborts = &sync.Map{}
+
+// abortOf returns the abort of req, nil when it wasn't sent by sendAbortable
+func abortOf(req *http.Request) *sendAbort {
+	if a, ok := sendAborts.Load(req); ok {
+		return a.(*sendAbort)
+	}
+	return nil
+}
+
+// sendAbort interrupts a request on the wire once sendAbortable abandons it, rather than leaving it
+// to be answered in the background
+type sendAbort struct {
+	lock    *sync.Mutex
+	aborted bool
+	// attempt is whether the request is being sent, which fasthttp may do more than once
+	attempt bool
+	// interrupt fails the attempt in flight, nil until it's known how
+	interrupt func()
+}
+
+func newSendAbort() *sendAbort {
+	return &sendAbort{lock: &sync.Mutex{}}
+}
+
+// begin starts an attempt at sending the request, false when it was already abandoned
+func (a *sendAbort) begin() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.attempt = !a.aborted
+	return a.attempt
+}
+
+// started sets how to interrupt the attempt in flight, doing so straight away when the request was
+// abandoned since it began
+func (a *sendAbort) started(interrupt func()) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.attempt {
+		return
+	}
+	if a.aborted {
+		interrupt()
+		return
+	}
+	a.interrupt = interrupt
+}
+
+// end ends the attempt in flight, after which its connection may be sent other requests
+func (a *sendAbort) end() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.attempt = false
+	a.interrupt = nil
+}
+
+// abort abandons the request, interrupting the attempt in flight
+func (a *sendAbort) abort() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.aborted = true
+	if a.interrupt != nil {
+		a.interrupt()
+		a.interrupt = nil
+	}
+}
+
+// abortTransport sends HTTP/1.1 requests as fasthttp does, closing the connection of those sent by
+// sendAbortable when they're abandoned. The connection is only known to fasthttp, which hands it
+// to the response before writing the request, so the body is written from a stream closed once
+// it's written, when the connection is taken from the response.
+type abortTransport struct{}
+
+func (abortTransport) RoundTrip(hc *http.HostClient, req *http.Request, resp *http.Response) (bool, error) {
+	a := abortOf(req)
+	if a == nil {
+		return http.DefaultTransport.RoundTrip(hc, req, resp)
+	}
+	if !a.begin() {
+		return false, context.Canceled
+	}
+	defer a.end()
+
+	written := &connTaker{abort: a, resp: resp}
+	if req.IsBodyStream() {
+		// streamed bodies aren't sent again, fasthttp only retrying the others
+		written.Reader = req.BodyStream()
+		req.SetBodyStream(written, req.Header.ContentLength())
+		return http.DefaultTransport.RoundTrip(hc, req, resp)
+	}
+
+	// sendAbortable keeps the body as the request's raw body, which is left alone by SetBodyStream
+	body := req.Body()
+	noLength := len(req.Header.Peek(http.HeaderContentLength)) == 0
+	written.Reader = bytes.NewReader(body)
+	req.SetBodyStream(written, len(body))
+	if len(body) == 0 && noLength && (req.Header.IsGet() || req.Header.IsHead()) {
+		// as fasthttp leaves the length out of requests without a body which don't expect one
+		req.Header.Del(http.HeaderContentLength)
+	}
+
+	retry, err := http.DefaultTransport.RoundTrip(hc, req, resp)
+	req.SetBodyRaw(body)
+	return retry, err
+}
+
+// connTaker is the body of a request sent by abortTransport, handing the connection it's written
+// on to the request's abort once it's written
+type connTaker struct {
+	io.Reader
+	abort *sendAbort
+	resp  *http.Response
+}
+
+func (c *connTaker) Close() error {
+	if addr, ok := c.resp.RemoteAddr().(*tracer.Addr); ok {
+		c.abort.started(func() { _ = addr.Close() })
+	}
+	if closer, ok := c.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
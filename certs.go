@@ -0,0 +1,88 @@
+package fasthttp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ClientCertificate is a certificate presented for mTLS to servers named ServerName, which may be a
+// wildcard such as *.example.com, or to any server when blank
+type ClientCertificate struct {
+	Certificate string
+	PrivateKey  string
+	ServerName  string
+}
+
+type clientCertificate struct {
+	serverName string
+	cert       tls.Certificate
+}
+
+// serverNameKey is the handshake context key of the name of the server being connected to
+type serverNameKey struct{}
+
+func loadClientCertificates(certs []ClientCertificate) ([]clientCertificate, error) {
+	loaded := make([]clientCertificate, 0, len(certs))
+	for _, c := range certs {
+		if c.PrivateKey != "" && c.Certificate == "" {
+			return nil, errors.New("blank certificate")
+		}
+		if c.PrivateKey == "" && c.Certificate != "" {
+			return nil, errors.New("blank private key")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Certificate, c.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key/cert; %v", err)
+		}
+		loaded = append(loaded, clientCertificate{serverName: c.ServerName, cert: cert})
+	}
+	return loaded, nil
+}
+
+// getClientCertificate returns a tls.Config GetClientCertificate which selects the first of certs
+// for the name of the server in the handshake context. Otherwise it selects the first certificate
+// for any server which suits the server's certificate request, or failing that the first of them.
+func getClientCertificate(certs []clientCertificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		serverName, _ := cri.Context().Value(serverNameKey{}).(string)
+		for i := range certs {
+			if certs[i].serverName != "" && matchServerName(certs[i].serverName, serverName) {
+				return &certs[i].cert, nil
+			}
+		}
+
+		var fallback *tls.Certificate
+		for i := range certs {
+			if certs[i].serverName != "" {
+				continue
+			}
+			if cri.SupportsCertificate(&certs[i].cert) == nil {
+				return &certs[i].cert, nil
+			}
+			if fallback == nil {
+				fallback = &certs[i].cert
+			}
+		}
+		if fallback == nil {
+			// no certificate is sent
+			return &tls.Certificate{}, nil
+		}
+		return fallback, nil
+	}
+}
+
+// matchServerName reports whether name matches pattern case-insensitively, a leading *. matching
+// a single label
+func matchServerName(pattern, name string) bool {
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(name, ".")
+	return ok && label != "" && strings.EqualFold(suffix, rest)
+}
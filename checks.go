@@ -1,30 +1,368 @@
 package fasthttp
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"strconv"
+	"strings"
 	"time"
 
+	e "github.com/domsolutions/xk6-fasthttp/errors"
 	"github.com/grafana/sobek"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	http "github.com/valyala/fasthttp"
 	"go.k6.io/k6/js/common"
 	"go.k6.io/k6/js/modules/k6"
+	"go.k6.io/k6/lib"
 	"go.k6.io/k6/metrics"
 )
 
 func (mi *ModuleInstance) CheckStatus(wantStatus int, r *sobek.Object, extras ...sobek.Value) (bool, error) {
-	state := mi.vu.State()
-	if state == nil {
-		return false, k6.ErrCheckInInitContext
+	resp, err := mi.checkedResponse(r, "CheckStatus")
+	if err != nil {
+		return false, err
+	}
+
+	checkName := "check status is " + strconv.FormatInt(int64(wantStatus), 10)
+	pass := resp.Status == wantStatus
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// CheckBody checks the response body contains the given substring, or matches it when a RegExp is given
+func (mi *ModuleInstance) CheckBody(r *sobek.Object, matcher sobek.Value, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckBody")
+	if err != nil {
+		return false, err
+	}
+
+	if matcher == nil || sobek.IsUndefined(matcher) || sobek.IsNull(matcher) {
+		return false, errors.New("substring or RegExp required for CheckBody")
+	}
+
+	var body []byte
+	if resp.Body != nil {
+		if body, err = common.ToBytes(resp.Body); err != nil {
+			return false, err
+		}
+	}
+
+	var checkName string
+	var pass bool
+	if regexp, ok := asRegExp(matcher); ok {
+		checkName = "body matches " + matcher.String()
+		matched, err := testRegExp(mi.vu.Runtime(), regexp, string(body))
+		if err != nil {
+			return false, err
+		}
+		pass = resp.Body != nil && matched
+	} else {
+		checkName = "body contains " + matcher.String()
+		pass = resp.Body != nil && bytes.Contains(body, []byte(matcher.String()))
+	}
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// CheckHeader checks the named response header equals expected, or matches it when a RegExp is given.
+// The header name is looked up case-insensitively.
+func (mi *ModuleInstance) CheckHeader(r *sobek.Object, name string, expected sobek.Value, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckHeader")
+	if err != nil {
+		return false, err
+	}
+
+	if expected == nil || sobek.IsUndefined(expected) || sobek.IsNull(expected) {
+		return false, errors.New("expected value or RegExp required for CheckHeader")
+	}
+
+	checkName := "header " + name + " is " + expected.String()
+	value, found := resp.header(name)
+
+	var pass bool
+	if regexp, ok := asRegExp(expected); ok {
+		matched, err := testRegExp(mi.vu.Runtime(), regexp, value)
+		if err != nil {
+			return false, err
+		}
+		pass = found && matched
+	} else {
+		pass = found && value == expected.String()
+	}
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// CheckJSON checks the value at the gjson path in the response body equals expected. A body which
+// isn't JSON or is missing the path fails the check rather than throwing.
+func (mi *ModuleInstance) CheckJSON(r *sobek.Object, path string, expected sobek.Value, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckJSON")
+	if err != nil {
+		return false, err
+	}
+
+	var want interface{}
+	if expected != nil {
+		want = expected.Export()
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		return false, err
+	}
+
+	checkName := "json " + path + " is " + string(wantJSON)
+
+	var pass bool
+	if resp.Body != nil {
+		if body, err := common.ToBytes(resp.Body); err == nil && gjson.ValidBytes(body) {
+			if result := gjson.GetBytes(body, path); result.Exists() {
+				// compare the JSON encodings so numbers match regardless of their Go type
+				got, err := json.Marshal(result.Value())
+				pass = err == nil && bytes.Equal(got, wantJSON)
+			}
+		}
+	}
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// CheckSchema checks the response body is JSON which validates against the JSON Schema given as
+// an object or JSON text. Why a body fails is logged as a warning for each error found.
+func (mi *ModuleInstance) CheckSchema(r *sobek.Object, schema sobek.Value, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckSchema")
+	if err != nil {
+		return false, err
+	}
+
+	if schema == nil || sobek.IsUndefined(schema) || sobek.IsNull(schema) {
+		return false, errors.New("JSON Schema required for CheckSchema")
+	}
+	compiled, err := mi.compileSchema(schema)
+	if err != nil {
+		return false, err
+	}
+
+	checkName := "json matches schema"
+	if compiled.Title != "" {
+		checkName += " " + compiled.Title
+	}
+
+	var pass bool
+	if resp.Body != nil {
+		body, err := common.ToBytes(resp.Body)
+		if err != nil {
+			return false, err
+		}
+
+		var doc interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		// numbers are kept exact for the schema's bounds and multipleOf
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			mi.vu.State().Logger.WithError(err).Warnf("Response body for %s isn't JSON", checkName)
+		} else if err := compiled.Validate(doc); err != nil {
+			logSchemaErrors(mi.vu.State().Logger, checkName, err)
+		} else {
+			pass = true
+		}
+	}
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// maxCachedSchemas bounds the schemas compiled by CheckSchema kept per VU, others being compiled on
+// every check
+const maxCachedSchemas = 64
+
+// compileSchema returns the compiled JSON Schema, compiling each schema object or text once per VU.
+// Objects are compiled as they are when first checked against, later changes to them being ignored.
+func (mi *ModuleInstance) compileSchema(schema sobek.Value) (*jsonschema.Schema, error) {
+	obj, isObject := schema.(*sobek.Object)
+	var key interface{} = obj
+	if !isObject {
+		key = schema.String()
+	}
+	if compiled, ok := mi.schemas[key]; ok {
+		return compiled, nil
+	}
+
+	text := schema.String()
+	if isObject {
+		b, err := json.Marshal(obj.Export())
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	compiler := jsonschema.NewCompiler()
+	// for the schema's title
+	compiler.ExtractAnnotations = true
+	// $ref can only point within the schema, not at files or remote schemas fetched from the VU
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("$ref to %s can't be loaded, only references within the schema are", url)
+	}
+	if err := compiler.AddResource("schema.json", strings.NewReader(text)); err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema; %w", err)
+	}
+	compiled, err := compiler.Compile("schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema; %w", err)
+	}
+	if mi.schemas == nil {
+		mi.schemas = make(map[interface{}]*jsonschema.Schema)
+	}
+	if len(mi.schemas) < maxCachedSchemas {
+		mi.schemas[key] = compiled
+	}
+	return compiled, nil
+}
+
+// logSchemaErrors logs the innermost causes of a failed validation, each naming the JSON pointer
+// of the value which failed
+func logSchemaErrors(logger logrus.FieldLogger, checkName string, err error) {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		logger.WithError(err).Warnf("Failed to validate response body for %s", checkName)
+		return
+	}
+
+	var log func(*jsonschema.ValidationError)
+	log = func(verr *jsonschema.ValidationError) {
+		if len(verr.Causes) == 0 {
+			logger.Warnf("%s failed at %q: %s", checkName, "#"+verr.InstanceLocation, verr.Message)
+		}
+		for _, cause := range verr.Causes {
+			log(cause)
+		}
+	}
+	log(verr)
+}
+
+// CheckDuration checks the request completed in under maxMillis milliseconds
+func (mi *ModuleInstance) CheckDuration(r *sobek.Object, maxMillis float64, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckDuration")
+	if err != nil {
+		return false, err
+	}
+
+	checkName := "duration is below " + strconv.FormatFloat(maxMillis, 'f', -1, 64) + "ms"
+	pass := resp.Timings.Duration < maxMillis
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// CheckContentLength checks the response declared a Content-Length and its body was read in full.
+// Bodies cut short of it fail their request with error_code 1704, so fail the check too, while
+// requests failing otherwise, such as for their status, don't.
+func (mi *ModuleInstance) CheckContentLength(r *sobek.Object, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckContentLength")
+	if err != nil {
+		return false, err
+	}
+
+	checkName := "content-length matches body"
+	contentLength, ok := resp.header(http.HeaderContentLength)
+	_, parseErr := strconv.ParseUint(contentLength, 10, 63)
+	cutShort, _ := e.ErrorCodeForError(e.ErrBodyCutShort)
+	pass := ok && parseErr == nil && resp.ErrorCode != int(cutShort)
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// CheckCORS checks the response's Access-Control-* headers allow a request with method from origin.
+// The allowed origin must be the origin itself or the * wildcard, which credentialed responses
+// can't use, and methods other than the CORS-safelisted GET, HEAD and POST must be allowed.
+func (mi *ModuleInstance) CheckCORS(r *sobek.Object, origin, method string, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckCORS")
+	if err != nil {
+		return false, err
+	}
+
+	checkName := "cors allows " + method + " from " + origin
+	pass := corsAllowed(resp, origin, method)
+
+	if err := mi.emitCheck(checkName, pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
+
+// corsAllowed reports whether the response's CORS headers allow a request with method from origin
+func corsAllowed(resp *Response, origin, method string) bool {
+	credentials, _ := resp.header("Access-Control-Allow-Credentials")
+	// wildcards only stand for any value on responses to requests without credentials
+	wildcard := credentials != "true"
+
+	allowOrigin, _ := resp.header("Access-Control-Allow-Origin")
+	if allowOrigin != origin && (allowOrigin != "*" || !wildcard) {
+		return false
+	}
+
+	switch strings.ToUpper(method) {
+	case "", http.MethodGet, http.MethodHead, http.MethodPost:
+		return true
+	}
+	allowMethods, _ := resp.header("Access-Control-Allow-Methods")
+	for _, m := range strings.Split(allowMethods, ",") {
+		m = strings.TrimSpace(m)
+		if strings.EqualFold(m, method) || (m == "*" && wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mi *ModuleInstance) checkedResponse(r *sobek.Object, fn string) (*Response, error) {
+	if mi.vu.State() == nil {
+		return nil, k6.ErrCheckInInitContext
 	}
 
 	if r == nil {
-		return false, errors.New("nil response")
+		return nil, errors.New("nil response")
 	}
 	resp, ok := r.Export().(*Response)
 	if !ok {
-		return false, errors.New("response object not given to CheckStatus")
+		return nil, errors.New("response object not given to " + fn)
 	}
+	return resp, nil
+}
 
+// emitCheck pushes a checks sample for the named check, tagged with any custom tags from extras.
+// k6's end of test summary aggregates the passes and fails of each check name per group from these.
+func (mi *ModuleInstance) emitCheck(checkName string, pass bool, extras []sobek.Value) error {
+	// the summary drops checks named with the group separator, which names built from bodies, JSON
+	// paths or IPv6 origins may contain
+	for strings.Contains(checkName, lib.GroupSeparator) {
+		checkName = strings.ReplaceAll(checkName, lib.GroupSeparator, ": :")
+	}
+
+	state := mi.vu.State()
 	ctx := mi.vu.Context()
 	rt := mi.vu.Runtime()
 	t := time.Now()
@@ -33,19 +371,15 @@ func (mi *ModuleInstance) CheckStatus(wantStatus int, r *sobek.Object, extras ..
 	commonTagsAndMeta := state.Tags.GetCurrentValues()
 	if len(extras) > 0 {
 		if err := common.ApplyCustomUserTags(rt, &commonTagsAndMeta, extras[0]); err != nil {
-			return false, err
+			return err
 		}
 	}
 
-	checkName := "check status is " + strconv.FormatInt(int64(wantStatus), 10)
-
 	tags := commonTagsAndMeta.Tags
 	if state.Options.SystemTags.Has(metrics.TagCheck) {
 		tags = tags.With("check", checkName)
 	}
 
-	pass := resp.Status == wantStatus
-
 	sample := metrics.Sample{
 		TimeSeries: metrics.TimeSeries{
 			Metric: state.BuiltinMetrics.Checks,
@@ -53,10 +387,40 @@ func (mi *ModuleInstance) CheckStatus(wantStatus int, r *sobek.Object, extras ..
 		},
 		Time:     t,
 		Metadata: commonTagsAndMeta.Metadata,
-		Value:    1,
+		Value:    0,
+	}
+	if pass {
+		sample.Value = 1
 	}
 
 	metrics.PushIfNotDone(ctx, state.Samples, sample)
 
-	return pass, nil
+	return nil
+}
+
+func asRegExp(v sobek.Value) (*sobek.Object, bool) {
+	obj, ok := v.(*sobek.Object)
+	return obj, ok && obj.ClassName() == "RegExp"
+}
+
+// testRegExp runs the JS RegExp itself so the pattern behaves exactly as written in the script
+func testRegExp(rt *sobek.Runtime, regexp *sobek.Object, s string) (bool, error) {
+	test, ok := sobek.AssertFunction(regexp.Get("test"))
+	if !ok {
+		return false, errors.New("RegExp has no test method")
+	}
+	res, err := test(regexp, rt.ToValue(s))
+	if err != nil {
+		return false, err
+	}
+	return res.ToBoolean(), nil
+}
+
+// execRegExp runs the JS RegExp's exec on s, returning null when it doesn't match
+func execRegExp(rt *sobek.Runtime, regexp *sobek.Object, s string) (sobek.Value, error) {
+	exec, ok := sobek.AssertFunction(regexp.Get("exec"))
+	if !ok {
+		return nil, errors.New("RegExp has no exec method")
+	}
+	return exec(regexp, rt.ToValue(s))
 }
@@ -0,0 +1,532 @@
+package fasthttp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/sobek"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"go.k6.io/k6/js/modulestest"
+	"go.k6.io/k6/lib"
+	"go.k6.io/k6/lib/netext/httpext"
+	"go.k6.io/k6/lib/testutils"
+	"go.k6.io/k6/metrics"
+)
+
+type checkTestCase struct {
+	mi      *ModuleInstance
+	runtime *modulestest.Runtime
+	samples chan metrics.SampleContainer
+	logs    *logtest.Hook
+}
+
+func newCheckTestCase(t *testing.T) *checkTestCase {
+	t.Helper()
+
+	runtime := modulestest.NewRuntime(t)
+	mi, ok := New().NewModuleInstance(runtime.VU).(*ModuleInstance)
+	require.True(t, ok)
+
+	registry := metrics.NewRegistry()
+	samples := make(chan metrics.SampleContainer, 1000)
+	logger, logs := logtest.NewNullLogger()
+	runtime.MoveToVUContext(&lib.State{
+		Logger: logger,
+		Options: lib.Options{
+			SystemTags: &metrics.DefaultSystemTagSet,
+		},
+		Samples:        samples,
+		Tags:           lib.NewVUStateTags(registry.RootTagSet()),
+		BuiltinMetrics: metrics.RegisterBuiltinMetrics(registry),
+	})
+
+	return &checkTestCase{mi: mi, runtime: runtime, samples: samples, logs: logs}
+}
+
+func (tc *checkTestCase) response(status int) *Response {
+	return &Response{Response: &httpext.Response{Status: status}}
+}
+
+func (tc *checkTestCase) lastCheckSample(t *testing.T) metrics.Sample {
+	t.Helper()
+
+	samples := metrics.GetBufferedSamples(tc.samples)
+	require.Len(t, samples, 1)
+	require.Len(t, samples[0].GetSamples(), 1)
+	return samples[0].GetSamples()[0]
+}
+
+func TestCheckStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		status int
+		pass   bool
+		value  float64
+	}{
+		"matching status":     {status: 200, pass: true, value: 1},
+		"non matching status": {status: 500, pass: false, value: 0},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			pass, err := tc.mi.CheckStatus(200, rt.ToValue(tc.response(tt.status)).ToObject(rt))
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			sample := tc.lastCheckSample(t)
+			require.Equal(t, tt.value, sample.Value)
+			checkName, ok := sample.Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, "check status is 200", checkName)
+		})
+	}
+}
+
+func TestCheckBody(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		body    interface{}
+		matcher string
+		pass    bool
+		name    string
+	}{
+		"substring found":          {body: "hello world", matcher: `"world"`, pass: true, name: "body contains world"},
+		"substring missing":        {body: "hello world", matcher: `"bye"`, pass: false, name: "body contains bye"},
+		"substring in binary":      {body: []byte{0x00, 'o', 'k', 0xff}, matcher: `"ok"`, pass: true, name: "body contains ok"},
+		"regexp matches":           {body: "status: ACTIVE", matcher: `/status: (active|pending)/i`, pass: true, name: "body matches /status: (active|pending)/i"},
+		"regexp does not match":    {body: "status: DONE", matcher: `/status: (active|pending)/i`, pass: false, name: "body matches /status: (active|pending)/i"},
+		"nil body never passes":    {body: nil, matcher: `/.*/`, pass: false, name: "body matches /.*/"},
+		"regexp matches in binary": {body: []byte("\x00abc123\xff"), matcher: `/c\d+/`, pass: true, name: `body matches /c\d+/`},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Body = tt.body
+			matcher, err := rt.RunString(tt.matcher)
+			require.NoError(t, err)
+
+			pass, err := tc.mi.CheckBody(rt.ToValue(resp).ToObject(rt), matcher)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, tt.name, checkName)
+		})
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	t.Parallel()
+
+	headers := map[string]string{"content-type": "application/json; charset=utf-8", "Cache-Control": "no-cache"}
+	tests := map[string]struct {
+		header   string
+		expected string
+		pass     bool
+		name     string
+	}{
+		"exact match":           {header: "Cache-Control", expected: `"no-cache"`, pass: true, name: "header Cache-Control is no-cache"},
+		"case insensitive name": {header: "Content-Type", expected: `"application/json; charset=utf-8"`, pass: true, name: "header Content-Type is application/json; charset=utf-8"},
+		"exact mismatch":        {header: "Cache-Control", expected: `"no-store"`, pass: false, name: "header Cache-Control is no-store"},
+		"regexp match":          {header: "content-TYPE", expected: `/^application\/json/`, pass: true, name: `header content-TYPE is /^application\/json/`},
+		"missing header":        {header: "ETag", expected: `/.*/`, pass: false, name: "header ETag is /.*/"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Headers = headers
+			expected, err := rt.RunString(tt.expected)
+			require.NoError(t, err)
+
+			pass, err := tc.mi.CheckHeader(rt.ToValue(resp).ToObject(rt), tt.header, expected)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, tt.name, checkName)
+		})
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	t.Parallel()
+
+	body := `{"status":{"ok":true,"code":200},"name":"fast","tags":["a","b"]}`
+	tests := map[string]struct {
+		body     interface{}
+		path     string
+		expected string
+		pass     bool
+		name     string
+	}{
+		"bool":              {body: body, path: "status.ok", expected: `true`, pass: true, name: "json status.ok is true"},
+		"number":            {body: body, path: "status.code", expected: `200`, pass: true, name: "json status.code is 200"},
+		"string":            {body: []byte(body), path: "name", expected: `"fast"`, pass: true, name: `json name is "fast"`},
+		"array":             {body: body, path: "tags", expected: `["a", "b"]`, pass: true, name: `json tags is ["a","b"]`},
+		"mismatch":          {body: body, path: "status.code", expected: `201`, pass: false, name: "json status.code is 201"},
+		"missing path":      {body: body, path: "status.missing", expected: `null`, pass: false, name: "json status.missing is null"},
+		"invalid json body": {body: "<html></html>", path: "status.ok", expected: `true`, pass: false, name: "json status.ok is true"},
+		"nil body":          {body: nil, path: "status.ok", expected: `true`, pass: false, name: "json status.ok is true"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Body = tt.body
+			expected, err := rt.RunString("(" + tt.expected + ")")
+			require.NoError(t, err)
+
+			pass, err := tc.mi.CheckJSON(rt.ToValue(resp).ToObject(rt), tt.path, expected)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, tt.name, checkName)
+		})
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	t.Parallel()
+
+	schema := `{
+		"title": "user",
+		"type": "object",
+		"required": ["id", "name"],
+		"properties": {"id": {"type": "integer", "minimum": 1}, "name": {"type": "string"}}
+	}`
+	tests := map[string]struct {
+		body   interface{}
+		schema string
+		pass   bool
+		logs   []string
+	}{
+		"valid":          {body: `{"id": 1, "name": "fast"}`, schema: schema, pass: true},
+		"schema as text": {body: []byte(`{"id": 1, "name": "fast"}`), schema: "`" + schema + "`", pass: true},
+		"invalid": {
+			body: `{"id": 0}`, schema: schema, pass: false,
+			logs: []string{
+				`json matches schema user failed at "#": missing properties: 'name'`,
+				`json matches schema user failed at "#/id": must be >= 1 but found 0`,
+			},
+		},
+		"invalid json body": {body: "<html></html>", schema: schema, pass: false, logs: []string{"Response body for json matches schema user isn't JSON"}},
+		"nil body":          {body: nil, schema: schema, pass: false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Body = tt.body
+			schema, err := rt.RunString("(" + tt.schema + ")")
+			require.NoError(t, err)
+
+			pass, err := tc.mi.CheckSchema(rt.ToValue(resp).ToObject(rt), schema)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, "json matches schema user", checkName)
+
+			var logs []string
+			for _, entry := range tc.logs.AllEntries() {
+				logs = append(logs, entry.Message)
+			}
+			require.ElementsMatch(t, tt.logs, logs)
+		})
+	}
+
+	tc := newCheckTestCase(t)
+	rt := tc.runtime.VU.Runtime()
+	_, err := tc.mi.CheckSchema(rt.ToValue(tc.response(200)).ToObject(rt), rt.ToValue(`{"type": 1}`))
+	require.ErrorContains(t, err, "invalid JSON Schema")
+
+	// references can't reach outside the schema, though drafts are known without loading them
+	for _, ref := range []string{"https://example.com/user.json", "user.json", "file:///etc/passwd"} {
+		_, err = tc.mi.CheckSchema(rt.ToValue(tc.response(200)).ToObject(rt), rt.ToValue(`{"$ref": "`+ref+`"}`))
+		require.ErrorContains(t, err, "can't be loaded, only references within the schema are")
+	}
+	_, err = tc.mi.CheckSchema(rt.ToValue(tc.response(200)).ToObject(rt),
+		rt.ToValue(`{"$schema": "http://json-schema.org/draft-07/schema#", "$ref": "#/definitions/id", "definitions": {"id": {}}}`))
+	require.NoError(t, err)
+}
+
+func TestCheckSchemaCache(t *testing.T) {
+	t.Parallel()
+
+	tc := newCheckTestCase(t)
+	rt := tc.runtime.VU.Runtime()
+	resp := tc.response(200)
+	resp.Body = `{"id": 1}`
+
+	// objects are compiled once, as they were when first checked against
+	schema, err := rt.RunString(`var schema = {type: "object"}; schema`)
+	require.NoError(t, err)
+	for _, change := range []string{`schema.type = "array"`, `schema.title = "changed"`} {
+		pass, err := tc.mi.CheckSchema(rt.ToValue(resp).ToObject(rt), schema)
+		require.NoError(t, err)
+		require.True(t, pass)
+		_, err = rt.RunString(change)
+		require.NoError(t, err)
+	}
+	require.Len(t, tc.mi.schemas, 1)
+
+	// distinct schemas past the limit are compiled on every check rather than kept
+	for i := range maxCachedSchemas + 10 {
+		pass, err := tc.mi.CheckSchema(rt.ToValue(resp).ToObject(rt), rt.ToValue(fmt.Sprintf(`{"maxProperties": %d}`, i+1)))
+		require.NoError(t, err)
+		require.True(t, pass)
+	}
+	require.Len(t, tc.mi.schemas, maxCachedSchemas)
+}
+
+func TestCheckDuration(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		duration float64
+		pass     bool
+	}{
+		"under threshold": {duration: 12.5, pass: true},
+		"over threshold":  {duration: 250, pass: false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Timings.Duration = tt.duration
+
+			pass, err := tc.mi.CheckDuration(rt.ToValue(resp).ToObject(rt), 100)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, "duration is below 100ms", checkName)
+		})
+	}
+}
+
+func TestCheckCORS(t *testing.T) {
+	t.Parallel()
+
+	const origin = "https://app.example.com"
+	tests := map[string]struct {
+		headers map[string]string
+		method  string
+		pass    bool
+	}{
+		"matching origin": {
+			headers: map[string]string{"Access-Control-Allow-Origin": origin},
+			method:  "GET", pass: true,
+		},
+		"wildcard origin": {
+			headers: map[string]string{"access-control-allow-origin": "*"},
+			method:  "POST", pass: true,
+		},
+		"other origin": {
+			headers: map[string]string{"Access-Control-Allow-Origin": "https://other.example.com"},
+			method:  "GET", pass: false,
+		},
+		"missing origin": {
+			headers: map[string]string{},
+			method:  "GET", pass: false,
+		},
+		"credentialed wildcard origin": {
+			headers: map[string]string{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": "true"},
+			method:  "GET", pass: false,
+		},
+		"credentialed matching origin": {
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Credentials": "true"},
+			method:  "GET", pass: true,
+		},
+		"allowed method": {
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Methods": "GET, PUT, DELETE"},
+			method:  "DELETE", pass: true,
+		},
+		"disallowed method": {
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Methods": "GET, PUT"},
+			method:  "DELETE", pass: false,
+		},
+		"allowed method in another case": {
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Methods": "get, put"},
+			method:  "PUT", pass: true,
+		},
+		"wildcard method": {
+			headers: map[string]string{"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Methods": "*"},
+			method:  "PATCH", pass: true,
+		},
+		"credentialed wildcard method": {
+			headers: map[string]string{
+				"Access-Control-Allow-Origin": origin, "Access-Control-Allow-Methods": "*", "Access-Control-Allow-Credentials": "true",
+			},
+			method: "PATCH", pass: false,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(204)
+			resp.Headers = tt.headers
+
+			pass, err := tc.mi.CheckCORS(rt.ToValue(resp).ToObject(rt), origin, tt.method)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, "cors allows "+tt.method+" from "+origin, checkName)
+		})
+	}
+}
+
+func TestCheckContentLength(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		headers   map[string]string
+		err       string
+		errorCode int
+		pass      bool
+	}{
+		"declared": {headers: map[string]string{"content-length": "42"}, pass: true},
+		"missing":  {headers: map[string]string{"Transfer-Encoding": "chunked"}, pass: false},
+		"invalid":  {headers: map[string]string{"Content-Length": "-1"}, pass: false},
+		"body cut short": {
+			headers: map[string]string{"Content-Length": "42"}, err: "response body cut short", errorCode: 1704, pass: false,
+		},
+		// failed for its status, its body being read in full
+		"unexpected status": {headers: map[string]string{"Content-Length": "42"}, errorCode: 1503, pass: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Headers = tt.headers
+			resp.Error = tt.err
+			resp.ErrorCode = tt.errorCode
+
+			pass, err := tc.mi.CheckContentLength(rt.ToValue(resp).ToObject(rt))
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, "content-length matches body", checkName)
+		})
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		algo     string
+		expected string
+		pass     bool
+	}{
+		"sha256":     {algo: "sha256", expected: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", pass: true},
+		"upper case": {algo: "MD5", expected: "5D41402ABC4B2A76B9719D911017C592", pass: true},
+		"crc32":      {algo: "crc32", expected: "3610a686", pass: true},
+		"mismatch":   {algo: "sha1", expected: "0000", pass: false},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			tc := newCheckTestCase(t)
+			rt := tc.runtime.VU.Runtime()
+
+			resp := tc.response(200)
+			resp.Body = "hello"
+
+			pass, err := tc.mi.CheckHash(rt.ToValue(resp).ToObject(rt), tt.algo, tt.expected)
+			require.NoError(t, err)
+			require.Equal(t, tt.pass, pass)
+
+			checkName, ok := tc.lastCheckSample(t).Tags.Get("check")
+			require.True(t, ok)
+			require.Equal(t, "body "+strings.ToLower(tt.algo)+" is "+tt.expected, checkName)
+		})
+	}
+
+	tc := newCheckTestCase(t)
+	rt := tc.runtime.VU.Runtime()
+	resp := tc.response(200)
+	resp.Body = "hello"
+	_, err := tc.mi.CheckHash(rt.ToValue(resp).ToObject(rt), "sha512", "00")
+	require.ErrorContains(t, err, `unsupported hash "sha512"`)
+}
+
+func TestCheckSummary(t *testing.T) {
+	t.Parallel()
+
+	tc := newCheckTestCase(t)
+	rt := tc.runtime.VU.Runtime()
+	// as set by k6 for the root group
+	tc.runtime.VU.State().Tags.Modify(func(tagsAndMeta *metrics.TagsAndMeta) {
+		tagsAndMeta.SetTag("group", lib.RootGroupPath)
+	})
+
+	ok := rt.ToValue(tc.response(200)).ToObject(rt)
+	failed := rt.ToValue(tc.response(500)).ToObject(rt)
+	for _, r := range []*sobek.Object{ok, ok, failed} {
+		_, err := tc.mi.CheckStatus(200, r)
+		require.NoError(t, err)
+		_, err = tc.mi.CheckBody(r, rt.ToValue("a::b"))
+		require.NoError(t, err)
+	}
+
+	summary := lib.NewGroupSummary(testutils.NewLogger(t))
+	require.NoError(t, summary.Start())
+	summary.AddMetricSamples(metrics.GetBufferedSamples(tc.samples))
+	require.NoError(t, summary.Stop())
+
+	checks := summary.Group().Checks
+	require.Len(t, checks, 2)
+	require.Equal(t, int64(2), checks["check status is 200"].Passes)
+	require.Equal(t, int64(1), checks["check status is 200"].Fails)
+	require.Equal(t, int64(3), checks["body contains a: :b"].Fails)
+}
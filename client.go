@@ -1,15 +1,27 @@
 package fasthttp
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net"
+	nethttp "net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	e "github.com/domsolutions/xk6-fasthttp/errors"
 	"github.com/domsolutions/xk6-fasthttp/metrics"
 	"github.com/domsolutions/xk6-fasthttp/tracer"
 	"github.com/grafana/sobek"
@@ -18,37 +30,158 @@ import (
 	"go.k6.io/k6/js/common"
 	"go.k6.io/k6/js/modules"
 	"go.k6.io/k6/lib/netext/httpext"
+	k6metrics "go.k6.io/k6/metrics"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/idna"
+	"golang.org/x/time/rate"
 )
 
 const (
 	defaultDialTimeout     = 5 * time.Second
-	defaultMaxConnsPerHost = 1
+	defaultMaxConnsPerHost = http.DefaultMaxConnsPerHost
+	// defaultReadBufferSize is large enough for responses with large headers i.e. JWTs in cookies,
+	// as response headers must fit in the read buffer. fasthttp's own default is 4KB.
+	defaultReadBufferSize = 16 * 1024
+
+	// streamResponseBodyThreshold is the body size above which responses are streamed from the
+	// connection rather than buffered by fasthttp, so bodies saved to file never sit in memory
+	streamResponseBodyThreshold = 64 * 1024
+
+	// defaultUserAgent and defaultContentType are fasthttp's, sent by requests disabling its
+	// special headers as regular ones
+	defaultUserAgent   = "fasthttp"
+	defaultContentType = "application/octet-stream"
 )
 
 type ClientConfig struct {
-	DialTimeout     int
-	Proxy           string
-	MaxConnDuration int
-	UserAgent       string
-	ReadBufferSize  int
-	WriteBufferSize int
-	ReadTimeout     int
-	WriteTimeout    int
-	MaxConnsPerHost int
-	TLSConfig       TLSConfig
+	// Name identifies the client across VUs, whose clients of the same name share its rate_limit
+	// and single_flight
+	Name                      string
+	DialTimeout               int
+	Proxy                     string
+	NoProxy                   string
+	MaxConnDuration           int
+	UserAgent                 string
+	ReadBufferSize            int
+	WriteBufferSize           int
+	ReadTimeout               int
+	WriteTimeout              int
+	MaxConnsPerHost           int
+	DisableKeepAlive          bool
+	SingleFlight              bool
+	MaxConnWaitTimeout        int
+	MaxIdleConnDuration       int
+	MaxIdemponentCallAttempts int
+	MaxResponseBodySize       int
+	MaxRedirects              int
+	RetryAfter                *RetryAfterConfig
+	TCPKeepAlive              *int
+	NormalizeHeaders          bool
+	RateLimit                 int
+	HTTP2                     bool `js:"http2"`
+	Pipeline                  *PipelineConfig
+	LocalAddr                 string
+	LocalAddrs                []string
+	DefaultHeaders            map[string]string
+	IdentityHeaders           map[string]string
+	BearerToken               string
+	Debug                     bool
+	TLSTags                   bool
+	TLSConfig                 TLSConfig
 }
 
 type TLSConfig struct {
 	InsecureSkipVerify bool
-	PrivateKey         string
-	Certificate        string
+	// SessionTickets caches sessions so later connections to a server resume them
+	SessionTickets bool
+	// Renegotiation is whether servers may renegotiate the connection, "never", "once" or "freely"
+	Renegotiation string
+	PrivateKey    string
+	Certificate   string
+	Certificates  []ClientCertificate
+	// NextProtos are the protocols offered through ALPN, in order of preference, none by default
+	// other than h2 and http/1.1 with http2 enabled
+	NextProtos []string
+}
+
+// tlsRenegotiation returns the renegotiation support named by the tls_config.renegotiation option,
+// which defaults to never
+func tlsRenegotiation(name string) (tls.RenegotiationSupport, error) {
+	switch name {
+	case "", "never":
+		return tls.RenegotiateNever, nil
+	case "once":
+		return tls.RenegotiateOnceAsClient, nil
+	case "freely":
+		return tls.RenegotiateFreelyAsClient, nil
+	default:
+		return 0, fmt.Errorf(`unknown tls_config.renegotiation %q, expected "never", "once" or "freely"`, name)
+	}
 }
 
 type Client struct {
-	fhc              *http.Client
-	vu               modules.VU
-	metrics          *metrics.MetricDispatcher
-	metricsSetupOnce *sync.Once
+	fhc doer
+	// flippedVerifyFhc is fhc with insecure_skip_verify flipped, for requests overriding it
+	flippedVerifyFhc doer
+	// timeoutFhcs are the clients of requests overriding read_timeout or write_timeout
+	timeoutFhcs        *timeoutDoers
+	insecureSkipVerify bool
+	conns              *openConns
+	raw                *rawSender
+	vu                 modules.VU
+	metrics            *metrics.MetricDispatcher
+	moduleMetrics      *metrics.ModuleMetrics
+	metricsSetupOnce   *sync.Once
+	responseCallback   func(int) bool
+	defaultHeaders     []header
+	bearerToken        string
+	userAgent          string
+	maxBodySize        int
+	maxRedirects       int
+	retryAfter         *RetryAfterConfig
+	maxConnsPerHost    int
+	disableKeepAlive   bool
+	normalizeHeaders   bool
+	debug              bool
+	tlsTags            bool
+	pipelined          bool
+	rateLimiter        *rate.Limiter
+	// errorClassifier maps requests' status and error code to the script's own, nil for the defaults
+	errorClassifier sobek.Callable
+	// flights coalesces identical requests in flight, nil unless single_flight is set
+	flights *flights
+	// identityHeaders are set on every send with the VU's id and iteration, sorted by name
+	identityHeaders []identityHeader
+}
+
+// identityHeader is a header of identity_headers whose value is expanded on every send
+type identityHeader struct {
+	name  string
+	value *template
+}
+
+// parseIdentityHeaders compiles the identity_headers option, whose values may only use the {{vu}}
+// and {{iter}} placeholders
+func parseIdentityHeaders(headers map[string]string) ([]identityHeader, error) {
+	parsed := make([]identityHeader, 0, len(headers))
+	for _, h := range sortedHeaders(headers) {
+		tmpl, err := parseTemplate("identity_headers", h.value)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range tmpl.names {
+			if name != "vu" && name != "iter" {
+				return nil, fmt.Errorf("unknown identity_headers placeholder %q, expected vu or iter", name)
+			}
+		}
+		parsed = append(parsed, identityHeader{name: h.name, value: tmpl})
+	}
+	return parsed, nil
+}
+
+type header struct {
+	name  string
+	value string
 }
 
 func (mi *ModuleInstance) Client(call sobek.ConstructorCall, rt *sobek.Runtime) *sobek.Object {
@@ -62,39 +195,195 @@ func (mi *ModuleInstance) Client(call sobek.ConstructorCall, rt *sobek.Runtime)
 		common.Throw(rt, fmt.Errorf("client constructor expects first argument to be ClientConfig got error %v", err))
 	}
 
-	var fhc *http.Client
-	if fhc, err = parseClientConfig(config); err != nil {
+	fhc, flippedVerifyFhc, timeoutFhcs, conns, raw, err := parseClientConfig(config)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+	identityHeaders, err := parseIdentityHeaders(config.IdentityHeaders)
+	if err != nil {
 		common.Throw(rt, err)
 	}
 
-	c := &Client{fhc: fhc, vu: mi.vu, metricsSetupOnce: &sync.Once{}}
+	c := &Client{
+		fhc:                fhc,
+		flippedVerifyFhc:   flippedVerifyFhc,
+		timeoutFhcs:        timeoutFhcs,
+		insecureSkipVerify: config.TLSConfig.InsecureSkipVerify,
+		conns:              conns,
+		raw:                raw,
+		vu:                 mi.vu,
+		moduleMetrics:      mi.metrics,
+		metricsSetupOnce:   &sync.Once{},
+		responseCallback:   defaultExpectedStatuses.match,
+		defaultHeaders:     sortedHeaders(config.DefaultHeaders),
+		bearerToken:        config.BearerToken,
+		userAgent:          cmp.Or(config.UserAgent, defaultUserAgent),
+		maxBodySize:        config.MaxResponseBodySize,
+		maxRedirects:       config.MaxRedirects,
+		retryAfter:         config.RetryAfter,
+		maxConnsPerHost:    config.MaxConnsPerHost,
+		disableKeepAlive:   config.DisableKeepAlive,
+		normalizeHeaders:   config.NormalizeHeaders,
+		debug:              config.Debug,
+		tlsTags:            config.TLSTags,
+		pipelined:          config.Pipeline != nil,
+		identityHeaders:    identityHeaders,
+	}
+
+	// VUs run the same init code so unless named the nth client of every VU is the same client,
+	// sharing its limit
+	var key interface{} = config.Name
+	if config.Name == "" {
+		mi.clients++
+		key = mi.clients
+	}
+	c.rateLimiter, err = mi.root.rateLimiter(key, config.RateLimit)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+	if config.SingleFlight {
+		fl, _ := mi.root.flights.LoadOrStore(key, newFlights())
+		c.flights = fl.(*flights)
+	}
 	return rt.ToValue(c).ToObject(rt)
 }
 
-func parseClientConfig(config ClientConfig) (*http.Client, error) {
+// rateLimiter returns the limiter shared by the clients of key, nil without a limit. The limit is
+// recorded either way so a client of key can't set another one than the first, which would be
+// ignored
+func (r *RootModule) rateLimiter(key interface{}, limit int) (*rate.Limiter, error) {
+	limit = max(limit, 0)
+	var limiter *rate.Limiter
+	if limit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(limit), 1)
+	}
+	shared, _ := r.rateLimiters.LoadOrStore(key, limiter)
+	sharedLimiter := shared.(*rate.Limiter)
+
+	var sharedLimit int
+	if sharedLimiter != nil {
+		sharedLimit = int(sharedLimiter.Limit())
+	}
+	if sharedLimit != limit {
+		name := fmt.Sprintf("%q", key)
+		if index, ok := key.(int); ok {
+			name = fmt.Sprintf("#%d of the init code", index)
+		}
+		return nil, fmt.Errorf("client %s was already created with rate_limit %d, not %d", name, sharedLimit, limit)
+	}
+	return sharedLimiter, nil
+}
+
+// parseClientConfig returns the client as configured, the same client with InsecureSkipVerify
+// flipped and the clients of requests overriding its timeouts, all dialing through the same set of
+// open connections as the sender of raw requests
+func parseClientConfig(config ClientConfig) (doer, doer, *timeoutDoers, *openConns, *rawSender, error) {
 	if config.TLSConfig.PrivateKey != "" && config.TLSConfig.Certificate == "" {
-		return nil, errors.New("blank certificate")
+		return nil, nil, nil, nil, nil, errors.New("blank certificate")
 	}
 	if config.TLSConfig.PrivateKey == "" && config.TLSConfig.Certificate != "" {
-		return nil, errors.New("blank private key")
+		return nil, nil, nil, nil, nil, errors.New("blank private key")
+	}
+	if config.HTTP2 && config.Pipeline != nil {
+		return nil, nil, nil, nil, nil, errors.New("http2 and pipeline can't both be enabled")
+	}
+	if config.DisableKeepAlive && (config.HTTP2 || config.Pipeline != nil) {
+		// their connections are shared by concurrent requests rather than closed after one
+		return nil, nil, nil, nil, nil, errors.New("disable_keep_alive can't be combined with http2 or pipeline")
+	}
+	if config.MaxConnWaitTimeout > 0 && (config.HTTP2 || config.Pipeline != nil) {
+		// HTTP/2 streams and pipelined requests queue on their connections rather than waiting for one
+		return nil, nil, nil, nil, nil, errors.New("max_conn_wait_timeout can't be combined with http2 or pipeline")
+	}
+	if config.RetryAfter != nil {
+		if err := config.RetryAfter.validate(); err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+	}
+	renegotiation, err := tlsRenegotiation(config.TLSConfig.Renegotiation)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
 	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: config.TLSConfig.InsecureSkipVerify,
+		Renegotiation:      renegotiation,
+		NextProtos:         config.TLSConfig.NextProtos,
+	}
+	if config.TLSConfig.SessionTickets {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
 	}
 
 	if config.TLSConfig.Certificate != "" && config.TLSConfig.PrivateKey != "" {
 		cert, err := tls.LoadX509KeyPair(config.TLSConfig.Certificate, config.TLSConfig.PrivateKey)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load key/cert; %v", err)
+			return nil, nil, nil, nil, nil, fmt.Errorf("failed to load key/cert; %v", err)
 		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	if len(config.TLSConfig.Certificates) > 0 {
+		certs, err := loadClientCertificates(config.TLSConfig.Certificates)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		// the single certificate is presented to any server after those listed
+		for _, cert := range tlsConfig.Certificates {
+			certs = append(certs, clientCertificate{cert: cert})
+		}
+		tlsConfig.GetClientCertificate = getClientCertificate(certs)
+	}
+
 	maxConnsPerHost := defaultMaxConnsPerHost
 	if config.MaxConnsPerHost > 0 {
 		maxConnsPerHost = config.MaxConnsPerHost
 	}
 
+	if config.ReadBufferSize <= 0 {
+		config.ReadBufferSize = defaultReadBufferSize
+	}
+
+	timeout := defaultDialTimeout
+	if config.DialTimeout > 0 {
+		timeout = time.Duration(config.DialTimeout) * time.Second
+	}
+
+	dial, err := newRawDialFunc(config, timeout)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	conns := newOpenConns()
+	dial = conns.dialFunc(dial)
+
+	flippedTLSConfig := tlsConfig.Clone()
+	flippedTLSConfig.InsecureSkipVerify = !tlsConfig.InsecureSkipVerify
+
+	raw := &rawSender{
+		dial: dial, dialTimeout: timeout, readTimeout: time.Duration(config.ReadTimeout) * time.Second,
+		writeTimeout: time.Duration(config.WriteTimeout) * time.Second, sendTimeout: defaultRawSendTimeout,
+		readBufferSize: config.ReadBufferSize, tlsConfig: tlsConfig, flippedTLSConfig: flippedTLSConfig,
+	}
+	if raw.readTimeout > 0 {
+		raw.sendTimeout = raw.readTimeout
+	}
+	timeoutFhcs := &timeoutDoers{
+		doers:        make(map[timeoutKey]doer),
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+		newDoer: func(key timeoutKey) doer {
+			overridden := config
+			overridden.ReadTimeout, overridden.WriteTimeout = key.readTimeout, key.writeTimeout
+			if key.flippedVerify {
+				return newDoer(overridden, dial, timeout, maxConnsPerHost, flippedTLSConfig)
+			}
+			return newDoer(overridden, dial, timeout, maxConnsPerHost, tlsConfig)
+		},
+	}
+	return newDoer(config, dial, timeout, maxConnsPerHost, tlsConfig),
+		newDoer(config, dial, timeout, maxConnsPerHost, flippedTLSConfig), timeoutFhcs, conns, raw, nil
+}
+
+// newDoer returns the client for the configured protocol, establishing TLS connections with tlsConfig
+func newDoer(config ClientConfig, dial http.DialFunc, timeout time.Duration, maxConnsPerHost int, tlsConfig *tls.Config) doer {
 	fhc := &http.Client{
 		Name:                          config.UserAgent,
 		MaxConnDuration:               time.Duration(config.MaxConnDuration) * time.Second,
@@ -103,21 +392,306 @@ func parseClientConfig(config ClientConfig) (*http.Client, error) {
 		WriteTimeout:                  time.Duration(config.WriteTimeout) * time.Second,
 		ReadTimeout:                   time.Duration(config.ReadTimeout) * time.Second,
 		MaxConnsPerHost:               maxConnsPerHost,
-		DisableHeaderNamesNormalizing: true,
-		TLSConfig:                     tlsConfig,
-		Dial: func(addr string) (net.Conn, error) {
-			timeout := defaultDialTimeout
-			if config.DialTimeout > 0 {
-				timeout = time.Duration(config.DialTimeout) * time.Second
+		MaxConnWaitTimeout:            time.Duration(config.MaxConnWaitTimeout) * time.Second,
+		MaxIdleConnDuration:           time.Duration(config.MaxIdleConnDuration) * time.Second,
+		MaxIdemponentCallAttempts:     config.MaxIdemponentCallAttempts,
+		DisableHeaderNamesNormalizing: !config.NormalizeHeaders,
+		// the body size limit is enforced when reading as larger bodies are streamed rather than rejected
+		MaxResponseBodySize: streamResponseBodyThreshold,
+		StreamResponseBody:  true,
+		TLSConfig:           tlsConfig,
+		ConfigureClient: func(hc *http.HostClient) error {
+			hc.Dial = newDialFunc(dial, timeout, tlsConfig, hc.IsTLS)
+			hc.Transport = abortTransport{}
+			return nil
+		},
+	}
+
+	switch {
+	case config.Pipeline != nil:
+		return newPipelineClient(config, dial, timeout, tlsConfig)
+	case config.HTTP2:
+		return newHTTP2Client(http1Client{fhc}, dial, timeout, tlsConfig)
+	default:
+		return http1Client{fhc}
+	}
+}
+
+// newRawDialFunc returns the dialer establishing TCP connections, setting the keep-alive period of
+// each connection when configured.
+func newRawDialFunc(config ClientConfig, timeout time.Duration) (http.DialFunc, error) {
+	dial, err := newTCPDialFunc(config, timeout)
+	if err != nil || config.TCPKeepAlive == nil {
+		return dial, err
+	}
+
+	keepAlive := time.Duration(*config.TCPKeepAlive) * time.Second
+	return func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setKeepAlive(conn, keepAlive); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, nil
+}
+
+// setKeepAlive sets the keep-alive period of TCP connections, disabling it when 0
+func setKeepAlive(conn net.Conn, keepAlive time.Duration) error {
+	if c, ok := conn.(proxiedConn); ok {
+		conn = c.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if keepAlive <= 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(keepAlive)
+}
+
+// newTCPDialFunc returns the dialer establishing TCP connections, through the proxy if configured
+// unless no_proxy excludes the host. Connections through the proxy are wrapped in proxiedConn.
+// When local addresses are configured connections are bound to each of them in turn.
+func newTCPDialFunc(config ClientConfig, timeout time.Duration) (http.DialFunc, error) {
+	localAddrs := config.LocalAddrs
+	if config.LocalAddr != "" {
+		localAddrs = append([]string{config.LocalAddr}, localAddrs...)
+	}
+
+	direct, err := newLocalDialFunc(localAddrs, "", timeout)
+	if err != nil || config.Proxy == "" {
+		return direct, err
+	}
+	viaProxy, err := newLocalDialFunc(localAddrs, config.Proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+	noProxy, err := parseNoProxy(config.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(addr string) (net.Conn, error) {
+		if noProxy.matches(addr) {
+			return direct(addr)
+		}
+		conn, err := viaProxy(addr)
+		if err != nil {
+			return nil, err
+		}
+		return proxiedConn{Conn: conn}, nil
+	}, nil
+}
+
+// newLocalDialFunc returns the dialer establishing TCP connections through proxyURL, or directly
+// when empty, bound to each of localAddrs in turn
+func newLocalDialFunc(localAddrs []string, proxyURL string, timeout time.Duration) (http.DialFunc, error) {
+	if len(localAddrs) == 0 {
+		if proxyURL != "" {
+			return proxy.FasthttpHTTPDialerTimeout(proxyURL, timeout), nil
+		}
+		return func(addr string) (net.Conn, error) {
+			return http.DialTimeout(addr, timeout)
+		}, nil
+	}
+
+	dials := make([]http.DialFunc, 0, len(localAddrs))
+	for _, localAddr := range localAddrs {
+		tcpAddr, err := parseLocalAddr(localAddr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != "" {
+			proxyDialer := &proxy.Dialer{
+				TCPDialer:      http.TCPDialer{LocalAddr: tcpAddr},
+				Config:         httpproxy.Config{HTTPProxy: proxyURL, HTTPSProxy: proxyURL},
+				Timeout:        timeout,
+				ConnectTimeout: timeout,
 			}
-			if config.Proxy != "" {
-				return proxy.FasthttpHTTPDialerTimeout(config.Proxy, timeout)(addr)
+			dial, err := proxyDialer.GetDialFunc(false)
+			if err != nil {
+				return nil, err
 			}
-			return http.DialTimeout(addr, timeout)
-		},
+			dials = append(dials, dial)
+			continue
+		}
+
+		dialer := &http.TCPDialer{LocalAddr: tcpAddr}
+		dials = append(dials, func(addr string) (net.Conn, error) {
+			return dialer.DialTimeout(addr, timeout)
+		})
 	}
 
-	return fhc, nil
+	if len(dials) == 1 {
+		return dials[0], nil
+	}
+
+	var next atomic.Uint64
+	return func(addr string) (net.Conn, error) {
+		return dials[(next.Add(1)-1)%uint64(len(dials))](addr)
+	}, nil
+}
+
+// proxiedConn marks connections dialed through the proxy
+type proxiedConn struct {
+	net.Conn
+}
+
+// NetConn returns the connection to the proxy
+func (c proxiedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// isProxied reports whether conn, or a connection it wraps, was dialed through the proxy
+func isProxied(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case proxiedConn:
+			return true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+}
+
+// noProxy holds the hosts connected to directly despite the proxy
+type noProxy struct {
+	all     bool
+	domains []string
+	nets    []*net.IPNet
+}
+
+// parseNoProxy parses a comma-separated list of host names, which also exclude their subdomains,
+// IPs and CIDR ranges, "*" excluding every host
+func parseNoProxy(list string) (noProxy, error) {
+	var np noProxy
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case entry == "*":
+			np.all = true
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return noProxy{}, fmt.Errorf("invalid no_proxy entry %q; %v", entry, err)
+			}
+			np.nets = append(np.nets, ipNet)
+		default:
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				np.nets = append(np.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+			np.domains = append(np.domains, strings.TrimPrefix(entry, "."))
+		}
+	}
+	return np, nil
+}
+
+// matches reports whether the host of addr, a host:port, is connected to directly
+func (np noProxy) matches(addr string) bool {
+	if np.all {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range np.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range np.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLocalAddr parses an IP, optionally with a port, to bind outgoing connections to
+func parseLocalAddr(localAddr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		host, port = localAddr, "0"
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid local address %q", localAddr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local address %q; %v", localAddr, err)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// newDialFunc returns a dialer which traces every connection it establishes. TLS connections are
+// handshaked here rather than by fasthttp so the negotiated state can be recorded against the conn.
+func newDialFunc(dial http.DialFunc, timeout time.Duration, tlsConfig *tls.Config, isTLS bool) http.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		start := time.Now()
+
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		info := tracer.NewConnInfo(time.Since(start), 0)
+		info.Proxied = isProxied(conn)
+		tc := tracer.NewConn(conn, info)
+		if !isTLS {
+			return tc, nil
+		}
+
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			cfg.ServerName = host
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		// client certificates are selected for the server's name, which the certificate request lacks
+		ctx = context.WithValue(ctx, serverNameKey{}, cfg.ServerName)
+
+		start = time.Now()
+		tlsConn := tls.Client(tc, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = tlsConn.Close()
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, http.ErrTLSHandshakeTimeout
+			}
+			return nil, err
+		}
+		info.TLSHandshaking = time.Since(start)
+
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+		return tlsConn, nil
+	}
 }
 
 func (c *Client) verifyReq(r *sobek.Object) {
@@ -126,6 +700,28 @@ func (c *Client) verifyReq(r *sobek.Object) {
 	}
 }
 
+// requestOrURL returns r when it's a Request, or a new Request for it when it's an http or https URL
+func requestOrURL(r sobek.Value) (*RequestWrapper, error) {
+	if r == nil {
+		return nil, errors.New("expected a Request or a URL")
+	}
+	switch v := r.Export().(type) {
+	case *RequestWrapper:
+		return v, nil
+	case string:
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL %q; %w", v, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q, expected an http or https one", v)
+		}
+		return newRequestWrapper(v), nil
+	default:
+		return nil, errors.New("expected a Request or a URL")
+	}
+}
+
 func (c *Client) Options(r *sobek.Object) (*Response, error) {
 	c.verifyReq(r)
 	return c.makeReq(r.Export().(*RequestWrapper), http.MethodOptions)
@@ -156,155 +752,1254 @@ func (c *Client) Get(r *sobek.Object) (*Response, error) {
 	return c.makeReq(r.Export().(*RequestWrapper), http.MethodGet)
 }
 
-func setBody(method string, body interface{}) bool {
-	return body != nil && method != http.MethodHead && method != http.MethodGet
+func (c *Client) OptionsAsync(r *sobek.Object) *sobek.Promise {
+	c.verifyReq(r)
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), http.MethodOptions, nil)
+}
+
+func (c *Client) PutAsync(r *sobek.Object) *sobek.Promise {
+	c.verifyReq(r)
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), http.MethodPut, nil)
 }
 
-func (c *Client) setupCachedReq(reqw *RequestWrapper, method string) error {
-	if setBody(method, reqw.Body) {
+func (c *Client) PatchAsync(r *sobek.Object) *sobek.Promise {
+	c.verifyReq(r)
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), http.MethodPatch, nil)
+}
 
-		switch reqw.Body.(type) {
-		case *FileStream:
-			f := reqw.Body.(*FileStream)
-			// reset to beginning of file
-			if _, err := f.Seek(0, 0); err != nil {
-				c.vu.State().Logger.WithError(err).Error("Failed to reset stream to beginning")
-				return err
-			}
-			reqw.req.SetBodyStream(f, -1)
-		}
+func (c *Client) DeleteAsync(r *sobek.Object) *sobek.Promise {
+	c.verifyReq(r)
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), http.MethodDelete, nil)
+}
 
-		return nil
-	}
+func (c *Client) PostAsync(r *sobek.Object) *sobek.Promise {
+	c.verifyReq(r)
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), http.MethodPost, nil)
+}
 
-	// reset body as req may be a GET request which should have no body but cached req may have a body
-	reqw.req.SetBody(nil)
-	reqw.req.SetBodyStream(nil, 0)
-	reqw.req.Header.SetMethod(method)
-	return nil
+func (c *Client) GetAsync(r *sobek.Object) *sobek.Promise {
+	c.verifyReq(r)
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), http.MethodGet, nil)
 }
 
-func (c *Client) setupNewReq(reqw *RequestWrapper, method string) error {
-	reqw.req.SetRequestURI(reqw.Url)
+// Stream sends r with method, GET by default, handing onChunk each piece of the response body as
+// it's read so bodies which never end, such as server-sent events, can be consumed. The returned
+// promise resolves with the response, without a body, once the body ends or onChunk returns false.
+func (c *Client) Stream(r *sobek.Object, onChunk sobek.Value, method ...string) *sobek.Promise {
+	c.verifyReq(r)
+	callable, ok := sobek.AssertFunction(onChunk)
+	if !ok {
+		common.Throw(c.vu.Runtime(), errors.New("stream expects a function to call with each chunk of the body"))
+	}
+	m := http.MethodGet
+	if len(method) > 0 && method[0] != "" {
+		m = strings.ToUpper(method[0])
+	}
+	return c.makeAsyncReq(r.Export().(*RequestWrapper), m, callable)
+}
 
-	if reqw.Host != "" {
-		reqw.req.UseHostHeader = true
-		reqw.req.Header.SetHost(reqw.Host)
+// Graphql POSTs query and its variables as a GraphQL over HTTP JSON body to r, which is a Request
+// or a URL. Errors in the response's body are returned by its graphqlErrors().
+func (c *Client) Graphql(r sobek.Value, query string, variables sobek.Value) (*Response, error) {
+	reqw, err := requestOrURL(r)
+	if err != nil {
+		return nil, err
 	}
 
-	if setBody(method, reqw.Body) {
-		switch reqw.Body.(type) {
-		case string:
-			reqw.req.SetBody([]byte(reqw.Body.(string)))
-		case sobek.ArrayBuffer:
-			reqw.req.SetBody(reqw.Body.(sobek.ArrayBuffer).Bytes())
-		case *FileStream:
-			f := reqw.Body.(*FileStream)
-			// reset to beginning of file for fresh request
-			if _, err := f.Seek(0, 0); err != nil {
-				c.vu.State().Logger.WithError(err).Error("Failed to reset stream to beginning")
-				return err
-			}
-			reqw.req.SetBodyStream(f, -1)
-		default:
-			return errors.New("req body type not supported")
-		}
+	payload := map[string]interface{}{"query": query}
+	if !common.IsNullish(variables) {
+		payload["variables"] = variables.Export()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
 	}
 
-	if reqw.DisableKeepAlive {
-		reqw.req.Header.SetConnectionClose()
+	// sent as a copy as pooled requests keep the body they were first sent with
+	gql := reqw.copy()
+	gql.Body = string(body)
+	gql.rawBody = nil
+	gql.template = nil
+	if gql.Headers == nil {
+		gql.Headers = make(map[string]string, 1)
 	}
-	for field, val := range reqw.Headers {
-		reqw.req.Header.Set(field, val)
+	if !gql.hasHeader(http.HeaderContentType) {
+		gql.Headers[http.HeaderContentType] = "application/json"
 	}
 
-	reqw.req.Header.SetMethod(method)
-	return nil
+	return c.makeReq(gql, http.MethodPost)
 }
 
-func (c *Client) makeReq(req *RequestWrapper, method string) (*Response, error) {
-	if r := req.reqPool.Get(); r != nil {
-		req.req = r.(*http.Request)
-		if err := c.setupCachedReq(req, method); err != nil {
-			return nil, err
-		}
-	} else {
-		req.req = http.AcquireRequest()
-		if err := c.setupNewReq(req, method); err != nil {
-			return nil, err
-		}
+// Warmup establishes up to count pooled connections to the request's host by sending that many
+// concurrent OPTIONS requests, so the first measured requests don't pay the connect and TLS cost.
+// count must be at least 1, is capped at max_conns_per_host and no metrics are emitted.
+func (c *Client) Warmup(r *sobek.Object, count int) error {
+	c.verifyReq(r)
+	reqw := r.Export().(*RequestWrapper)
+	if c.disableKeepAlive {
+		return errors.New("warmup can't be used with disable_keep_alive as no connection is kept")
+	}
+	if count < 1 {
+		return fmt.Errorf("warmup count must be at least 1, got %d", count)
 	}
 
-	defer func() {
-		req.reqPool.Put(req.req)
-		req.req = nil
-	}()
+	maxConns := defaultMaxConnsPerHost
+	if c.maxConnsPerHost > 0 {
+		maxConns = c.maxConnsPerHost
+	}
+	count = min(count, maxConns)
 
-	c.metricsSetupOnce.Do(func() {
-		tags := c.vu.State().Tags.GetCurrentValues()
-		c.metrics = metrics.NewMetricDispatcher(&tags, c.vu.State())
-	})
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			errs <- c.warmupConn(reqw)
+		}()
+	}
 
-	var resp *Response
 	var err error
-	if resp, err = c.do(c.vu.Context(), req); err != nil {
-		return nil, err
+	for i := 0; i < count; i++ {
+		err = errors.Join(err, <-errs)
 	}
-
-	return resp, nil
+	if err != nil {
+		return fmt.Errorf("warmup failed; %w", err)
+	}
+	return nil
 }
 
-func (c *Client) do(ctx context.Context, req *RequestWrapper) (response *Response, err error) {
-	resp := http.AcquireResponse()
+// WaitForStatus polls r, a Request or a URL, with GET requests every interval milliseconds until it
+// responds with wantStatus, returning false if it hasn't within timeout milliseconds. Failed requests
+// are polled again as the server may not be up yet. No metrics are emitted for the polls.
+func (c *Client) WaitForStatus(r sobek.Value, wantStatus, timeout, interval int) (bool, error) {
+	reqw, err := requestOrURL(r)
+	if err != nil {
+		return false, err
+	}
 
-	defer func() {
-		http.ReleaseResponse(resp)
-		if !req.Throw {
-			err = nil
+	parent := c.vu.Context()
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	for {
+		if status, err := c.pollStatus(ctx, reqw); err == nil && status == wantStatus {
+			return true, nil
 		}
-	}()
 
-	c.metrics.ProcessLastSavedRequest(c.vu.Context(), nil)
+		select {
+		case <-time.After(time.Duration(interval) * time.Millisecond):
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				return false, parent.Err()
+			}
+			return false, nil
+		}
+	}
+}
 
-	t1 := time.Now()
-	// send request on wire
-	err = c.fhc.Do(req.req, resp)
-	trial := &tracer.Trail{Duration: time.Since(t1)}
-
-	c.metrics.SaveCurrentRequest(c.vu.Context(), &metrics.UnfinishedRequest{
-		Ctx:      ctx,
-		Trail:    trial,
-		Request:  req.req,
-		Response: resp,
-		Err:      err,
-	})
+// pollStatus sends a GET for reqw returning its status, giving up once ctx is done
+func (c *Client) pollStatus(ctx context.Context, reqw *RequestWrapper) (int, error) {
+	req, err := c.acquireReq(reqw, http.MethodGet)
+	if err != nil {
+		return 0, err
+	}
+	defer reqw.reqPool.Put(req)
 
+	fhc, err := c.doerFor(reqw)
 	if err != nil {
-		if !req.Throw {
-			c.vu.State().Logger.WithError(err).Warn("Request Failed")
-		}
-		return nil, err
+		return 0, err
 	}
+	resp, _, err := c.sendAbortable(ctx, fhc, req, http.AcquireResponse())
+	defer http.ReleaseResponse(resp)
+	if err != nil {
+		return 0, err
+	}
+	// read to the end so the connection is returned to the pool
+	err = resp.BodyWriteTo(io.Discard)
+	resp.CloseBodyStream()
+	return resp.StatusCode(), err
+}
 
-	r := &httpext.Response{}
-	r.Status = resp.StatusCode()
-	r.RemoteIP = resp.RemoteAddr().String()
-	r.URL = req.req.URI().String()
+// Close closes every connection of the client as if it were restarted, requests in flight on them
+// failing. Later requests dial new connections.
+func (c *Client) Close() {
+	c.CloseIdle()
+	c.conns.closeAll()
+}
 
-	r.Headers = make(map[string]string)
-	resp.Header.VisitAll(func(key, value []byte) {
-		r.Headers[string(key)] = string(value)
-	})
+// CloseIdle closes the client's pooled connections which aren't serving a request
+func (c *Client) CloseIdle() {
+	c.fhc.CloseIdleConnections()
+	c.flippedVerifyFhc.CloseIdleConnections()
+	c.timeoutFhcs.closeIdle()
+}
+
+// doerFor returns the client to send reqw with, connections verifying the server's certificate
+// unless insecure_skip_verify is set on the request or, when unset there, on the client. Requests
+// overriding read_timeout or write_timeout are sent by a client of their own with those timeouts,
+// while those with request_target or expect_continue are written over a raw connection of their own
+// with the same overrides.
+func (c *Client) doerFor(reqw *RequestWrapper) (doer, error) {
+	flippedVerify := c.flipsVerify(reqw)
+	fhc := c.fhc
+	switch {
+	case reqw.RequestTarget != "" || reqw.ExpectContinue:
+		// the raw connections aren't pooled so any timeouts are fine
+	case reqw.ReadTimeout > 0 || reqw.WriteTimeout > 0:
+		var err error
+		if fhc, err = c.timeoutFhcs.get(reqw.ReadTimeout, reqw.WriteTimeout, flippedVerify); err != nil {
+			return nil, err
+		}
+	case flippedVerify:
+		fhc = c.flippedVerifyFhc
+	}
+	if reqw.RequestTarget != "" || reqw.ExpectContinue {
+		fhc = targetDoer{raw: c.rawFor(reqw), target: reqw.RequestTarget}
+	}
+	if reqw.Deadline > 0 {
+		return deadlineDoer{doer: fhc, deadline: time.UnixMilli(reqw.Deadline)}, nil
+	}
+	return fhc, nil
+}
+
+// flipsVerify returns whether reqw's insecure_skip_verify differs from the client's
+func (c *Client) flipsVerify(reqw *RequestWrapper) bool {
+	return reqw.InsecureSkipVerify != nil && *reqw.InsecureSkipVerify != c.insecureSkipVerify
+}
+
+// rawFor returns the sender of reqw's raw connections, with the timeouts and TLS verification it
+// overrides the client's with
+func (c *Client) rawFor(reqw *RequestWrapper) *rawSender {
+	flippedVerify := c.flipsVerify(reqw)
+	if reqw.ReadTimeout == 0 && reqw.WriteTimeout == 0 && !flippedVerify {
+		return c.raw
+	}
+
+	raw := *c.raw
+	if reqw.ReadTimeout > 0 {
+		raw.readTimeout = time.Duration(reqw.ReadTimeout) * time.Second
+	}
+	if reqw.WriteTimeout > 0 {
+		raw.writeTimeout = time.Duration(reqw.WriteTimeout) * time.Second
+	}
+	if flippedVerify {
+		raw.tlsConfig = c.raw.flippedTLSConfig
+	}
+	return &raw
+}
+
+// deadlineDoer sends every request with the DoDeadline of its doer
+type deadlineDoer struct {
+	doer
+	deadline time.Time
+}
+
+func (d deadlineDoer) Do(req *http.Request, resp *http.Response) (net.Addr, error) {
+	addr, err := d.doer.DoDeadline(req, resp, d.deadline)
+	if errors.Is(err, http.ErrTimeout) && !time.Now().Before(d.deadline) {
+		// reported as the request timing out rather than a read of the response
+		err = context.DeadlineExceeded
+	}
+	return addr, err
+}
+
+// maxTimeoutDoers is the number of combinations of timeouts a client's requests may override its own
+// with, as each has a pool of up to max_conns_per_host connections per host
+const maxTimeoutDoers = 8
+
+// timeoutDoers creates a client for each combination of timeouts requests override the client's
+// with, as fasthttp's read and write timeouts can only be shortened per request. Each keeps its own
+// pool of connections to the hosts it sends to, so there are at most maxTimeoutDoers.
+type timeoutDoers struct {
+	mu      sync.Mutex
+	doers   map[timeoutKey]doer
+	newDoer func(timeoutKey) doer
+	// readTimeout and writeTimeout are the client's, used for the timeout a request doesn't override
+	readTimeout, writeTimeout int
+}
+
+type timeoutKey struct {
+	readTimeout, writeTimeout int
+	flippedVerify             bool
+}
+
+// get returns the client sending with the timeouts in seconds, those which are 0 being the client's,
+// failing once maxTimeoutDoers clients were created for other combinations
+func (t *timeoutDoers) get(readTimeout, writeTimeout int, flippedVerify bool) (doer, error) {
+	key := timeoutKey{readTimeout: t.readTimeout, writeTimeout: t.writeTimeout, flippedVerify: flippedVerify}
+	if readTimeout > 0 {
+		key.readTimeout = readTimeout
+	}
+	if writeTimeout > 0 {
+		key.writeTimeout = writeTimeout
+	}
+
+	// async requests are sent off the event loop
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fhc, ok := t.doers[key]
+	if !ok {
+		if len(t.doers) >= maxTimeoutDoers {
+			return nil, fmt.Errorf("at most %d combinations of read_timeout, write_timeout and "+
+				"insecure_skip_verify can be overridden per client, each pooling connections of its own", maxTimeoutDoers)
+		}
+		fhc = t.newDoer(key)
+		t.doers[key] = fhc
+	}
+	return fhc, nil
+}
+
+func (t *timeoutDoers) closeIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, fhc := range t.doers {
+		fhc.CloseIdleConnections()
+	}
+}
+
+func (c *Client) warmupConn(reqw *RequestWrapper) error {
+	// not HEAD as fasthttp closes the connection when a HEAD response has no Content-Length, which
+	// servers commonly omit
+	req, err := c.acquireReq(reqw, http.MethodOptions)
+	if err != nil {
+		return err
+	}
+	defer reqw.reqPool.Put(req)
+
+	resp := http.AcquireResponse()
+	defer http.ReleaseResponse(resp)
+
+	fhc, err := c.doerFor(reqw)
+	if err != nil {
+		return err
+	}
+	addr, err := fhc.Do(req, resp)
+	if err != nil {
+		return err
+	}
+	// the connect time was paid here so it isn't reported by the first request reusing the connection
+	if info := tracer.ConnInfoFromAddr(addr); info != nil {
+		info.MarkUsed()
+	}
+	// read to the end so the connection is returned to the pool
+	err = resp.BodyWriteTo(io.Discard)
+	resp.CloseBodyStream()
+	return err
+}
+
+// sortedHeaders copies headers ordered by name so they're always set on requests in the same order
+func sortedHeaders(headers map[string]string) []header {
+	sorted := make([]header, 0, len(headers))
+	for name, value := range headers {
+		sorted = append(sorted, header{name: name, value: value})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+	return sorted
+}
+
+func hasHeader(headers map[string]string, name string) bool {
+	for field := range headers {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// setBody reports whether the request's body is sent with method, GET requests only carrying one
+// when allowed
+func setBody(method string, reqw *RequestWrapper) bool {
+	if reqw.Body == nil && reqw.rawBody == nil && reqw.template == nil {
+		return false
+	}
+	switch method {
+	case http.MethodHead:
+		return false
+	case http.MethodGet:
+		return reqw.AllowBodyOnGet
+	default:
+		return true
+	}
+}
+
+// setupCachedReq prepares a request built by an earlier send of reqw, possibly with another method,
+// for sending with method
+func (c *Client) setupCachedReq(reqw *RequestWrapper, req *http.Request, method string) error {
+	return c.setReqBody(reqw, req, method)
+}
+
+func (c *Client) setupNewReq(reqw *RequestWrapper, req *http.Request, method string) error {
+	// names are normalized as they're set so this must come before any headers
+	if !c.normalizeHeaders {
+		req.Header.DisableNormalizing()
+	}
+	if reqw.DisableAutoHost {
+		// headers are then sent only as set, fasthttp no longer adding Host, User-Agent or
+		// Content-Type from the URL and client itself, so the User-Agent is set first as it would be
+		req.Header.DisableSpecialHeader()
+		if !reqw.hasHeader(http.HeaderUserAgent) {
+			req.Header.Set(http.HeaderUserAgent, c.userAgent)
+		}
+	}
+	uri, err := asciiURL(reqw.Url)
+	if err != nil {
+		return err
+	}
+	req.SetRequestURI(uri)
+
+	host, err := asciiHost(reqw.Host)
+	if err != nil {
+		return err
+	}
+	if host != "" && reqw.DisableAutoHost {
+		req.Header.Set(http.HeaderHost, host)
+	} else if host != "" {
+		req.UseHostHeader = true
+		req.Header.SetHost(host)
+	}
+
+	if reqw.DisableKeepAlive || c.disableKeepAlive {
+		req.Header.SetConnectionClose()
+		if reqw.DisableAutoHost {
+			req.Header.Set(http.HeaderConnection, "close")
+		}
+	}
+	// fasthttp writes headers in the order they're first set, so the ordered ones come first. Later
+	// headers of the same name replace their value in place.
+	for _, h := range reqw.OrderedHeaders {
+		req.Header.Add(h[0], h[1])
+	}
+	// an explicit Authorization header wins over the request's auth options, which win over the defaults
+	auth := reqw.authorization(c.bearerToken)
+	for _, h := range c.defaultHeaders {
+		if reqw.hasHeader(h.name) || (auth != "" && strings.EqualFold(h.name, http.HeaderAuthorization)) {
+			continue
+		}
+		req.Header.Set(h.name, h.value)
+	}
+	if auth != "" && reqw.AWSSig4 == nil && !reqw.hasHeader(http.HeaderAuthorization) {
+		req.Header.Set(http.HeaderAuthorization, auth)
+	}
+	for field, val := range reqw.Headers {
+		req.Header.Set(field, val)
+	}
+
+	return c.setReqBody(reqw, req, method)
+}
+
+// setReqBody sets req's method and the body sent with it, removing the body a request reused from
+// the pool was sent with by another method
+func (c *Client) setReqBody(reqw *RequestWrapper, req *http.Request, method string) error {
+	req.Header.SetMethod(method)
+
+	sendBody := setBody(method, reqw)
+	f, ok := reqw.Body.(*FileStream)
+	if ok {
+		setFileStreamHeaders(reqw, req, f, sendBody)
+	}
+	if reqw.DisableAutoHost && (!ok || f.contentType == "") {
+		c.setDefaultContentType(reqw, req, method)
+	}
+	if !sendBody {
+		// a chunked stream is gone once sent, though its Content-Length of -1 is left behind
+		if req.IsBodyStream() || len(req.Body()) > 0 || req.Header.ContentLength() != 0 {
+			req.ResetBody()
+			req.SetBodyStream(nil, 0)
+		}
+		return nil
+	}
+
+	switch {
+	case reqw.Chunked:
+		// the previous send read the stream to its end
+		return c.setChunkedBody(reqw, req)
+	case reqw.template != nil:
+		return reqw.template.fill(req, reqw.vars)
+	case reqw.rawBody != nil:
+		// sent as is, sharing the script's buffer rather than copying it
+		req.SetBodyRaw(reqw.rawBody)
+		return nil
+	}
+
+	switch body := reqw.Body.(type) {
+	case string:
+		req.SetBodyString(body)
+	case sobek.ArrayBuffer:
+		req.SetBody(body.Bytes())
+	case *FileStream:
+		// reset to beginning of file for fresh request
+		if _, err := body.Seek(0, 0); err != nil {
+			c.vu.State().Logger.WithError(err).Error("Failed to reset stream to beginning")
+			return err
+		}
+		if reqw.ContentLength != nil {
+			req.SetBodyStream(newLimitedStream(body, int64(*reqw.ContentLength)), *reqw.ContentLength)
+			return nil
+		}
+		req.SetBodyStream(body, -1)
+	default:
+		return errors.New("req body type not supported")
+	}
+	return nil
+}
+
+// setDefaultContentType sets the Content-Type fasthttp sends by default once special headers are
+// disabled, unless the request or the client's default headers set their own. Like fasthttp it
+// isn't sent with GET and HEAD, removing the one of a pooled request last sent by another method.
+func (c *Client) setDefaultContentType(reqw *RequestWrapper, req *http.Request, method string) {
+	if reqw.hasHeader(http.HeaderContentType) {
+		return
+	}
+	for _, h := range c.defaultHeaders {
+		if strings.EqualFold(h.name, http.HeaderContentType) {
+			return
+		}
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		req.Header.Del(http.HeaderContentType)
+		return
+	}
+	req.Header.Set(http.HeaderContentType, defaultContentType)
+}
+
+// setFileStreamHeaders sets the Content-Type and Content-Encoding of f when its body is sent and
+// the request hasn't set its own, removing them when it isn't
+func setFileStreamHeaders(reqw *RequestWrapper, req *http.Request, f *FileStream, sendBody bool) {
+	if f.contentType != "" && !reqw.hasHeader(http.HeaderContentType) {
+		if sendBody {
+			req.Header.Set(http.HeaderContentType, f.contentType)
+		} else {
+			req.Header.Del(http.HeaderContentType)
+		}
+	}
+	if f.contentEncoding != "" && !reqw.hasHeader(http.HeaderContentEncoding) {
+		if sendBody {
+			req.Header.SetContentEncoding(f.contentEncoding)
+		} else {
+			req.Header.Del(http.HeaderContentEncoding)
+		}
+	}
+}
+
+// setChunkedBody sets the body as a stream of unknown length, so fasthttp sends it with
+// Transfer-Encoding: chunked rather than a Content-Length whatever its type
+func (c *Client) setChunkedBody(reqw *RequestWrapper, req *http.Request) error {
+	if reqw.rawBody != nil {
+		req.SetBodyStream(bytes.NewReader(reqw.rawBody), -1)
+		return nil
+	}
+
+	switch body := reqw.Body.(type) {
+	case string:
+		req.SetBodyStream(strings.NewReader(body), -1)
+	case sobek.ArrayBuffer:
+		req.SetBodyStream(bytes.NewReader(body.Bytes()), -1)
+	case *FileStream:
+		if _, err := body.Seek(0, 0); err != nil {
+			c.vu.State().Logger.WithError(err).Error("Failed to reset stream to beginning")
+			return err
+		}
+		req.SetBodyStream(body, -1)
+	default:
+		return errors.New("req body type not supported")
+	}
+	return nil
+}
+
+// acquireReq returns a fasthttp request for reqw, reusing one from its pool when available. Each
+// call gets its own request so the same Request object can be sent concurrently.
+func (c *Client) acquireReq(reqw *RequestWrapper, method string) (*http.Request, error) {
+	var req *http.Request
+	if r := reqw.reqPool.Get(); r != nil {
+		req = r.(*http.Request)
+		if err := c.setupCachedReq(reqw, req, method); err != nil {
+			reqw.reqPool.Put(req)
+			return nil, err
+		}
+	} else {
+		req = http.AcquireRequest()
+		if err := c.setupNewReq(reqw, req, method); err != nil {
+			// only requests which were fully built are pooled
+			http.ReleaseRequest(req)
+			return nil, err
+		}
+	}
+	if err := c.finishReq(reqw, req); err != nil {
+		reqw.reqPool.Put(req)
+		return nil, err
+	}
+	return req, nil
+}
+
+// finishReq sets what's set on every send of req rather than when it's built
+func (c *Client) finishReq(reqw *RequestWrapper, req *http.Request) error {
+	if reqw.DisableAutoHost {
+		setContentLength(req)
+	}
+	if err := c.setIdentityHeaders(reqw, req); err != nil {
+		return err
+	}
+	// only a body can be held back, the request being pooled for bodiless methods too
+	if reqw.ExpectContinue && (req.IsBodyStream() || len(req.Body()) > 0) {
+		req.Header.Set(http.HeaderExpect, "100-continue")
+	} else if reqw.ExpectContinue {
+		req.Header.Del(http.HeaderExpect)
+	}
+
+	// signed on every send as the signature covers the time it's made
+	if reqw.AWSSig4 != nil {
+		return reqw.AWSSig4.sign(req, time.Now())
+	}
+	return nil
+}
+
+// setIdentityHeaders sets the identity_headers the request hasn't set itself, expanded with the
+// VU's id and current iteration as the request is sent
+func (c *Client) setIdentityHeaders(reqw *RequestWrapper, req *http.Request) error {
+	if len(c.identityHeaders) == 0 {
+		return nil
+	}
+
+	state := c.vu.State()
+	vars := map[string]string{
+		"vu":   strconv.FormatUint(state.VUID, 10),
+		"iter": strconv.FormatInt(state.Iteration, 10),
+	}
+	for _, h := range c.identityHeaders {
+		if reqw.hasHeader(h.name) {
+			continue
+		}
+		val, err := h.value.expand(vars)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(h.name, val)
+	}
+	return nil
+}
+
+// asciiURL returns rawURL with an internationalized or percent-encoded host converted to punycode
+// so it can be resolved and sent in the Host header, leaving the rest of the URL as it's written
+func asciiURL(rawURL string) (string, error) {
+	start := strings.Index(rawURL, "://")
+	if start < 0 {
+		return rawURL, nil
+	}
+	start += len("://")
+	end := len(rawURL)
+	if i := strings.IndexAny(rawURL[start:], "/?#"); i >= 0 {
+		end = start + i
+	}
+	// the userinfo is left as it is
+	if i := strings.LastIndex(rawURL[start:end], "@"); i >= 0 {
+		start += i + 1
+	}
+
+	host, err := asciiHost(rawURL[start:end])
+	if err != nil {
+		return "", err
+	}
+	return rawURL[:start] + host + rawURL[end:], nil
+}
+
+// asciiHost converts the name of host, which may have a port, to punycode when it's
+// internationalized or percent-encoded
+func asciiHost(host string) (string, error) {
+	// IPv6 addresses are left as they are, including their zone
+	if strings.HasPrefix(host, "[") ||
+		!strings.ContainsFunc(host, func(r rune) bool { return r == '%' || r >= utf8.RuneSelf }) {
+		return host, nil
+	}
+
+	name, port := host, ""
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		name, port = host[:i], host[i:]
+	}
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid host %q; %w", host, err)
+	}
+	name, err = idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid host %q; %w", host, err)
+	}
+	return name + port, nil
+}
+
+// setContentLength sets the Content-Length of the body, which fasthttp doesn't send itself once
+// special headers are disabled. Streamed bodies are still sent chunked unless given a content_length.
+func setContentLength(req *http.Request) {
+	if req.IsBodyStream() && req.Header.ContentLength() >= 0 {
+		req.Header.Set(http.HeaderContentLength, strconv.Itoa(req.Header.ContentLength()))
+		return
+	}
+	if req.IsBodyStream() || (len(req.Body()) == 0 && (req.Header.IsGet() || req.Header.IsHead())) {
+		req.Header.Del(http.HeaderContentLength)
+		return
+	}
+	req.Header.Set(http.HeaderContentLength, strconv.Itoa(len(req.Body())))
+}
+
+func (c *Client) setupMetrics() {
+	c.metricsSetupOnce.Do(func() {
+		tags := c.vu.State().Tags.GetCurrentValues()
+		c.metrics = metrics.NewMetricDispatcher(&tags, c.vu.State())
+		c.metrics.ResponseCallback = c.responseCallback
+		c.metrics.ModuleMetrics = c.moduleMetrics
+		c.metrics.TLSTags = c.tlsTags
+	})
+}
+
+func (c *Client) makeReq(reqw *RequestWrapper, method string) (*Response, error) {
+	req, err := c.acquireReq(reqw, method)
+	if err != nil {
+		return nil, err
+	}
+	defer reqw.reqPool.Put(req)
+
+	c.setupMetrics()
+	tags := c.vu.State().Tags.GetCurrentValues()
 
-	response = &Response{Response: r, client: c}
+	sendCtx, done := reqw.inFlight.add(c.vu.Context())
+	defer done()
 
-	response.Body, err = readResponseBody(req.responseType, resp)
+	fhc, err := c.doerFor(reqw)
 	if err != nil {
-		var code e.ErrCode
-		code, response.Error = e.ErrorCodeForError(err)
-		response.ErrorCode = int(code)
+		return nil, err
+	}
+	var resp *Response
+	if resp, err = c.doCoalesced(c.vu.Context(), sendCtx, fhc, reqw, req, &tags, nil); err != nil {
+		return nil, err
+	}
+	resp.wrapBinaryBody(c.vu.Runtime())
+
+	return resp, nil
+}
+
+// makeAsyncReq sends the request off the event loop, settling the returned promise back on it
+// once the response has been read. With onChunk the body is streamed to it rather than read.
+func (c *Client) makeAsyncReq(reqw *RequestWrapper, method string, onChunk sobek.Callable) *sobek.Promise {
+	promise, resolve, reject := c.vu.Runtime().NewPromise()
+
+	req, err := c.acquireReq(reqw, method)
+	if err != nil {
+		_ = reject(err)
+		return promise
+	}
+	fhc, err := c.doerFor(reqw)
+	if err != nil {
+		reqw.reqPool.Put(req)
+		_ = reject(err)
+		return promise
+	}
+
+	c.setupMetrics()
+	ctx := c.vu.Context()
+	// taken on the event loop as the group, iteration etc. may have moved on once the response is read
+	tags := c.vu.State().Tags.GetCurrentValues()
+	// registered before returning so the request can be cancelled straight away
+	sendCtx, done := reqw.inFlight.add(ctx)
+	queue := newLoopQueue(c.vu)
+
+	var stream func([]byte) bool
+	if onChunk != nil {
+		stream = c.chunkStreamer(sendCtx, queue, onChunk)
+	}
+
+	go func() {
+		defer reqw.reqPool.Put(req)
+		defer done()
+
+		var resp *Response
+		var err error
+		if stream != nil {
+			resp, err = c.do(ctx, sendCtx, fhc, reqw, req, &tags, queue, stream)
+		} else {
+			resp, err = c.doCoalesced(ctx, sendCtx, fhc, reqw, req, &tags, queue)
+		}
+		queue.last(func() error {
+			if err != nil {
+				return reject(err)
+			}
+			// the runtime is only used on the event loop
+			resp.wrapBinaryBody(c.vu.Runtime())
+			return resolve(resp)
+		})
+	}()
+
+	return promise
+}
+
+// loopQueue runs functions on the event loop from another goroutine any number of times. As
+// callbacks may only be registered on the loop, each function queued registers the callback of the
+// next one before it runs, the first being registered by newLoopQueue.
+type loopQueue struct {
+	vu modules.VU
+	// next holds the callback the next function is queued with once the previous one has run
+	next chan func(func() error)
+}
+
+// newLoopQueue returns a loopQueue for vu, which must be called on the event loop. The event loop
+// waits for it until last is called.
+func newLoopQueue(vu modules.VU) *loopQueue {
+	q := &loopQueue{vu: vu, next: make(chan func(func() error), 1)}
+	q.next <- vu.RegisterCallback()
+	return q
+}
+
+// run queues fn on the event loop, keeping a callback registered for the function queued after it.
+func (q *loopQueue) run(fn func() error) {
+	enqueue := <-q.next
+	enqueue(func() error {
+		q.next <- q.vu.RegisterCallback()
+		return fn()
+	})
+}
+
+// last queues fn on the event loop as the last function, after which the queue can't be used.
+func (q *loopQueue) last(fn func() error) {
+	(<-q.next)(fn)
+}
+
+// chunkStreamer returns a function handing each chunk of a streamed body to onChunk on the event
+// loop through queue, which waits for onChunk to return so a slow script holds back reading. It
+// reports whether to carry on reading, which stops when onChunk returns false or throws, or ctx is
+// done.
+func (c *Client) chunkStreamer(ctx context.Context, queue *loopQueue, onChunk sobek.Callable) func([]byte) bool {
+	return func(chunk []byte) bool {
+		next := make(chan bool, 1)
+		queue.run(func() error {
+			rt := c.vu.Runtime()
+			v, err := onChunk(sobek.Undefined(), rt.ToValue(rt.NewArrayBuffer(chunk)))
+			next <- err == nil && (v == nil || !v.StrictEquals(rt.ToValue(false)))
+			return err
+		})
+
+		select {
+		case ok := <-next:
+			return ok
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// sendAbortable sends a copy of req so that when ctx is cancelled first it can return straight away,
+// interrupting the abandoned request on the wire before releasing its copies. On success the
+// response read is returned in place of resp.
+func (c *Client) sendAbortable(
+	ctx context.Context, fhc doer, req *http.Request, resp *http.Response,
+) (*http.Response, net.Addr, error) {
+	sent := http.AcquireRequest()
+	req.CopyTo(sent)
+	if req.IsBodyStream() {
+		sent.SetBodyStream(req.BodyStream(), req.Header.ContentLength())
+	} else {
+		// kept as the raw body, owned by the copy rather than pooled with it, for abortTransport
+		body := sent.Body()
+		sent.SwapBody(nil)
+		sent.SetBodyRaw(body)
+	}
+	received := http.AcquireResponse()
+	abort := newSendAbort()
+	sendAborts.Store(sent, abort)
+
+	type result struct {
+		addr net.Addr
+		err  error
+	}
+	done := make(chan result)
+	abandoned := make(chan struct{})
+
+	go func() {
+		addr, err := fhc.Do(sent, received)
+		sendAborts.Delete(sent)
+		http.ReleaseRequest(sent)
+		select {
+		case done <- result{addr: addr, err: err}:
+		case <-abandoned:
+			// the rest of a streamed body is left unread, its connection closed rather than reused
+			received.SetConnectionClose()
+			_ = received.CloseBodyStream()
+			http.ReleaseResponse(received)
+		}
+	}()
+
+	select {
+	case res := <-done:
+		http.ReleaseResponse(resp)
+		return received, res.addr, res.err
+	case <-ctx.Done():
+		abort.abort()
+		close(abandoned)
+		return resp, nil, ctx.Err()
+	}
+}
+
+// retryWait returns how long to wait before retrying a request which was answered with a Retry-After,
+// jittered if configured, false when it shouldn't be retried
+func (c *Client) retryWait(req *http.Request, resp *http.Response, err error, retries int) (time.Duration, bool) {
+	// streamed bodies can't be sent again
+	if c.retryAfter == nil || err != nil || retries >= c.retryAfter.MaxRetries || req.IsBodyStream() {
+		return 0, false
+	}
+	wait, ok := retryAfter(resp, time.Now())
+	if !ok || (c.retryAfter.MaxWait > 0 && wait > time.Duration(c.retryAfter.MaxWait)*time.Second) {
+		return 0, false
+	}
+	return jittered(wait, c.retryAfter.Jitter), true
+}
+
+// readTimeout returns the read timeout of the traced connection the request was sent over in place
+// of err when it's fasthttp's ErrTimeout, which it returns for the request's other timeouts too
+func readTimeout(resp *http.Response, addr net.Addr, err error) error {
+	if !errors.Is(err, http.ErrTimeout) {
+		return err
+	}
+	if addr == nil {
+		// fasthttp's own client only returns the connection's address with the response
+		addr = resp.RemoteAddr()
+	}
+	if info := tracer.ConnInfoFromAddr(addr); info != nil {
+		if readErr := info.ReadTimeout(); readErr != nil {
+			return readErr
+		}
+	}
+	return err
+}
+
+// send sends req with fhc, following up to maxRedirects redirects with a copy of req so the pooled
+// request is left as it was. The response of the last request sent is returned in place of resp,
+// along with the number of redirects followed and the URL redirected to last, empty when none were.
+func (c *Client) send(
+	ctx context.Context, fhc doer, req *http.Request, resp *http.Response, abortable bool, maxRedirects int,
+) (*http.Response, net.Addr, int, string, error) {
+	sent := req
+	defer func() {
+		if sent != req {
+			http.ReleaseRequest(sent)
+		}
+	}()
+
+	for redirects := 0; ; redirects++ {
+		var addr net.Addr
+		var err error
+		if abortable {
+			resp, addr, err = c.sendAbortable(ctx, fhc, sent, resp)
+		} else {
+			addr, err = fhc.Do(sent, resp)
+		}
+		err = readTimeout(resp, addr, err)
+
+		status := resp.StatusCode()
+		location := resp.Header.Peek(http.HeaderLocation)
+		// 307 and 308 resend the body, which can't be done when it was streamed
+		resend := status == http.StatusTemporaryRedirect || status == http.StatusPermanentRedirect
+		if err != nil || redirects >= maxRedirects || !http.StatusCodeIsRedirect(status) || len(location) == 0 ||
+			(resend && req.IsBodyStream()) {
+			return resp, addr, redirects, redirectedURL(req, sent), err
+		}
+		if err := ctx.Err(); err != nil {
+			return resp, addr, redirects, redirectedURL(req, sent), err
+		}
+
+		if sent == req {
+			sent = http.AcquireRequest()
+			req.CopyTo(sent)
+		}
+		sent.URI().UpdateBytes(location)
+		// the host is taken from the redirect's URL
+		sent.Header.Del(http.HeaderHost)
+		if !redirectKeepsCredentials(req.URI().Host(), sent.URI().Host()) {
+			// as net/http does, credentials aren't sent on to other hosts
+			for _, name := range redirectCredentialHeaders {
+				sent.Header.Del(name)
+			}
+		}
+		if !resend && !sent.Header.IsGet() && !sent.Header.IsHead() {
+			// as browsers do, 301, 302 and 303 are followed with a GET without the body
+			sent.Header.SetMethod(http.MethodGet)
+			sent.ResetBody()
+			sent.Header.Del(http.HeaderContentType)
+			sent.Header.Del(http.HeaderContentLength)
+		}
+
+		// read to the end so the connection is returned to the pool
+		_ = resp.BodyWriteTo(io.Discard)
+		resp.CloseBodyStream()
+	}
+}
+
+// redirectCredentialHeaders are removed from redirects to hosts other than the request's
+var redirectCredentialHeaders = []string{
+	http.HeaderAuthorization, http.HeaderProxyAuthorization, http.HeaderCookie, "Cookie2", http.HeaderWWWAuthenticate,
+}
+
+// redirectKeepsCredentials reports whether a redirect from the host:port initial to dest may be
+// sent the request's credentials, only being the case for the same host or a subdomain of it
+func redirectKeepsCredentials(initial, dest []byte) bool {
+	ihost := strings.ToLower(hostname(string(initial)))
+	dhost := strings.ToLower(hostname(string(dest)))
+	return dhost == ihost || strings.HasSuffix(dhost, "."+ihost)
+}
+
+// hostname returns host without its port, if any
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// responseProto returns the HTTP version the response was read with. fasthttp only keeps whether
+// the responses it parses are HTTP/1.1, reporting every other version as HTTP/1.1 too.
+func responseProto(resp *http.Response) string {
+	if !resp.Header.IsHTTP11() && bytes.Equal(resp.Header.Protocol(), []byte("HTTP/1.1")) {
+		return "HTTP/1.0"
+	}
+	return string(resp.Header.Protocol())
+}
+
+// responseStatusText returns the status code and reason phrase of resp's status line as k6/http's
+// status_text, i.e. "419 Session Expired", the reason being the standard one for the code when the
+// server sent none as over HTTP/2
+func responseStatusText(resp *http.Response) string {
+	reason := string(resp.Header.StatusMessage())
+	if reason == "" {
+		reason = nethttp.StatusText(resp.StatusCode())
+	}
+	return strings.TrimSpace(strconv.Itoa(resp.StatusCode()) + " " + reason)
+}
+
+// redirectedURL returns the URL of sent when it's a redirect of req, otherwise an empty string
+func redirectedURL(req, sent *http.Request) string {
+	if sent == req {
+		return ""
+	}
+	return sent.URI().String()
+}
+
+// do sends the request with fhc, cancelling it along with sendCtx. Metrics are emitted with ctx so they're
+// still recorded for cancelled requests, tagged with the VU's tags when the request was made. With
+// stream the body is handed to it as it's read instead of being kept on the response. queue is that
+// of requests sent off the event loop, nil for those sent on it.
+func (c *Client) do(
+	ctx, sendCtx context.Context, fhc doer, reqw *RequestWrapper, req *http.Request, tags *k6metrics.TagsAndMeta,
+	queue *loopQueue, stream func([]byte) bool,
+) (response *Response, err error) {
+	resp := http.AcquireResponse()
+
+	defer func() {
+		http.ReleaseResponse(resp)
+		if !reqw.Throw {
+			err = nil
+		}
+	}()
+
+	if reqw.Deadline > 0 {
+		// waits on the rate limit and to retry end at the deadline too
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithDeadline(sendCtx, time.UnixMilli(reqw.Deadline))
+		defer cancel()
+	}
+
+	// time waiting on the rate limit is reported as blocked rather than as part of the duration
+	var blocked time.Duration
+	if c.rateLimiter != nil {
+		start := time.Now()
+		err = c.rateLimiter.Wait(sendCtx)
+		blocked = time.Since(start)
+	}
+
+	maxRedirects := c.maxRedirects
+	if reqw.MaxRedirects != nil {
+		maxRedirects = *reqw.MaxRedirects
+	}
+
+	t1 := time.Now()
+	// send request on wire
+	var remoteAddr net.Addr
+	var redirects int
+	var finalURL string
+	switch {
+	case err != nil:
+	case sendCtx.Err() != nil:
+		err = sendCtx.Err()
+	default:
+		for retries := 0; ; retries++ {
+			resp, remoteAddr, redirects, finalURL, err = c.send(sendCtx, fhc, req, resp, queue != nil, maxRedirects)
+			wait, ok := c.retryWait(req, resp, err, retries)
+			if !ok {
+				break
+			}
+
+			// read to the end so the connection is returned to the pool
+			_ = resp.BodyWriteTo(io.Discard)
+			resp.CloseBodyStream()
+
+			// only the last attempt is timed, with the time waited to retry reported as blocked
+			start := time.Now()
+			select {
+			case <-time.After(wait):
+			case <-sendCtx.Done():
+				err = sendCtx.Err()
+			}
+			blocked += time.Since(start)
+			t1 = time.Now()
+			if err != nil {
+				break
+			}
+		}
+		if err != nil && resp.Header.ContentLength() != 0 {
+			// bodies under streamResponseBodyThreshold are read by fasthttp, once their headers were
+			err = bodyCutShort(err)
+		}
+	}
+
+	// bodies over streamResponseBodyThreshold are still on the wire, read them before stopping the clock
+	var body interface{}
+	var bodySize int
+	var bodyErr error
+	var digest hash.Hash
+	if err == nil && stream != nil {
+		// the duration runs to the end of the stream, while waiting is still the time to first byte
+		bodySize, bodyErr = streamResponseBody(resp, stream)
+	} else if err == nil {
+		maxBodySize := c.maxBodySize
+		if reqw.MaxBodySize > 0 {
+			maxBodySize = reqw.MaxBodySize
+		}
+		// a hash option changed since the request was created is checked as it's used
+		if reqw.Hash != "" {
+			digest, bodyErr = newDigest(reqw.Hash)
+		}
+		if bodyErr == nil {
+			body, bodySize, bodyErr = readResponseBody(
+				reqw.responseType, reqw.SaveToFile, reqw.Charset, maxBodySize, reqw.TruncateBody, c.vu.State().Logger, resp,
+				bodyLength(req, resp), digest,
+			)
+		}
+	}
+	end := time.Now()
+	trial := &tracer.Trail{EndTime: end, Duration: end.Sub(t1), Blocked: blocked}
+	if c.debug {
+		var received *http.Response
+		if err == nil {
+			received = resp
+		}
+		logDump(c.vu.State().Logger, req, received, body)
+	}
+	if err == nil {
+		trial.ConnRemoteAddr = remoteAddr
+		if info := tracer.ConnInfoFromAddr(trial.ConnRemoteAddr); info != nil {
+			// the wait for a free connection can only be told apart from earlier hops without redirects
+			var sendStart time.Time
+			if redirects == 0 {
+				sendStart = t1
+			}
+			trial.AddConnInfo(info, sendStart, end, !c.pipelined)
+		}
+	}
+
+	// emitted before the request and response are released back to fasthttp
+	finished := c.metrics.EmitRequest(ctx, &metrics.UnfinishedRequest{
+		Ctx:           ctx,
+		Trail:         trial,
+		Request:       req,
+		Response:      resp,
+		Err:           err,
+		BodyErr:       bodyErr,
+		Name:          reqw.Name,
+		Tags:          tags,
+		OpenConns:     c.conns.count(),
+		Redirects:     redirects,
+		BodySize:      bodySize,
+		ClassifyError: c.classifyError(sendCtx, queue),
+	})
+
+	response = acquireResponse(c)
+	r := response.Response
+	r.URL = req.URI().String()
+	response.FinalURL = r.URL
+	if finalURL != "" {
+		response.FinalURL = finalURL
+	}
+	r.Timings = httpext.ResponseTimings{
+		Duration:       k6metrics.D(trial.Duration),
+		Blocked:        k6metrics.D(trial.Blocked),
+		Connecting:     k6metrics.D(trial.Connecting),
+		TLSHandshaking: k6metrics.D(trial.TLSHandshaking),
+		Sending:        k6metrics.D(trial.Sending),
+		Waiting:        k6metrics.D(trial.Waiting),
+		Receiving:      k6metrics.D(trial.Receiving),
+	}
+
+	if err != nil {
+		if !reqw.Throw {
+			c.vu.State().Logger.WithError(err).Warn("Request Failed")
+		}
+		// as with k6/http a failed request still has a response to inspect when not throwing
+		response.setError(err)
+		response.ErrorCode = int(finished.ErrorCode)
 		return response, err
 	}
 
+	r.Status = resp.StatusCode()
+	r.Proto = responseProto(resp)
+	r.StatusText = responseStatusText(resp)
+	response.BodySize = bodySize
+	if remoteAddr != nil {
+		response.RemoteAddr = remoteAddr.String()
+		if host, port, err := net.SplitHostPort(response.RemoteAddr); err == nil {
+			r.RemoteIP = host
+			r.RemotePort, _ = strconv.Atoi(port)
+		}
+		if info := tracer.ConnInfoFromAddr(remoteAddr); info != nil {
+			if info.LocalAddr != nil {
+				response.LocalAddr = info.LocalAddr.String()
+			}
+			response.Proxied = info.Proxied
+		}
+	}
+	// the certificates are only converted if the script asks for them
+	response.tls = trial.TLS
+	if trial.TLS != nil {
+		response.NegotiatedProtocol = trial.TLS.NegotiatedProtocol
+	}
+
+	// trailers are added to the headers once the body is read, so are told apart by being declared
+	var trailers map[string]struct{}
+	resp.Header.VisitAllTrailer(func(name []byte) {
+		if trailers == nil {
+			trailers = make(map[string]struct{})
+		}
+		trailers[strings.ToLower(string(name))] = struct{}{}
+	})
+	r.Headers = response.headers
+	resp.Header.VisitAll(func(key, value []byte) {
+		if _, ok := trailers[strings.ToLower(string(key))]; ok {
+			if response.Trailers == nil {
+				response.Trailers = make(map[string]string, len(trailers))
+			}
+			response.Trailers[string(key)] = string(value)
+			return
+		}
+		r.Headers[string(key)] = string(value)
+	})
+
+	response.Body = body
+	if digest != nil && bodyErr == nil {
+		response.digest = hex.EncodeToString(digest.Sum(nil))
+		response.digestAlgo = reqw.Hash
+	}
+	if bodyErr != nil {
+		response.setError(bodyErr)
+		response.ErrorCode = int(finished.ErrorCode)
+		return response, bodyErr
+	}
+
 	return response, nil
 }
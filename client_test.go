@@ -0,0 +1,3395 @@
+package fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fasthttpmetrics "github.com/domsolutions/xk6-fasthttp/metrics"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	k6module "go.k6.io/k6/js/modules/k6"
+	"go.k6.io/k6/js/modulestest"
+	"go.k6.io/k6/lib"
+	"go.k6.io/k6/metrics"
+)
+
+// newClientTestRuntime returns a runtime with the module exported as fasthttp, having run initScript
+// in the init context before moving to the VU context, and the channel its samples are pushed to
+func newClientTestRuntime(t *testing.T, initScript string) (*modulestest.Runtime, chan metrics.SampleContainer) {
+	t.Helper()
+	return newVUTestRuntime(t, New(), initScript)
+}
+
+// newVUTestRuntime is newClientTestRuntime for a VU of the given root module, sharing it with others
+func newVUTestRuntime(t *testing.T, root *RootModule, initScript string) (*modulestest.Runtime, chan metrics.SampleContainer) {
+	t.Helper()
+
+	runtime := modulestest.NewRuntime(t)
+	mi, ok := root.NewModuleInstance(runtime.VU).(*ModuleInstance)
+	require.True(t, ok)
+	require.NoError(t, runtime.VU.Runtime().Set("fasthttp", mi.Exports().Default))
+
+	_, err := runtime.VU.Runtime().RunString(initScript)
+	require.NoError(t, err)
+
+	registry := metrics.NewRegistry()
+	samples := make(chan metrics.SampleContainer, 1000)
+	runtime.MoveToVUContext(&lib.State{
+		Options: lib.Options{
+			SystemTags: &metrics.DefaultSystemTagSet,
+		},
+		Samples:        samples,
+		Tags:           lib.NewVUStateTags(registry.RootTagSet()),
+		BuiltinMetrics: metrics.RegisterBuiltinMetrics(registry),
+		Logger:         runtime.VU.InitEnvField.Logger,
+	})
+
+	return runtime, samples
+}
+
+// samplesNamed drains the samples pushed so far, returning those of the named metrics in the order
+// they were pushed
+func samplesNamed(samples chan metrics.SampleContainer, names ...string) []metrics.Sample {
+	var named []metrics.Sample
+	for _, container := range metrics.GetBufferedSamples(samples) {
+		for _, sample := range container.GetSamples() {
+			if slices.Contains(names, sample.Metric.Name) {
+				named = append(named, sample)
+			}
+		}
+	}
+	return named
+}
+
+// sampleValues is samplesNamed returning the values of a single metric
+func sampleValues(samples chan metrics.SampleContainer, name string) []float64 {
+	var values []float64
+	for _, sample := range samplesNamed(samples, name) {
+		values = append(values, sample.Value)
+	}
+	return values
+}
+
+func TestSaveToFile(t *testing.T) {
+	t.Parallel()
+
+	// large enough to be streamed from the connection
+	body := strings.Repeat("fasthttp", streamResponseBodyThreshold)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "body")
+	runtime, _ := newClientTestRuntime(t, `var client = new fasthttp.Client({});`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(new fasthttp.Request("` + srv.URL + `", {save_to_file: "` + path + `"}));
+		res.status === 200 && res.body === null;
+	`)
+	require.NoError(t, err)
+	require.True(t, res.ToBoolean())
+
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, body, string(saved))
+}
+
+func TestResponseHash(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("a", 2*streamResponseBodyThreshold)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256([]byte(body))
+	path := filepath.Join(t.TempDir(), "body")
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var kept = new fasthttp.Request("`+srv.URL+`", {response_type: "binary"});
+		var saved = new fasthttp.Request("`+srv.URL+`", {save_to_file: "`+path+`", hash: "sha256"});
+		var unsaved = new fasthttp.Request("`+srv.URL+`", {save_to_file: "`+path+`"});
+	`)
+
+	// the body saved to file was hashed as it streamed from the connection
+	res, err := runtime.VU.Runtime().RunString(`[client.get(kept).hash("sha256"), client.get(saved).hash("SHA256")].join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(sum[:])+","+hex.EncodeToString(sum[:]), res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`client.get(unsaved).hash("sha256")`)
+	require.ErrorContains(t, err, "no body to hash")
+
+	// bodies are hashed as received with the option, and as returned without
+	latin1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=iso-8859-1")
+		_, _ = w.Write([]byte("caf\xe9 au lait"))
+	}))
+	defer latin1.Close()
+	received, returned := sha256.Sum256([]byte("caf\xe9 au lait")), sha256.Sum256([]byte("café"))
+	res, err = runtime.VU.Runtime().RunString(`
+		var options = {max_body_size: 4, truncate_body: true};
+		var hashed = new fasthttp.Request("` + latin1.URL + `", Object.assign({hash: "sha256"}, options));
+		var decoded = new fasthttp.Request("` + latin1.URL + `", options);
+		[client.get(hashed).hash("sha256"), client.get(decoded).hash("sha256")].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(received[:])+","+hex.EncodeToString(returned[:]), res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`new fasthttp.Request("` + srv.URL + `", {hash: "sha3"})`)
+	require.ErrorContains(t, err, `unsupported hash "sha3"`)
+}
+
+func TestDownload(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("a", 2*streamResponseBodyThreshold)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256([]byte(body))
+	path := filepath.Join(t.TempDir(), "body")
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {response_type: "binary"});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var d = client.download("` + srv.URL + `", "` + path + `");
+		[d.path, d.size, d.hash, d.status, d.duration > 0].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%s,%d,%s,200,true", path, len(body), hex.EncodeToString(sum[:])), res.String())
+	saved, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, body, string(saved))
+
+	// a Request is downloaded without changing its own options, to a temporary file when no path is given
+	res, err = runtime.VU.Runtime().RunString(`
+		var d = client.download(req, "", "md5");
+		[d.path, d.hash, client.get(req).body.byteLength].join(",");
+	`)
+	require.NoError(t, err)
+	parts := strings.Split(res.String(), ",")
+	require.Len(t, parts, 3)
+	t.Cleanup(func() { _ = os.Remove(parts[0]) })
+	saved, err = os.ReadFile(parts[0])
+	require.NoError(t, err)
+	require.Equal(t, body, string(saved))
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte(body))), parts[1])
+	require.Equal(t, strconv.Itoa(len(body)), parts[2])
+
+	_, err = runtime.VU.Runtime().RunString(`client.download(req, "` + path + `", "sha3")`)
+	require.ErrorContains(t, err, `unsupported hash "sha3"`)
+
+	for _, r := range []string{"undefined", "{}", `"not a url"`, `"ftp://example.com"`} {
+		_, err = runtime.VU.Runtime().RunString(`client.download(` + r + `, "")`)
+		require.Error(t, err, r)
+	}
+
+	// the temporary files of failed downloads are removed, whether they threw or not
+	closed := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	closed.Close()
+	temps := func() []string {
+		matches, err := filepath.Glob(filepath.Join(os.TempDir(), "xk6-fasthttp-download-*"))
+		require.NoError(t, err)
+		return matches
+	}
+	before := temps()
+	res, err = runtime.VU.Runtime().RunString(`
+		var d = client.download("` + closed.URL + `", "");
+		[d.path, d.error_code > 0].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, ",true", res.String())
+	_, err = runtime.VU.Runtime().RunString(`
+		client.download(new fasthttp.Request("` + closed.URL + `", {throw: true}), "");
+	`)
+	require.Error(t, err)
+	require.ElementsMatch(t, before, temps())
+}
+
+func TestFileStreamFromArrayBuffer(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var stream = new fasthttp.FileStream(new Uint8Array([104, 101, 108, 108, 111]).buffer);
+		var req = new fasthttp.Request("`+srv.URL+`", {body: stream});
+	`)
+
+	// sent twice to check the stream is reset for the cached request
+	res, err := runtime.VU.Runtime().RunString(`
+		client.post(req).body === "hello" && client.post(req).body === "hello";
+	`)
+	require.NoError(t, err)
+	require.True(t, res.ToBoolean())
+}
+
+func TestFileStreamMultipleFiles(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	header := filepath.Join(dir, "header")
+	payload := filepath.Join(dir, "payload")
+	require.NoError(t, os.WriteFile(header, []byte("header;"), 0o600))
+	require.NoError(t, os.WriteFile(payload, []byte("payload"), 0o600))
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var stream = new fasthttp.FileStream("`+header+`", "`+payload+`");
+		var req = new fasthttp.Request("`+srv.URL+`", {body: stream});
+	`)
+
+	// sent twice to check every file is reset for the cached request
+	res, err := runtime.VU.Runtime().RunString(`
+		client.post(req).body === "header;payload" && client.post(req).body === "header;payload";
+	`)
+	require.NoError(t, err)
+	require.True(t, res.ToBoolean())
+}
+
+func TestFileStreamClosesFilesOnError(t *testing.T) {
+	t.Parallel()
+
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files can't be listed")
+	}
+
+	header := filepath.Join(t.TempDir(), "header")
+	require.NoError(t, os.WriteFile(header, []byte("header;"), 0o600))
+
+	runtime, _ := newClientTestRuntime(t, ``)
+	_, err := runtime.VU.Runtime().RunString(`new fasthttp.FileStream("` + header + `", "` + header + `.missing")`)
+	require.ErrorContains(t, err, "no such file")
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	for _, fd := range fds {
+		path, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		require.NotEqual(t, header, path, "file left open")
+	}
+}
+
+func TestFileStreamContentType(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Content-Type")))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, "image.png")
+	unknown := filepath.Join(dir, "upload")
+	require.NoError(t, os.WriteFile(image, []byte("not really a png"), 0o600))
+	require.NoError(t, os.WriteFile(unknown, []byte("<html><body></body></html>"), 0o600))
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var byExtension = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream("`+image+`")});
+		var sniffed = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream("`+unknown+`")});
+		var explicit = new fasthttp.Request("`+srv.URL+`", {
+			body: new fasthttp.FileStream("`+image+`"),
+			headers: {"Content-Type": "application/octet-stream"},
+		});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.post(byExtension).body, client.post(sniffed).body, client.post(explicit).body].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "image/png,text/html; charset=utf-8,application/octet-stream", res.String())
+}
+
+func TestFileStreamContentEncoding(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		_, _ = fmt.Fprintf(w, "%s,%s,%s", r.Header.Get("Content-Encoding"), r.Header.Get("Content-Type"), body)
+	}))
+	defer srv.Close()
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err := zw.Write([]byte(`{"a":1}`))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	path := filepath.Join(t.TempDir(), "payload.json.gz")
+	require.NoError(t, os.WriteFile(path, compressed.Bytes(), 0o600))
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream("`+path+`", {content_encoding: "gzip"})});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.post(req).body`)
+	require.NoError(t, err)
+	require.Equal(t, `gzip,application/json,{"a":1}`, res.String())
+}
+
+func TestFileStreamFromReader(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `var client = new fasthttp.Client({});`)
+	// as given by another extension
+	rt := runtime.VU.Runtime()
+	require.NoError(t, rt.Set("seekable", strings.NewReader("seekable")))
+	require.NoError(t, rt.Set("once", io.MultiReader(strings.NewReader("once"))))
+
+	res, err := rt.RunString(`
+		var seekableReq = new fasthttp.Request("` + srv.URL + `", {body: new fasthttp.FileStream(seekable)});
+		var onceReq = new fasthttp.Request("` + srv.URL + `", {body: new fasthttp.FileStream(once)});
+		[client.post(seekableReq).body, client.post(seekableReq).body, client.post(onceReq).body].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "seekable,seekable,once", res.String())
+
+	// the reader was read to its end by the first send
+	_, err = rt.RunString(`client.post(onceReq)`)
+	require.ErrorContains(t, err, "can only be sent once")
+}
+
+func TestAsyncRequests(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_conns_per_host: 2});
+		var first = new fasthttp.Request("`+srv.URL+`/first");
+		var second = new fasthttp.Request("`+srv.URL+`/second");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var bodies;
+		Promise.all([client.getAsync(first), client.getAsync(second)]).then((res) => {
+			bodies = res.map((r) => r.body).join(",");
+		});
+	`)
+	require.NoError(t, err)
+
+	bodies := runtime.VU.Runtime().Get("bodies")
+	require.NotNil(t, bodies)
+	require.Equal(t, "/first,/second", bodies.String())
+}
+
+func TestSingleFlight(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		// held so the other requests are made while it's in flight
+		time.Sleep(100 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, "%s %d", r.Method, n)
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({single_flight: true});
+		var req = new fasthttp.Request("`+srv.URL+`/warm");
+		var same = new fasthttp.Request("`+srv.URL+`/warm");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var bodies;
+		Promise.all([client.getAsync(req), client.getAsync(same), client.getAsync(req), client.postAsync(req)]).then((res) => {
+			bodies = res.map((r) => r.body.split(" ")[0]).join(",");
+		});
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "GET,GET,GET,POST", runtime.VU.Runtime().Get("bodies").String())
+	require.EqualValues(t, 2, hits.Load())
+
+	counts := map[string]float64{}
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName, fasthttpmetrics.HTTPReqsCoalescedName) {
+		counts[sample.Metric.Name] += sample.Value
+	}
+	require.Equal(t, 2.0, counts[metrics.HTTPReqsName])
+	require.Equal(t, 2.0, counts[fasthttpmetrics.HTTPReqsCoalescedName])
+
+	// requests made once the first landed are sent again
+	res, err := runtime.VU.Runtime().RunString(`client.get(req).body`)
+	require.NoError(t, err)
+	require.Equal(t, "GET 3", res.String())
+}
+
+func TestSingleFlightCredentials(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({single_flight: true});
+		var alice = new fasthttp.Request("`+srv.URL+`", {headers: {"Authorization": "Bearer alice"}});
+		var bob = new fasthttp.Request("`+srv.URL+`", {headers: {"Authorization": "Bearer bob"}});
+		var cookie = new fasthttp.Request("`+srv.URL+`", {headers: {"Cookie": "session=carol"}});
+		var anonymous = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var bodies;
+		Promise.all([
+			client.getAsync(alice), client.getAsync(bob), client.getAsync(cookie), client.getAsync(anonymous),
+			client.getAsync(alice),
+		]).then((res) => {
+			bodies = res.map((r) => r.body).join(",");
+		});
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "Bearer alice|,Bearer bob|,|session=carol,|,Bearer alice|", runtime.VU.Runtime().Get("bodies").String())
+
+	counts := map[string]float64{}
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName, fasthttpmetrics.HTTPReqsCoalescedName) {
+		counts[sample.Metric.Name] += sample.Value
+	}
+	require.Equal(t, 4.0, counts[metrics.HTTPReqsName])
+	require.Equal(t, 1.0, counts[fasthttpmetrics.HTTPReqsCoalescedName])
+}
+
+func TestSingleFlightOptions(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, "%s|%s", r.Header.Get("Accept"), r.Header.Get("Range"))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({single_flight: true});
+		var plain = new fasthttp.Request("`+srv.URL+`");
+		var binary = new fasthttp.Request("`+srv.URL+`", {response_type: "binary"});
+		var truncated = new fasthttp.Request("`+srv.URL+`", {max_body_size: 1, truncate_body: true});
+		var json = new fasthttp.Request("`+srv.URL+`", {headers: {"Accept": "application/json"}});
+		var ranged = new fasthttp.Request("`+srv.URL+`", {headers: {"Range": "bytes=0-1"}});
+		var same = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var bodies;
+		Promise.all([
+			client.getAsync(plain), client.getAsync(binary), client.getAsync(truncated), client.getAsync(json),
+			client.getAsync(ranged), client.getAsync(same),
+		]).then((res) => {
+			bodies = res.map((r) => typeof r.body === "string" ? r.body : "binary").join(",");
+		});
+	`)
+	require.NoError(t, err)
+	// requests read or answered differently are each sent
+	require.Equal(t, "|,binary,|,application/json|,|bytes=0-1,|", runtime.VU.Runtime().Get("bodies").String())
+	require.EqualValues(t, 5, hits.Load())
+
+	require.Equal(t, []float64{1}, sampleValues(samples, fasthttpmetrics.HTTPReqsCoalescedName))
+}
+
+func TestSingleFlightCancelled(t *testing.T) {
+	t.Parallel()
+
+	// the first request is only answered once the client has given up on it, the ready one once it's
+	// arrived and the others have had the time to be coalesced into it
+	var hits atomic.Int32
+	arrived := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			<-arrived
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		if hits.Add(1) == 1 {
+			arrived <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, _ = fmt.Fprint(w, "sent again")
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({single_flight: true});
+		var first = new fasthttp.Request("`+srv.URL+`/slow");
+		var second = new fasthttp.Request("`+srv.URL+`/slow");
+		var third = new fasthttp.Request("`+srv.URL+`/slow");
+		var ready = new fasthttp.Request("`+srv.URL+`/ready");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var bodies;
+		Promise.all([client.getAsync(first), client.getAsync(second), client.getAsync(third)]).then((res) => {
+			bodies = res.map((r) => r.error_code > 0 ? "cancelled" : r.body).join(",");
+		});
+		client.getAsync(ready).then(() => { first.cancel(); });
+	`)
+	require.NoError(t, err)
+	// the coalesced requests aren't failed by the cancelled one, one of them being sent in its place
+	require.Equal(t, "cancelled,sent again,sent again", runtime.VU.Runtime().Get("bodies").String())
+	require.EqualValues(t, 2, hits.Load())
+
+	require.Equal(t, []float64{1}, sampleValues(samples, fasthttpmetrics.HTTPReqsCoalescedName))
+}
+
+func TestSingleFlightSaveToFile(t *testing.T) {
+	t.Parallel()
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, "body %d", n)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({single_flight: true});
+		var first = new fasthttp.Request("`+srv.URL+`", {save_to_file: `+strconv.Quote(first)+`});
+		var second = new fasthttp.Request("`+srv.URL+`", {save_to_file: `+strconv.Quote(second)+`});
+	`)
+
+	_, err := runtime.RunOnEventLoop(`Promise.all([client.getAsync(first), client.getAsync(second)]);`)
+	require.NoError(t, err)
+	// each body is written to its own file rather than only the first
+	require.EqualValues(t, 2, hits.Load())
+	for _, path := range []string{first, second} {
+		body, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "body ")
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte{0, 1, 2, 0xff})
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {response_type: "binary"});
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var describe = (body) => (body instanceof ArrayBuffer) + ":" + new Uint8Array(body).join(",");
+		var sync = describe(client.get(req).body);
+		var async;
+		client.getAsync(req).then((res) => { async = describe(res.body); });
+	`)
+	require.NoError(t, err)
+
+	rt := runtime.VU.Runtime()
+	require.Equal(t, "true:0,1,2,255", rt.Get("sync").String())
+	require.Equal(t, "true:0,1,2,255", rt.Get("async").String())
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	// an event stream which never ends, until the client goes away
+	closed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(closed)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var events = [];
+		var status, body, timings;
+		client.stream(req, (chunk) => {
+			events.push(String.fromCharCode(...new Uint8Array(chunk)).trim());
+			return events.length < 3;
+		}).then((res) => {
+			status = res.status;
+			body = res.body;
+			timings = res.timings;
+		});
+	`)
+	require.NoError(t, err)
+
+	rt := runtime.VU.Runtime()
+	require.Equal(t, "data: 0,data: 1,data: 2", rt.Get("events").String())
+	require.EqualValues(t, 200, rt.Get("status").Export())
+	require.Nil(t, rt.Get("body").Export())
+	// waiting is the time to the first event, the duration runs until the stream was stopped
+	var timings map[string]float64
+	require.NoError(t, rt.ExportTo(rt.Get("timings"), &timings))
+	require.Less(t, timings["waiting"], 50.0)
+	require.GreaterOrEqual(t, timings["duration"], 100.0)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("stream wasn't closed once stopped")
+	}
+}
+
+func TestConnWaitBlocked(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_conns_per_host: 1, max_conn_wait_timeout: 5});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var timings;
+		Promise.all([client.getAsync(req), client.getAsync(req)]).then((res) => {
+			timings = res.map((r) => r.timings);
+		});
+	`)
+	require.NoError(t, err)
+
+	var timings []map[string]float64
+	require.NoError(t, runtime.VU.Runtime().ExportTo(runtime.VU.Runtime().Get("timings"), &timings))
+	require.Len(t, timings, 2)
+	// one request waits on the other for the only connection, which isn't part of its duration
+	first, second := timings[0], timings[1]
+	if first["blocked"] > second["blocked"] {
+		first, second = second, first
+	}
+	require.Less(t, first["blocked"], 100.0)
+	require.GreaterOrEqual(t, second["blocked"], 150.0)
+	require.Less(t, second["duration"], 400.0)
+
+	for _, config := range []ClientConfig{
+		{MaxConnWaitTimeout: 5, HTTP2: true},
+		{MaxConnWaitTimeout: 5, Pipeline: &PipelineConfig{}},
+	} {
+		_, _, _, _, _, err = parseClientConfig(config)
+		require.ErrorContains(t, err, "max_conn_wait_timeout can't be combined with http2 or pipeline")
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Join(r.Header.Values("Accept"), ",") + ";" + r.Header.Get("X-Api-Key")))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({default_headers: {"Accept": "application/json", "X-Api-Key": "secret"}});
+		var defaults = new fasthttp.Request("`+srv.URL+`");
+		var overridden = new fasthttp.Request("`+srv.URL+`", {headers: {"accept": "text/plain"}});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(defaults).body + "|" + client.get(overridden).body`)
+	require.NoError(t, err)
+	require.Equal(t, "application/json;secret|text/plain;secret", res.String())
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Client-Id")))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({identity_headers: {"X-Client-Id": "vu{{vu}}-{{ iter }}"}});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		var overridden = new fasthttp.Request("`+srv.URL+`", {headers: {"x-client-id": "fixed"}});
+	`)
+	runtime.VU.State().VUID = 7
+
+	// the pooled request is expanded again on every send
+	var ids []string
+	for iter := int64(0); iter < 2; iter++ {
+		runtime.VU.State().Iteration = iter
+		res, err := runtime.VU.Runtime().RunString(`client.get(req).body + "," + client.get(overridden).body`)
+		require.NoError(t, err)
+		ids = append(ids, res.String())
+	}
+	require.Equal(t, []string{"vu7-0,fixed", "vu7-1,fixed"}, ids)
+
+	_, err := parseIdentityHeaders(map[string]string{"X-Client-Id": "{{scenario}}"})
+	require.ErrorContains(t, err, `unknown identity_headers placeholder "scenario"`)
+}
+
+func TestNormalizeHeaders(t *testing.T) {
+	t.Parallel()
+
+	// net/http canonicalizes header names so fasthttp's server is used to see them as sent
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &fasthttp.Server{
+		DisableHeaderNamesNormalizing: true,
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Response.Header.Set("x-reply", "1")
+			if ctx.Request.Header.Peek("X-Custom") != nil {
+				ctx.SetBodyString("X-Custom")
+			} else if ctx.Request.Header.Peek("x-custom") != nil {
+				ctx.SetBodyString("x-custom")
+			}
+		},
+	}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Shutdown() }()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var preserving = new fasthttp.Client({});
+		var normalizing = new fasthttp.Client({normalize_headers: true});
+		var url = "http://`+ln.Addr().String()+`";
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[preserving, normalizing].map((client) => {
+			var res = client.get(new fasthttp.Request(url, {headers: {"x-custom": "1"}}));
+			return res.body + ":" + Object.keys(res.headers).filter((h) => h.toLowerCase() == "x-reply");
+		}).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "x-custom:x-reply|X-Custom:X-Reply", res.String())
+}
+
+func TestStatusText(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &fasthttp.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.SetStatusCode(419)
+			ctx.Response.Header.SetStatusMessage([]byte("Session Expired"))
+		},
+	}
+	go func() { _ = srv.Serve(ln) }()
+	defer func() { _ = srv.Shutdown() }()
+
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({http2: true, tls_config: {insecure_skip_verify: true}});
+		var custom = new fasthttp.Request("http://`+ln.Addr().String()+`");
+		var h2 = new fasthttp.Request("`+h2.URL+`");
+	`)
+
+	// HTTP/2 has no reason phrase so the standard one is used
+	res, err := runtime.VU.Runtime().RunString(`[client.get(custom).status_text, client.get(h2).status_text].join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, "419 Session Expired,404 Not Found", res.String())
+}
+
+func TestUserAgent(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Join(r.Header.Values("User-Agent"), ",")))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({user_agent: "client"});
+		var defaulted = new fasthttp.Client({user_agent: "client", default_headers: {"User-Agent": "default"}});
+		var requests = () => [
+			new fasthttp.Request("`+srv.URL+`"),
+			new fasthttp.Request("`+srv.URL+`", {headers: {"User-Agent": "mobile"}}),
+			new fasthttp.Request("`+srv.URL+`", {headers: {"user-agent": "web"}}),
+		];
+	`)
+
+	// sent twice so requests set up from scratch and reused from the pool are both covered
+	res, err := runtime.VU.Runtime().RunString(`
+		[client, defaulted].flatMap((c) => {
+			var reqs = requests();
+			return reqs.concat(reqs).map((req) => c.get(req).body);
+		}).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "client|mobile|web|client|mobile|web|default|mobile|web|default|mobile|web", res.String())
+}
+
+func TestRequestBodyOptions(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + ":" + strconv.FormatInt(r.ContentLength, 10) + ":" + string(body)))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var search = new fasthttp.Request("`+srv.URL+`", {body: '{"query":{}}', allow_body_on_get: true});
+		var dropped = new fasthttp.Request("`+srv.URL+`", {body: '{"query":{}}'});
+		var raw = new fasthttp.Request("`+srv.URL+`", {raw_body: new Uint8Array([104, 105])});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.get(search), client.get(dropped), client.post(raw), client.get(raw)].map((r) => r.body).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, `GET:12:{"query":{}}|GET:0:|POST:2:hi|GET:0:`, res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`new fasthttp.Request("` + srv.URL + `", {raw_body: "hi"})`)
+	require.ErrorContains(t, err, "raw_body expects an ArrayBuffer or Uint8Array")
+}
+
+func TestContentLength(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(strings.Join(r.TransferEncoding, ",") + ":" + strconv.FormatInt(r.ContentLength, 10) + ":" + string(body)))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var hello = new Uint8Array([104, 101, 108, 108, 111]).buffer;
+		var sized = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream(hello), content_length: 5});
+		var cut = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream(hello), content_length: 2});
+		var unhosted = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream(hello), content_length: 5, disable_auto_host: true, headers: {"Host": "example.com"}});
+		var short = new fasthttp.Request("`+srv.URL+`", {body: new fasthttp.FileStream(hello), content_length: 6});
+	`)
+
+	// the stream is rewound for every send, async ones included
+	_, err := runtime.RunOnEventLoop(`
+		var bodies;
+		Promise.all([client.postAsync(sized), client.postAsync(cut)]).then((res) => {
+			bodies = res.concat([client.post(sized), client.post(unhosted)]).map((r) => r.body).join("|");
+		});
+	`)
+	require.NoError(t, err)
+	require.Equal(t, ":5:hello|:2:he|:5:hello|:5:hello", runtime.VU.Runtime().Get("bodies").String())
+
+	res, err := runtime.VU.Runtime().RunString(`client.post(short).error`)
+	require.NoError(t, err)
+	require.Contains(t, res.String(), "copied 5 bytes from body stream instead of 6 bytes")
+
+	_, err = runtime.VU.Runtime().RunString(`new fasthttp.Request("` + srv.URL + `", {body: "hello", content_length: 2})`)
+	require.ErrorContains(t, err, "content_length only applies to FileStream bodies")
+}
+
+func TestChunkedBody(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(strings.Join(r.TransferEncoding, ",") + ":" + strconv.FormatInt(r.ContentLength, 10) + ":" + string(body)))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var text = new fasthttp.Request("`+srv.URL+`", {body: "hello", chunked: true});
+		var raw = new fasthttp.Request("`+srv.URL+`", {raw_body: new Uint8Array([104, 105]), chunked: true});
+		var sized = new fasthttp.Request("`+srv.URL+`", {body: "hello"});
+	`)
+
+	// sent twice to check the stream is reset for the cached request
+	res, err := runtime.VU.Runtime().RunString(`
+		[text, text, raw, raw, sized].map((req) => client.post(req).body).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "chunked:-1:hello|chunked:-1:hello|chunked:-1:hi|chunked:-1:hi|:5:hello", res.String())
+
+	// a GET pools the request without its stream, which the next POST sets again
+	res, err = runtime.VU.Runtime().RunString(`[client.get(text).body, client.post(text).body].join("|")`)
+	require.NoError(t, err)
+	require.Equal(t, ":0:|chunked:-1:hello", res.String())
+}
+
+func TestCachedReqMethod(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + ":" + string(body)))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var warmed = new fasthttp.Request("`+srv.URL+`", {body: "payload"});
+		var req = new fasthttp.Request("`+srv.URL+`", {body: "payload"});
+		client.warmup(warmed, 1);
+	`)
+
+	// requests pooled by a send with another method are sent with the method and body of the next
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.post(warmed), client.get(req), client.post(req), client.get(req), client.put(req)]
+			.map((r) => r.body).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "POST:payload|GET:|POST:payload|GET:|PUT:payload", res.String())
+}
+
+func TestBodyTemplate(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {body_template: '{"id": {{id}}, "name": "{{ name }}"}'});
+	`)
+
+	// sent twice to check the cached request is filled again
+	res, err := runtime.VU.Runtime().RunString(`
+		req.setVars({id: 1, name: "first"});
+		var first = client.post(req).body;
+		req.setVars({id: 2, name: "second"});
+		[first, client.post(req).body].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, `{"id": 1, "name": "first"}|{"id": 2, "name": "second"}`, res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`req.setVars({id: 3}); client.post(req);`)
+	require.ErrorContains(t, err, `no value for body_template placeholder "name"`)
+
+	// the request which failed to fill is pooled again, and filled with the method of the next send
+	res, err = runtime.VU.Runtime().RunString(`
+		var got = client.get(req).body;
+		req.setVars({id: 3, name: "third"});
+		[got, client.post(req).body].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, `|{"id": 3, "name": "third"}`, res.String())
+
+	for _, opts := range []string{`{body_template: "{{id"}`, `{body_template: "{{}}"}`, `{body_template: "{{id}}", body: "body"}`} {
+		_, err = runtime.VU.Runtime().RunString(`new fasthttp.Request("` + srv.URL + `", ` + opts + `)`)
+		require.Error(t, err, opts)
+	}
+}
+
+func TestAWSSig4(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		_, _ = w.Write([]byte(strings.Join([]string{
+			string(body),
+			strconv.FormatBool(r.Header.Get("X-Amz-Content-Sha256") == hex.EncodeToString(sum[:])),
+			r.Header.Get("X-Amz-Security-Token"),
+			r.Header.Get("Authorization"),
+		}, "|")))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({bearer_token: "ignored"});
+		var req = new fasthttp.Request("`+srv.URL+`/bucket/key", {
+			body: new fasthttp.FileStream(new Uint8Array([104, 101, 108, 108, 111]).buffer),
+			aws_sig4: {access_key: "AKID", secret_key: "secret", region: "eu-west-1", service: "s3", session_token: "token"},
+		});
+	`)
+
+	for i := 0; i < 2; i++ {
+		res, err := runtime.VU.Runtime().RunString(`client.put(req).body`)
+		require.NoError(t, err)
+		parts := strings.Split(res.String(), "|")
+		require.Equal(t, []string{"hello", "true", "token"}, parts[:3])
+		require.Regexp(t, `^AWS4-HMAC-SHA256 Credential=AKID/\d{8}/eu-west-1/s3/aws4_request, `+
+			`SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature=[0-9a-f]{64}$`, parts[3])
+	}
+}
+
+func TestResponseHTML(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`<html><body>
+			<h1>Login</h1>
+			<form><input type="hidden" name="csrf" value="token123"></form>
+			<ul><li>a</li><li>b</li></ul>
+		</body></html>`))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(req);
+		var doc = res.html();
+		[
+			doc.find("h1").text(),
+			doc.find("input[name=csrf]").attr("value"),
+			res.html("li").size(),
+		].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "Login|token123|2", res.String())
+}
+
+func TestResponseExtract(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`<input type="hidden" name="csrf" value="token123"> session=abc; user=bob`))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(req);
+		[
+			res.extract(/name="csrf" value="([^"]+)"/),
+			res.extract("session=(\\w+); user=(\\w+)", 2),
+			res.extract("session=\\w+", 0),
+			res.extract(/missing=(\w+)/) === null,
+			res.extract(/session=(\w+)/, 5) === null,
+		].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "token123|bob|session=abc|true|true", res.String())
+}
+
+func TestResponseRevalidate(t *testing.T) {
+	t.Parallel()
+
+	const lastModified = "Wed, 21 Oct 2015 07:28:00 GMT"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("X-Token", r.Header.Get("X-Token"))
+		if r.Header.Get("If-None-Match") == `"v1"` && r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {headers: {"X-Token": "abc", "if-none-match": "stale"}});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(req);
+		var revalidated = res.revalidate();
+		var withReq = res.revalidate(req);
+		[
+			res.status, res.body,
+			revalidated.status, revalidated.body === null,
+			withReq.status, withReq.headers["X-Token"],
+			client.get(req).status,
+		].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "200|body|304|true|304|abc|200", res.String())
+}
+
+func TestGraphql(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if payload.Variables["id"] == nil {
+			_, _ = w.Write([]byte(`{"data":null,"errors":[{"message":"id required"}]}`))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"data":{"user":{"id":%q}},"via":%q}`, payload.Variables["id"], r.Method+" "+r.Header.Get("Content-Type"))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		var query = "query ($id: ID!) { user(id: $id) { id } }";
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var ok = client.graphql(req, query, {id: "1"});
+		var again = client.graphql("` + srv.URL + `", query, {id: "2"});
+		var failed = client.graphql(req, query);
+		[
+			ok.json("data.user.id"), ok.json("via"), ok.graphqlErrors(),
+			again.json("data.user.id"), failed.graphqlErrors()[0].message,
+		].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "1|POST application/json||2|id required", res.String())
+
+	// the request is sent as a copy, its own headers left as they were
+	res, err = runtime.VU.Runtime().RunString(`
+		var headed = new fasthttp.Request("` + srv.URL + `", {headers: {"X-A": "a"}});
+		client.graphql(headed, query, {id: "1"});
+		JSON.stringify(headed.headers);
+	`)
+	require.NoError(t, err)
+	require.Equal(t, `{"X-A":"a"}`, res.String())
+}
+
+func TestBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Join(r.Header.Values("Authorization"), ",")))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({default_headers: {"Authorization": "Bearer default"}});
+		var auth = new fasthttp.Request("`+srv.URL+`", {basic_auth: {username: "jürgen", password: "pä:ss"}});
+		var explicit = new fasthttp.Request("`+srv.URL+`", {
+			basic_auth: {username: "user", password: "pass"},
+			headers: {"authorization": "Basic explicit"},
+		});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(auth).body + "|" + client.get(explicit).body`)
+	require.NoError(t, err)
+	require.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("jürgen:pä:ss"))+"|Basic explicit", res.String())
+}
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Join(r.Header.Values("Authorization"), ",")))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({bearer_token: "client", default_headers: {"Authorization": "Basic default"}});
+		var fallback = new fasthttp.Request("`+srv.URL+`");
+		var rotated = new fasthttp.Request("`+srv.URL+`", {bearer_token: "rotated"});
+		var explicit = new fasthttp.Request("`+srv.URL+`", {bearer_token: "rotated", headers: {"Authorization": "Bearer explicit"}});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`[client.get(fallback).body, client.get(rotated).body, client.get(explicit).body].join("|")`)
+	require.NoError(t, err)
+	require.Equal(t, "Bearer client|Bearer rotated|Bearer explicit", res.String())
+}
+
+func TestLocalAddrs(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		_, _ = w.Write([]byte(host))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({local_addrs: ["127.0.0.1", "127.0.0.2"]});
+		var req = new fasthttp.Request("`+srv.URL+`", {disable_keep_alive: true});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`[client.get(req).body, client.get(req).body, client.get(req).body].join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1,127.0.0.2,127.0.0.1", res.String())
+}
+
+func TestWaitingAndReceiving(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(strings.Repeat("a", streamResponseBodyThreshold)))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte(strings.Repeat("b", streamResponseBodyThreshold)))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.VU.Runtime().RunString(`client.get(req)`)
+	require.NoError(t, err)
+
+	phases := map[string]float64{}
+	for _, sample := range samplesNamed(
+		samples, metrics.HTTPReqWaitingName, metrics.HTTPReqReceivingName, metrics.HTTPReqDurationName,
+	) {
+		phases[sample.Metric.Name] = sample.Value
+	}
+	require.GreaterOrEqual(t, phases[metrics.HTTPReqWaitingName], 50.0)
+	require.GreaterOrEqual(t, phases[metrics.HTTPReqReceivingName], 50.0)
+	require.GreaterOrEqual(t, phases[metrics.HTTPReqDurationName], phases[metrics.HTTPReqWaitingName]+phases[metrics.HTTPReqReceivingName])
+}
+
+func TestConnAddrs(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(req);
+		[res.remote_addr, res.remote_ip, res.remote_port, res.local_addr === res.body].join(",");
+	`)
+	require.NoError(t, err)
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	require.Equal(t, fmt.Sprintf("%s,%s,%d,true", addr, addr.IP, addr.Port), res.String())
+}
+
+func TestProxied(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	var tunnels atomic.Int32
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		tunnels.Add(1)
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(target, buf)
+			_ = target.Close()
+		}()
+		_, _ = io.Copy(conn, target)
+		_ = conn.Close()
+	}))
+	defer proxySrv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var proxied = new fasthttp.Client({proxy: "`+proxySrv.Listener.Addr().String()+`"});
+		var bypassed = new fasthttp.Client({proxy: "`+proxySrv.Listener.Addr().String()+`", no_proxy: "example.com, 127.0.0.0/8"});
+		var direct = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[proxied.get(req), bypassed.get(req), direct.get(req)].map(r => r.body + ":" + r.proxied).join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "ok:true,ok:false,ok:false", res.String())
+	require.EqualValues(t, 1, tunnels.Load())
+}
+
+func TestNoProxy(t *testing.T) {
+	t.Parallel()
+
+	np, err := parseNoProxy(" .example.com,localhost, 10.0.0.0/8,::1")
+	require.NoError(t, err)
+	for addr, expected := range map[string]bool{
+		"example.com:443":     true,
+		"api.example.com:80":  true,
+		"badexample.com:80":   false,
+		"LOCALHOST:8080":      true,
+		"10.1.2.3:80":         true,
+		"11.1.2.3:80":         false,
+		"[::1]:443":           true,
+		"other.localhost.com": false,
+	} {
+		require.Equal(t, expected, np.matches(addr), addr)
+	}
+
+	np, err = parseNoProxy("*")
+	require.NoError(t, err)
+	require.True(t, np.matches("anything:80"))
+
+	_, err = parseNoProxy("10.0.0.0/33")
+	require.ErrorContains(t, err, "invalid no_proxy entry")
+}
+
+func TestSendRaw(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				head, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(head, "GARBAGE") {
+					_, _ = conn.Write([]byte("not http"))
+					return
+				}
+				// the connection is left open so the response must be parsed to know it's complete
+				_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(head), head)
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	runtime, _ := newClientTestRuntime(t, `var client = new fasthttp.Client({});`)
+	res, err := runtime.VU.Runtime().RunString(`
+		var decode = (b) => String.fromCharCode(...new Uint8Array(b));
+		[
+			decode(client.sendRaw("` + ln.Addr().String() + `", "get  /odd\tHTTP/1.1\r\nhOsT: x\r\n\r\n")),
+			decode(client.sendRaw("http://` + ln.Addr().String() + `", new Uint8Array([71, 65, 82, 66, 65, 71, 69, 10]).buffer)),
+		].join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 20\r\n\r\nget  /odd\tHTTP/1.1\r\n|not http", res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`client.sendRaw("ftp://` + ln.Addr().String() + `", "")`)
+	require.ErrorContains(t, err, `unsupported sendRaw scheme "ftp"`)
+
+	// without a read_timeout a server which never answers, as with a request line never ended, is
+	// given up on after the default
+	_, _, _, _, raw, err := parseClientConfig(ClientConfig{})
+	require.NoError(t, err)
+	require.Equal(t, defaultRawSendTimeout, raw.sendTimeout)
+	_, _, _, _, raw, err = parseClientConfig(ClientConfig{ReadTimeout: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, raw.sendTimeout)
+
+	raw.sendTimeout = 50 * time.Millisecond
+	_, err = raw.send(context.Background(), ln.Addr().String(), false, []byte("GET /"))
+	require.ErrorIs(t, err, fasthttp.ErrTimeout)
+}
+
+func TestResponseProto(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				proto := "HTTP/1.1"
+				if req.URL.Path == "/1.0" {
+					proto = "HTTP/1.0"
+				}
+				_, _ = conn.Write([]byte(proto + " 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+			}()
+		}
+	}()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var old = new fasthttp.Request("http://`+ln.Addr().String()+`/1.0");
+		var current = new fasthttp.Request("http://`+ln.Addr().String()+`/1.1");
+	`)
+	res, err := runtime.VU.Runtime().RunString(`[client.get(old).proto, client.get(current).proto].join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/1.0,HTTP/1.1", res.String())
+}
+
+// newHeaderEchoServer returns the URL of a server replying with the request's header block as sent,
+// its lines joined by ";"
+func newHeaderEchoServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				for {
+					var head []string
+					for {
+						line, err := r.ReadString('\n')
+						if err != nil {
+							return
+						}
+						if line == "\r\n" {
+							break
+						}
+						head = append(head, strings.TrimSuffix(line, "\r\n"))
+					}
+					req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader(strings.Join(head, "\r\n") + "\r\n\r\n")))
+					_, _ = io.CopyN(io.Discard, r, req.ContentLength)
+					body := strings.Join(head[1:], ";")
+					_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				}
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestDisableAutoHost(t *testing.T) {
+	t.Parallel()
+
+	url := newHeaderEchoServer(t)
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var named = new fasthttp.Client({user_agent: "k6"});
+		var none = new fasthttp.Request("`+url+`", {disable_auto_host: true});
+		var other = new fasthttp.Request("`+url+`", {disable_auto_host: true});
+		var empty = new fasthttp.Request("`+url+`", {disable_auto_host: true, headers: {"Host": ""}});
+		var wrong = new fasthttp.Request("`+url+`", {disable_auto_host: true, host: "elsewhere", body: "data"});
+		var typed = new fasthttp.Request("`+url+`", {
+			disable_auto_host: true, body: "{}", ordered_headers: [["User-Agent", "curl"]], headers: {"Content-Type": "application/json"},
+		});
+	`)
+	res, err := runtime.VU.Runtime().RunString(`
+		[
+			client.get(none).body, named.get(other).body, client.get(empty).body, client.post(wrong).body,
+			client.post(wrong).body, client.get(wrong).body, client.post(typed).body,
+		].join("|");
+	`)
+	require.NoError(t, err)
+	// the User-Agent and default Content-Type fasthttp sets itself are kept, in the order it sends them
+	require.Equal(t, []string{
+		"User-Agent: fasthttp",
+		"User-Agent: k6",
+		"User-Agent: fasthttp;Host: ",
+		"User-Agent: fasthttp;Host: elsewhere;Content-Type: application/octet-stream;Content-Length: 4",
+		"User-Agent: fasthttp;Host: elsewhere;Content-Type: application/octet-stream;Content-Length: 4",
+		"User-Agent: fasthttp;Host: elsewhere",
+		"User-Agent: curl;Content-Type: application/json;Content-Length: 2",
+	}, strings.Split(res.String(), "|"))
+}
+
+func TestRequestClone(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s;%s;%s;%s", r.URL.Path, r.Header.Get("X-A"), r.Header.Get("X-B"), body)
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var base = new fasthttp.Request("`+srv.URL+`/base", {headers: {"X-A": "a"}, body_template: "{{id}}"});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		base.setVars({id: "1"});
+		var copy = base.clone();
+		var variant = base.clone({url: "` + srv.URL + `/variant", headers: {"X-B": "b"}});
+		// the original's pooled request isn't shared with its clones
+		var bodies = [client.post(base).body, client.post(copy).body, client.post(variant).body];
+		copy.setVars({id: "2"});
+		bodies.push(client.post(copy).body, client.post(base).body);
+		bodies.join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "/base;a;;1,/base;a;;1,/variant;;b;1,/base;a;;2,/base;a;;1", res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`base.clone({body: "x"})`)
+	require.ErrorContains(t, err, "body_template can't be combined with body")
+
+	_, err = runtime.VU.Runtime().RunString(`base.clone({body: "x", body_template: ""})`)
+	require.NoError(t, err)
+
+	// options set through pointers are copied rather than shared with the original
+	res, err = runtime.VU.Runtime().RunString(`
+		var authed = new fasthttp.Request("` + srv.URL + `", {basic_auth: {username: "a", password: "p"}, max_redirects: 1});
+		var other = authed.clone({basic_auth: {username: "b"}, max_redirects: 2});
+		[authed.basic_auth.username, authed.basic_auth.password, authed.max_redirects, other.basic_auth.username].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "a,p,1,b", res.String())
+}
+
+func TestOrderedHeaders(t *testing.T) {
+	t.Parallel()
+
+	url := newHeaderEchoServer(t)
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({default_headers: {"Accept": "*/*", "X-Default": "1"}});
+		var ordered = new fasthttp.Request("`+url+`", {
+			headers: {"X-Last": "1"},
+			ordered_headers: [["X-B", "2"], ["accept", "text/html"], ["X-A", "1"], ["X-B", "3"]],
+		});
+		var impersonated = new fasthttp.Request("`+url+`", {
+			disable_auto_host: true,
+			ordered_headers: [["User-Agent", "Mozilla/5.0"], ["Host", "example.com"], ["Accept", "*/*"]],
+		});
+	`)
+	res, err := runtime.VU.Runtime().RunString(`[client.get(ordered).body, client.get(impersonated).body].join("|")`)
+	require.NoError(t, err)
+
+	sent := strings.Split(res.String(), "|")
+	// fasthttp writes the User-Agent and Host it sets itself first
+	require.Equal(t, "X-B: 2;accept: text/html;X-A: 1;X-B: 3;X-Default: 1;X-Last: 1",
+		strings.Join(strings.Split(sent[0], ";")[2:], ";"))
+	require.Equal(t, "User-Agent: Mozilla/5.0;Host: example.com;Accept: */*;X-Default: 1", sent[1])
+
+	_, err = runtime.VU.Runtime().RunString(`new fasthttp.Request("` + url + `", {ordered_headers: [["X-A"]]})`)
+	require.ErrorContains(t, err, "ordered_headers expects [name, value] pairs")
+}
+
+func TestInvalidLocalAddr(t *testing.T) {
+	t.Parallel()
+
+	_, _, _, _, _, err := parseClientConfig(ClientConfig{LocalAddr: "localhost"})
+	require.ErrorContains(t, err, `invalid local address "localhost"`)
+}
+
+func TestMaxResponseBodySize(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("a", 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// flushing before the body is written forces a chunked response without a Content-Length
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_response_body_size: 100});
+		var fixed = new fasthttp.Request("`+srv.URL+`/fixed");
+		var chunked = new fasthttp.Request("`+srv.URL+`/chunked");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`[client.get(fixed).error_code, client.get(chunked).error_code].join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, "1702,1702", res.String())
+
+	// a request's own limit overrides the client's, either way
+	res, err = runtime.VU.Runtime().RunString(`
+		var raised = new fasthttp.Request("` + srv.URL + `/fixed", {max_body_size: 2048});
+		var lowered = new fasthttp.Request("` + srv.URL + `/fixed", {max_body_size: 10});
+		var truncated = new fasthttp.Request("` + srv.URL + `/chunked", {max_body_size: 10, truncate_body: true});
+		[client.get(raised).body.length, client.get(lowered).error_code, client.get(truncated).body, client.get(fixed).error_code].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "1024,1702,aaaaaaaaaa,1702", res.String())
+}
+
+func TestMaxResponseBodySizeClosesConn(t *testing.T) {
+	t.Parallel()
+
+	// a body whose length is known to be over the limit, sent for as long as it's read up to a few
+	// seconds
+	closed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		defer close(closed)
+		w.Header().Set("Content-Length", strconv.Itoa(1<<30))
+		chunk := []byte(strings.Repeat("a", 64*1024))
+		for end := time.Now().Add(5 * time.Second); time.Now().Before(end); {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_response_body_size: 1024});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	start := time.Now()
+	res, err := runtime.VU.Runtime().RunString(`client.get(req).error_code`)
+	require.NoError(t, err)
+	require.EqualValues(t, 1702, res.Export())
+	// the rest of the body isn't read, its connection being closed
+	require.Less(t, time.Since(start), time.Second)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't closed once the body went over the limit")
+	}
+}
+
+func TestBodyErrorMetrics(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 1024)))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		var tooLarge = new fasthttp.Request("`+srv.URL+`", {max_body_size: 10});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.get(req), client.get(tooLarge)].map((r) => r.status + " " + r.error_code).join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "200 0,200 1702", res.String())
+
+	// the status is kept while the request is failed by its body
+	var failed []float64
+	var tags []string
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqFailedName) {
+		failed = append(failed, sample.Value)
+		status, _ := sample.Tags.Get("status")
+		code, _ := sample.Tags.Get("error_code")
+		tags = append(tags, status+" "+code)
+	}
+	require.Equal(t, []float64{0, 1}, failed)
+	require.Equal(t, []string{"200 ", "200 1702"}, tags)
+}
+
+func TestHTTP2(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Proto + " " + string(body)))
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({http2: true, tls_config: {insecure_skip_verify: true}});
+		var h2 = new fasthttp.Request("`+h2.URL+`", {body: "body"});
+		var h1 = new fasthttp.Request("`+h1.URL+`", {body: "body"});
+	`)
+
+	// h1 is sent twice to check the fallback is remembered
+	res, err := runtime.VU.Runtime().RunString(`
+		var h2Res = client.post(h2);
+		[h2Res.body, h2Res.proto, client.post(h1).body, client.post(h1).proto].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "HTTP/2.0 body,HTTP/2.0,HTTP/1.1 body,HTTP/1.1", res.String())
+}
+
+func TestInsecureSkipVerifyOverride(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var verify = new fasthttp.Client({});
+		var skip = new fasthttp.Client({tls_config: {insecure_skip_verify: true}});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		var skipReq = new fasthttp.Request("`+srv.URL+`", {insecure_skip_verify: true});
+		var verifyReq = new fasthttp.Request("`+srv.URL+`", {insecure_skip_verify: false});
+	`)
+
+	// the self-signed certificate is rejected unless verification is skipped, whichever client sends it
+	res, err := runtime.VU.Runtime().RunString(`
+		[
+			verify.get(req).status, verify.get(skipReq).status, verify.get(req).status,
+			skip.get(req).status, skip.get(verifyReq).status, skip.get(req).status,
+		].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "0,200,0,200,0,200", res.String())
+}
+
+func TestTLSRenegotiation(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]tls.RenegotiationSupport{
+		"":       tls.RenegotiateNever,
+		"never":  tls.RenegotiateNever,
+		"once":   tls.RenegotiateOnceAsClient,
+		"freely": tls.RenegotiateFreelyAsClient,
+	} {
+		_, _, _, _, raw, err := parseClientConfig(ClientConfig{TLSConfig: TLSConfig{Renegotiation: name}})
+		require.NoError(t, err)
+		require.Equal(t, expected, raw.tlsConfig.Renegotiation, name)
+	}
+
+	_, _, _, _, _, err := parseClientConfig(ClientConfig{TLSConfig: TLSConfig{Renegotiation: "always"}})
+	require.ErrorContains(t, err, `unknown tls_config.renegotiation "always"`)
+}
+
+func TestTLSNextProtos(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var none = new fasthttp.Client({tls_config: {insecure_skip_verify: true}});
+		var custom = new fasthttp.Client({tls_config: {insecure_skip_verify: true, next_protos: ["custom", "http/1.1"]}});
+		var h2 = new fasthttp.Client({http2: true, tls_config: {insecure_skip_verify: true}});
+		var h1 = new fasthttp.Client({http2: true, tls_config: {insecure_skip_verify: true, next_protos: ["http/1.1"]}});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	// http/1.1 is forced even though the server selects h2 when offered, and protocols it doesn't
+	// support are passed over
+	res, err := runtime.VU.Runtime().RunString(`
+		[none, custom, h2, h1].map((c) => c.get(req)).map((r) => r.negotiated_protocol + " " + r.body).join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, " HTTP/1.1,http/1.1 HTTP/1.1,h2 HTTP/2.0,http/1.1 HTTP/1.1", res.String())
+}
+
+func TestTLSResumed(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var full = new fasthttp.Client({tls_tags: true, tls_config: {insecure_skip_verify: true}});
+		var resumed = new fasthttp.Client({tls_tags: true, tls_config: {insecure_skip_verify: true, session_tickets: true}});
+		var untagged = new fasthttp.Client({tls_config: {insecure_skip_verify: true}});
+		// every request makes a handshake on a connection of its own
+		var req = new fasthttp.Request("`+srv.URL+`", {disable_keep_alive: true});
+	`)
+
+	_, err := runtime.VU.Runtime().RunString(`
+		full.get(req); full.get(req); resumed.get(req); resumed.get(req); untagged.get(req);
+	`)
+	require.NoError(t, err)
+
+	var rates []float64
+	var tags, ciphers []string
+	for _, sample := range samplesNamed(samples, fasthttpmetrics.TLSResumedName, metrics.HTTPReqsName) {
+		if sample.Metric.Name == metrics.HTTPReqsName {
+			cipher, _ := sample.Tags.Get("tls_cipher_suite")
+			ciphers = append(ciphers, cipher)
+			continue
+		}
+		rates = append(rates, sample.Value)
+		tag, _ := sample.Tags.Get("tls_resumed")
+		tags = append(tags, tag)
+	}
+	require.Equal(t, []float64{0, 0, 0, 1, 0}, rates)
+	// the tags are left out without tls_tags, though tls_version is among the system tags
+	require.Equal(t, []string{"false", "false", "false", "true", ""}, tags)
+	require.Len(t, ciphers, 5)
+	for _, cipher := range ciphers[:4] {
+		require.Contains(t, cipher, "TLS_")
+	}
+	require.Empty(t, ciphers[4])
+}
+
+func TestPeerCertificates(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({tls_config: {insecure_skip_verify: true}});
+		var h2Client = new fasthttp.Client({http2: true, tls_config: {insecure_skip_verify: true}});
+		var tlsReq = new fasthttp.Request("`+tlsSrv.URL+`");
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	cert := tlsSrv.Certificate()
+	res, err := runtime.VU.Runtime().RunString(`
+		var certs = client.get(tlsReq).peerCertificates();
+		var h2Certs = h2Client.get(tlsReq).peerCertificates();
+		[
+			certs.length, certs[0].subject, certs[0].issuer, new Date(certs[0].not_after).getTime(),
+			certs[0].subject_alt_names.join(" "), h2Certs.length, client.get(req).peerCertificates().length,
+		].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("1,%s,%s,%d,example.com *.example.com 127.0.0.1 ::1,1,0",
+		cert.Subject, cert.Issuer, cert.NotAfter.UnixMilli()), res.String())
+}
+
+func TestDebugDump(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Reply", "1")
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({debug: true});
+		var req = new fasthttp.Request("`+srv.URL+`", {headers: {"x-sent": "1"}, body: "ping"});
+	`)
+	hook := logtest.NewLocal(runtime.VU.StateField.Logger.(*logrus.Logger))
+
+	_, err := runtime.VU.Runtime().RunString(`client.post(req)`)
+	require.NoError(t, err)
+
+	entries := hook.AllEntries()
+	require.Len(t, entries, 2)
+	require.Contains(t, entries[0].Message, "Request:\nPOST / HTTP/1.1\r\n")
+	require.Contains(t, entries[0].Message, "x-sent: 1\r\n")
+	require.Contains(t, entries[0].Message, "\r\n\r\nping")
+	require.Contains(t, entries[1].Message, "Response:\nHTTP/1.1 200 OK\r\n")
+	require.Contains(t, entries[1].Message, "X-Reply: 1\r\n")
+	require.Contains(t, entries[1].Message, "\r\n\r\npong")
+}
+
+// writeClientCertificate writes a self-signed certificate for commonName and its key to dir
+func writeClientCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, commonName+".crt"), filepath.Join(dir, commonName+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestClientCertificates(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	localCert, localKey := writeClientCertificate(t, dir, "local")
+	anyCert, anyKey := writeClientCertificate(t, dir, "any")
+
+	port := srv.URL[strings.LastIndex(srv.URL, ":")+1:]
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({tls_config: {
+			insecure_skip_verify: true,
+			certificates: [
+				{certificate: "`+anyCert+`", private_key: "`+anyKey+`"},
+				{certificate: "`+localCert+`", private_key: "`+localKey+`", server_name: "LOCALHOST"},
+			],
+		}});
+		var byName = new fasthttp.Request("https://localhost:`+port+`");
+		var byIP = new fasthttp.Request("https://127.0.0.1:`+port+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`[client.get(byName).body, client.get(byIP).body].join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, "local,any", res.String())
+}
+
+func TestPipeline(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({pipeline: {max_conns: 1, max_pending_requests: 10}});
+		var reqs = [1, 2, 3, 4, 5].map((i) => new fasthttp.Request("`+srv.URL+`/" + i));
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var bodies, remote, phases;
+		Promise.all(reqs.map((req) => client.getAsync(req))).then((res) => {
+			bodies = res.map((r) => r.body).join(",");
+			remote = res.every((r) => r.remote_addr == "` + srv.Listener.Addr().String() + `");
+			phases = res.map((r) => r.timings.sending + r.timings.waiting + r.timings.receiving).join(",");
+		});
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "/1,/2,/3,/4,/5", runtime.VU.Runtime().Get("bodies").String())
+	// pipelined connections are traced as the default client's are
+	require.True(t, runtime.VU.Runtime().Get("remote").ToBoolean())
+	// though their requests aren't timed by phase
+	require.Equal(t, "0,0,0,0,0", runtime.VU.Runtime().Get("phases").String())
+
+	counts := map[string]float64{}
+	// the phases aren't timed, so any of their samples would show up among the counts
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName, fasthttpmetrics.HTTPReqNewConnName,
+		metrics.HTTPReqWaitingName, metrics.HTTPReqReceivingName) {
+		counts[sample.Metric.Name] += sample.Value
+	}
+	require.Equal(t, map[string]float64{metrics.HTTPReqsName: 5, fasthttpmetrics.HTTPReqNewConnName: 1}, counts)
+}
+
+func TestNewConnMetric(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_conns_per_host: 1});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.VU.Runtime().RunString(`client.get(req); client.get(req); client.get(req);`)
+	require.NoError(t, err)
+
+	require.Equal(t, []float64{1, 0, 0}, sampleValues(samples, fasthttpmetrics.HTTPReqNewConnName))
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({disable_keep_alive: true});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.VU.Runtime().RunString(`client.get(req); client.get(req); client.get(req);`)
+	require.NoError(t, err)
+	_, err = runtime.VU.Runtime().RunString(`client.warmup(req, 1)`)
+	require.ErrorContains(t, err, "warmup can't be used with disable_keep_alive")
+
+	newConns := sampleValues(samples, fasthttpmetrics.HTTPReqNewConnName)
+	require.Equal(t, []float64{1, 1, 1}, newConns)
+
+	_, _, _, _, _, err = parseClientConfig(ClientConfig{DisableKeepAlive: true, HTTP2: true})
+	require.ErrorContains(t, err, "disable_keep_alive can't be combined with http2 or pipeline")
+}
+
+func TestOpenConnsMetric(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		// held so the concurrent requests can't share a connection
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_conns_per_host: 2});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		var other = new fasthttp.Request("`+srv.URL+`/other");
+	`)
+
+	// the concurrent requests dial a connection each, which stay open for the later request
+	_, err := runtime.RunOnEventLoop(`
+		Promise.all([client.getAsync(req), client.getAsync(other)]).then(() => client.get(req));
+	`)
+	require.NoError(t, err)
+
+	openConns := sampleValues(samples, fasthttpmetrics.OpenConnsName)
+	require.Len(t, openConns, 3)
+	require.Equal(t, float64(2), openConns[2])
+}
+
+func TestRedirects(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/3", "/2", "/1":
+			n, _ := strconv.Atoi(r.URL.Path[1:])
+			http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+		case "/temporary":
+			http.Redirect(w, r, "/0", http.StatusTemporaryRedirect)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte(r.Method + " " + string(body)))
+		}
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_redirects: 3});
+		var noRedirects = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`/3", {body: "body"});
+		var once = new fasthttp.Request("`+srv.URL+`/3", {max_redirects: 1});
+		var temporary = new fasthttp.Request("`+srv.URL+`/temporary", {body: "body"});
+	`)
+
+	// 302 is followed with a GET without the body, 307 with the same method and body
+	res, err := runtime.VU.Runtime().RunString(`
+		[
+			client.post(req).body, noRedirects.get(req).status, client.get(once).status,
+			client.post(temporary).body, client.post(req).body,
+		].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "GET ,302,302,POST body,GET ", res.String())
+
+	redirects := sampleValues(samples, fasthttpmetrics.HTTPReqRedirectsName)
+	require.Equal(t, []float64{3, 0, 1, 1, 3}, redirects)
+
+	// url stays the requested one for metrics
+	res, err = runtime.VU.Runtime().RunString(`
+		[client.get(req), client.get(once), noRedirects.get(req)].map((r) => r.url + " " + r.final_url).join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("%[1]s/3 %[1]s/0,%[1]s/3 %[1]s/2,%[1]s/3 %[1]s/3", srv.URL), res.String())
+}
+
+func TestBodySize(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/empty" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = w.Write([]byte(strings.Repeat("a", 1000)))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`/");
+		var discarded = new fasthttp.Request("`+srv.URL+`/", {response_type: "none"});
+		var empty = new fasthttp.Request("`+srv.URL+`/empty");
+	`)
+
+	// bodies which aren't kept are still measured
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.get(req), client.get(discarded), client.get(empty)].map((r) => r.body_size).join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "1000,1000,0", res.String())
+
+	sizes := sampleValues(samples, fasthttpmetrics.HTTPRespBodySizeName)
+	require.Equal(t, []float64{1000, 1000, 0}, sizes)
+}
+
+func TestRedirectCredentials(t *testing.T) {
+	t.Parallel()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization") + ";" + r.Header.Get("Cookie") + ";" +
+			r.Header.Get("Proxy-Authorization")))
+	}))
+	defer target.Close()
+	_, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the same host on another port, or another host of the same server
+		if r.URL.Path == "/same" {
+			http.Redirect(w, r, target.URL, http.StatusFound)
+		} else {
+			http.Redirect(w, r, "http://localhost:"+port, http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_redirects: 1, bearer_token: "token"});
+		var headers = {"Cookie": "session=1", "Proxy-Authorization": "Basic cHJveHk="};
+		var same = new fasthttp.Request("`+srv.URL+`/same", {headers: headers});
+		var other = new fasthttp.Request("`+srv.URL+`/other", {headers: headers});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(same).body + "|" + client.get(other).body`)
+	require.NoError(t, err)
+	require.Equal(t, "Bearer token;session=1;Basic cHJveHk=|;;", res.String())
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := attempts.Add(1)
+		switch {
+		case r.URL.Path == "/date" && n == 1:
+			// in the past so retried straight away
+			w.Header().Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/seconds" && n == 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/long":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		_, _ = w.Write([]byte(strconv.Itoa(int(n))))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({retry_after: {max_retries: 2, max_wait: 10}});
+		var date = new fasthttp.Request("`+srv.URL+`/date");
+		var seconds = new fasthttp.Request("`+srv.URL+`/seconds");
+		var long = new fasthttp.Request("`+srv.URL+`/long");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(date).body`)
+	require.NoError(t, err)
+	require.Equal(t, "2", res.String())
+
+	attempts.Store(0)
+	res, err = runtime.VU.Runtime().RunString(`
+		var res = client.get(seconds);
+		[res.body, res.timings.blocked >= 1000, res.timings.duration < 1000].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "2,true,true", res.String())
+
+	// waits longer than max_wait are returned rather than retried
+	attempts.Store(0)
+	res, err = runtime.VU.Runtime().RunString(`client.get(long).status`)
+	require.NoError(t, err)
+	require.Equal(t, int64(429), res.ToInteger())
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestRetryJitter(t *testing.T) {
+	t.Parallel()
+
+	wait := 10 * time.Second
+	for i := 0; i < 100; i++ {
+		// never sooner than the Retry-After
+		full := jittered(wait, "full")
+		require.GreaterOrEqual(t, full, wait)
+		require.LessOrEqual(t, full, 2*wait)
+
+		equal := jittered(wait, "equal")
+		require.GreaterOrEqual(t, equal, wait)
+		require.LessOrEqual(t, equal, wait+wait/2)
+	}
+	require.Equal(t, wait, jittered(wait, ""))
+	require.Zero(t, jittered(0, "full"))
+
+	_, _, _, _, _, err := parseClientConfig(ClientConfig{RetryAfter: &RetryAfterConfig{Jitter: "none"}})
+	require.ErrorContains(t, err, `unknown retry_after jitter "none"`)
+}
+
+func TestRetryAfterHuge(t *testing.T) {
+	t.Parallel()
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	resp.SetStatusCode(http.StatusTooManyRequests)
+
+	// waits overflowing a time.Duration, or an int64 of seconds, are clamped rather than wrapping
+	// around to a negative or short wait, and can still be jittered
+	now := time.Now()
+	for _, value := range []string{
+		"9999999999999", "99999999999999999999999", now.AddDate(400, 0, 0).UTC().Format(http.TimeFormat),
+	} {
+		resp.Header.Set("Retry-After", value)
+		wait, ok := retryAfter(resp, now)
+		require.True(t, ok, value)
+		require.Equal(t, maxRetryAfter, wait, value)
+		require.GreaterOrEqual(t, jittered(wait, "full"), wait)
+	}
+
+	resp.Header.Set("Retry-After", "-99999999999999999999999")
+	_, ok := retryAfter(resp, now)
+	require.False(t, ok)
+}
+
+func TestVUTags(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	// as set by k6 when the VU moves on to another scenario, group and iteration
+	for i, scenario := range []string{"first", "second"} {
+		runtime.VU.State().Tags.Modify(func(tagsAndMeta *metrics.TagsAndMeta) {
+			tagsAndMeta.SetTag("scenario", scenario)
+			tagsAndMeta.SetTag("group", "::"+scenario)
+			tagsAndMeta.SetMetadata("iter", strconv.Itoa(i))
+		})
+		_, err := runtime.VU.Runtime().RunString(`client.get(req)`)
+		require.NoError(t, err)
+	}
+
+	var tagged []string
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName) {
+		scenario, _ := sample.Tags.Get("scenario")
+		group, _ := sample.Tags.Get("group")
+		tagged = append(tagged, scenario+","+group+","+sample.Metadata["iter"])
+	}
+	require.Equal(t, []string{"first,::first,0", "second,::second,1"}, tagged)
+}
+
+func TestGroupTag(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+	k6, ok := k6module.New().NewModuleInstance(runtime.VU).(*k6module.K6)
+	require.True(t, ok)
+	require.NoError(t, runtime.VU.Runtime().Set("group", k6.Group))
+
+	_, err := runtime.VU.Runtime().RunString(`
+		client.get(req);
+		group("login", () => {
+			fasthttp.checkstatus(200, client.get(req));
+		});
+	`)
+	require.NoError(t, err)
+
+	var tagged []string
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName, metrics.ChecksName) {
+		group, _ := sample.Tags.Get("group")
+		tagged = append(tagged, sample.Metric.Name+":"+group)
+	}
+	require.Equal(t, []string{"http_reqs:", "http_reqs:::login", "checks:::login"}, tagged)
+}
+
+func TestResponseTypeNone(t *testing.T) {
+	t.Parallel()
+
+	// large enough to be streamed from the connection
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("fasthttp", streamResponseBodyThreshold)))
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_conns_per_host: 1});
+		var req = new fasthttp.Request("`+srv.URL+`", {response_type: "none"});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var first = client.get(req);
+		var second = client.get(req);
+		first.status === 200 && first.body === null && second.status === 200 && second.body === null;
+	`)
+	require.NoError(t, err)
+	require.True(t, res.ToBoolean())
+
+	// the discarded body leaves the connection to be reused
+	newConns := sampleValues(samples, fasthttpmetrics.HTTPReqNewConnName)
+	require.Equal(t, []float64{1, 0}, newConns)
+}
+
+func TestWaitForStatus(t *testing.T) {
+	t.Parallel()
+
+	var polls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo" {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte(r.Method + ":" + string(body)))
+			return
+		}
+		if r.URL.Path == "/down" || polls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.waitForStatus(req, 200, 1000, 10), client.waitForStatus("` + srv.URL + `/down", 200, 50, 10)].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "true,false", res.String())
+	require.EqualValues(t, 3, polls.Load())
+	require.Empty(t, metrics.GetBufferedSamples(samples))
+
+	// the polls' GET requests are pooled, while the next send has its own method and body
+	res, err = runtime.VU.Runtime().RunString(`
+		var posted = new fasthttp.Request("` + srv.URL + `/echo", {body: "payload"});
+		client.waitForStatus(posted, 200, 1000, 10);
+		client.post(posted).body;
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "POST:payload", res.String())
+}
+
+func TestMaxIdleConnDuration(t *testing.T) {
+	t.Parallel()
+
+	handler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewServer(handler)
+	defer h1.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var h1Client = new fasthttp.Client({max_idle_conn_duration: 1});
+		var h2Client = new fasthttp.Client({max_idle_conn_duration: 1, http2: true, tls_config: {insecure_skip_verify: true}});
+		var h1Req = new fasthttp.Request("`+h1.URL+`");
+		var h2Req = new fasthttp.Request("`+h2.URL+`");
+	`)
+
+	// the connections are closed while idle so the second requests dial new ones
+	for i := 0; i < 2; i++ {
+		_, err := runtime.VU.Runtime().RunString(`h1Client.get(h1Req); h2Client.get(h2Req);`)
+		require.NoError(t, err)
+		if i == 0 {
+			time.Sleep(2500 * time.Millisecond)
+		}
+	}
+
+	newConns := sampleValues(samples, fasthttpmetrics.HTTPReqNewConnName)
+	require.Equal(t, []float64{1, 1, 1, 1}, newConns)
+}
+
+func TestWarmup(t *testing.T) {
+	t.Parallel()
+
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			// hold the connections open so every warmup request dials its own
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_conns_per_host: 3});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		client.warmup(req, 5);
+	`)
+	require.EqualValues(t, 3, conns.Load())
+
+	_, err := runtime.VU.Runtime().RunString(`client.get(req); client.get(req);`)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, conns.Load())
+
+	// the connections were dialed by the warmup so the requests reuse them
+	newConns := sampleValues(samples, fasthttpmetrics.HTTPReqNewConnName)
+	require.Equal(t, []float64{0, 0}, newConns)
+
+	for _, count := range []string{"0", "-1"} {
+		_, err = runtime.VU.Runtime().RunString(`client.warmup(req, ` + count + `)`)
+		require.ErrorContains(t, err, "warmup count must be at least 1, got "+count)
+	}
+	require.EqualValues(t, 3, conns.Load())
+}
+
+func TestCloseConnections(t *testing.T) {
+	t.Parallel()
+
+	var conns, closed atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			conns.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	for i, script := range []string{`client.get(req); client.get(req);`, `client.closeIdle(); client.get(req);`, `client.close(); client.get(req);`} {
+		_, err := runtime.VU.Runtime().RunString(script)
+		require.NoError(t, err)
+		require.EqualValues(t, i+1, conns.Load())
+		require.Eventually(t, func() bool { return closed.Load() == int32(i) }, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestReleaseResponse(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-Reply", "1")
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(req);
+		res.release();
+		res;
+	`)
+	require.NoError(t, err)
+	resp, ok := res.Export().(*Response)
+	require.True(t, ok)
+	require.Zero(t, resp.Status)
+	require.Nil(t, resp.Body)
+	require.Nil(t, resp.Headers)
+	require.Empty(t, resp.headers)
+
+	// its methods throw rather than reading parts which are gone
+	for _, method := range []string{"json()", "html()", `extract("b")`, "graphqlErrors()", "revalidate()", "clone()", `hash("sha256")`} {
+		_, err = runtime.VU.Runtime().RunString(`res.` + method)
+		require.ErrorContains(t, err, "response already released", method)
+	}
+
+	// a released response's parts are handed out again with nothing left over from their last use
+	res, err = runtime.VU.Runtime().RunString(`client.get(req).headers["X-Reply"] + ":" + client.get(req).body`)
+	require.NoError(t, err)
+	require.Equal(t, "1:body", res.String())
+
+	// a reference kept to a released response stays empty once its parts are reused, and can't
+	// release them from under the response now using them
+	res, err = runtime.VU.Runtime().RunString(`
+		var stale = client.get(req);
+		stale.release();
+		var current = client.get(req);
+		[stale.status, Object.keys(stale.headers || {}).length, current.status, current.headers["X-Reply"]].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "0,0,200,1", res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`stale.release()`)
+	require.ErrorContains(t, err, "response already released")
+	res, err = runtime.VU.Runtime().RunString(`current.body`)
+	require.NoError(t, err)
+	require.Equal(t, "body", res.String())
+}
+
+// not parallel as allocations can't be counted alongside other tests
+func TestReleaseResponseAllocs(t *testing.T) {
+	// only the Response and k6's response are allocated, releasing them allocating nothing
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = acquireResponse(nil).Release()
+	})
+	require.LessOrEqual(t, allocs, 2.0)
+}
+
+func TestCloneResponse(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var first = new fasthttp.Request("`+srv.URL+`/first", {response_type: "binary"});
+		var second = new fasthttp.Request("`+srv.URL+`/second", {response_type: "binary"});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.get(first);
+		var clone = res.clone();
+		res.release();
+		client.get(second);
+		clone.status + ":" + clone.headers["X-Path"] + ":" + String.fromCharCode(...new Uint8Array(clone.body));
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "200:/first:/first", res.String())
+}
+
+func TestDecodeCharset(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sjis":
+			w.Header().Set("Content-Type", "text/plain; charset=Shift_JIS")
+			// こんにちは
+			_, _ = w.Write([]byte{0x82, 0xb1, 0x82, 0xf1, 0x82, 0xc9, 0x82, 0xbf, 0x82, 0xcd})
+		case "/unknown":
+			w.Header().Set("Content-Type", "text/plain; charset=klingon")
+			_, _ = w.Write([]byte("qapla'"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("caf\xe9"))
+		}
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var sjis = new fasthttp.Request("`+srv.URL+`/sjis");
+		var latin1 = new fasthttp.Request("`+srv.URL+`/latin1", {charset: "ISO-8859-1"});
+		var unknown = new fasthttp.Request("`+srv.URL+`/unknown");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var raw = client.get(unknown).body;
+		client.get(sjis).body + "|" + client.get(latin1).body + "|" + (raw instanceof ArrayBuffer) + ":" + raw.byteLength;
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "こんにちは|café|true:6", res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`new fasthttp.Request("` + srv.URL + `", {charset: "klingon"})`)
+	require.ErrorContains(t, err, `unknown charset "klingon"`)
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	// the limit is shared by the same client of every VU
+	root := New()
+	initScript := `
+		var client = new fasthttp.Client({rate_limit: 20});
+		var req = new fasthttp.Request("` + srv.URL + `");
+	`
+	first, samples := newVUTestRuntime(t, root, initScript)
+	second, _ := newVUTestRuntime(t, root, initScript)
+
+	start := time.Now()
+	for _, runtime := range []*modulestest.Runtime{first, second, first, second, first} {
+		_, err := runtime.VU.Runtime().RunString(`client.get(req)`)
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 4*50*time.Millisecond)
+
+	blocked := sampleValues(samples, metrics.HTTPReqBlockedName)
+	require.Len(t, blocked, 3)
+	require.Greater(t, blocked[1], 0.0)
+}
+
+func TestRateLimitName(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	// named clients are shared whatever the order they're created in, without shifting unnamed ones
+	root := New()
+	first, _ := newVUTestRuntime(t, root, `
+		var api = new fasthttp.Client({name: "api", rate_limit: 20});
+		var plain = new fasthttp.Client({rate_limit: 20});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+	second, _ := newVUTestRuntime(t, root, `
+		var plain = new fasthttp.Client({rate_limit: 20});
+		var api = new fasthttp.Client({name: "api", rate_limit: 20});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	start := time.Now()
+	for _, client := range []string{"api", "plain"} {
+		for _, runtime := range []*modulestest.Runtime{first, second, first, second} {
+			_, err := runtime.VU.Runtime().RunString(client + `.get(req)`)
+			require.NoError(t, err)
+		}
+	}
+	require.GreaterOrEqual(t, time.Since(start), 6*50*time.Millisecond)
+}
+
+func TestRateLimitConflict(t *testing.T) {
+	t.Parallel()
+
+	// clients sharing a limit can't set another one, named or not
+	root := New()
+	_, _ = newVUTestRuntime(t, root, `
+		var api = new fasthttp.Client({name: "api", rate_limit: 20});
+		var plain = new fasthttp.Client({rate_limit: 20});
+		var unlimited = new fasthttp.Client({});
+	`)
+	runtime, _ := newVUTestRuntime(t, root, `
+		var errors = [];
+		for (const config of [{name: "api", rate_limit: 10}, {}, {rate_limit: 5}, {name: "api", rate_limit: 20}]) {
+			try {
+				new fasthttp.Client(config);
+			} catch (e) {
+				errors.push(e.toString());
+			}
+		}
+	`)
+
+	require.Equal(t, []interface{}{
+		`GoError: client "api" was already created with rate_limit 20, not 10`,
+		"GoError: client #1 of the init code was already created with rate_limit 20, not 0",
+		"GoError: client #2 of the init code was already created with rate_limit 0, not 5",
+	}, runtime.VU.Runtime().Get("errors").Export())
+}
+
+func TestRequestName(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`/users/123", {name: "/users/{id}"});
+	`)
+
+	_, err := runtime.VU.Runtime().RunString(`client.get(req)`)
+	require.NoError(t, err)
+
+	containers := metrics.GetBufferedSamples(samples)
+	require.NotEmpty(t, containers)
+	for _, sample := range containers[0].GetSamples() {
+		name, _ := sample.Tags.Get("name")
+		url, _ := sample.Tags.Get("url")
+		require.Equal(t, "/users/{id}", name)
+		require.Equal(t, "/users/{id}", url)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {throw: true});
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var error;
+		var pending = client.getAsync(req).catch((e) => { error = e.toString(); });
+		req.cancel();
+	`)
+	require.NoError(t, err)
+	require.Contains(t, runtime.VU.Runtime().Get("error").String(), "context canceled")
+
+	containers := metrics.GetBufferedSamples(samples)
+	require.NotEmpty(t, containers)
+	errorCode, _ := containers[0].GetSamples()[0].Tags.Get("error_code")
+	require.Equal(t, "1051", errorCode)
+}
+
+func TestCancelRequestClosesConn(t *testing.T) {
+	t.Parallel()
+
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2.0"} {
+		t.Run(proto, func(t *testing.T) {
+			t.Parallel()
+
+			// slow requests are only answered once the client has closed their connection or stream,
+			// the ready one once they've both arrived
+			arrived := make(chan struct{}, 2)
+			closed := make(chan string, 2)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				switch r.URL.Path {
+				case "/sent":
+					_, _ = fmt.Fprintf(w, "%s:%s:%s", r.Method, r.Header.Get("Content-Length"), body)
+					return
+				case "/ready":
+					<-arrived
+					<-arrived
+					return
+				}
+				arrived <- struct{}{}
+				<-r.Context().Done()
+				closed <- fmt.Sprintf("%s %s:%s", r.Proto, r.Method, body)
+			}))
+			srv.EnableHTTP2 = proto == "HTTP/2.0"
+			srv.StartTLS()
+			defer srv.Close()
+
+			runtime, _ := newClientTestRuntime(t, `
+				var client = new fasthttp.Client({http2: `+strconv.FormatBool(srv.EnableHTTP2)+`, tls_config: {insecure_skip_verify: true}});
+				var get = new fasthttp.Request("`+srv.URL+`/slow");
+				var post = new fasthttp.Request("`+srv.URL+`/slow", {body: "payload"});
+				var sentGet = new fasthttp.Request("`+srv.URL+`/sent");
+				var sentPost = new fasthttp.Request("`+srv.URL+`/sent", {body: "payload"});
+				var ready = new fasthttp.Request("`+srv.URL+`/ready");
+			`)
+
+			_, err := runtime.RunOnEventLoop(`
+				client.getAsync(get);
+				client.postAsync(post);
+				client.getAsync(ready).then(() => { get.cancel(); post.cancel(); });
+			`)
+			require.NoError(t, err)
+
+			var requests []string
+			for len(requests) < 2 {
+				select {
+				case r := <-closed:
+					requests = append(requests, r)
+				case <-time.After(time.Second):
+					t.Fatal("requests weren't interrupted once cancelled")
+				}
+			}
+			require.ElementsMatch(t, []string{proto + " GET:", proto + " POST:payload"}, requests)
+
+			// bodies are sent as they were, the client going on with the requests sent next
+			_, err = runtime.RunOnEventLoop(`
+				var bodies;
+				Promise.all([client.getAsync(sentGet), client.postAsync(sentPost)]).then((res) => {
+					bodies = res.map((r) => r.body).join(",");
+				});
+			`)
+			require.NoError(t, err)
+			require.Equal(t, "GET::,POST:7:payload", runtime.VU.Runtime().Get("bodies").String())
+		})
+	}
+}
+
+func TestExpectedStatusErrorCodes(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		client.setResponseCallback(fasthttp.expectedStatuses({min: 200, max: 299}, 404));
+		var notFound = new fasthttp.Request("`+srv.URL+`/404");
+		var unavailable = new fasthttp.Request("`+srv.URL+`/503");
+	`)
+
+	_, err := runtime.VU.Runtime().RunString(`client.get(notFound); client.get(unavailable);`)
+	require.NoError(t, err)
+
+	errorCodes := map[string]string{}
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName) {
+		status, _ := sample.Tags.Get("status")
+		errorCodes[status], _ = sample.Tags.Get("error_code")
+	}
+	require.Equal(t, map[string]string{"404": "", "503": "1503"}, errorCodes)
+}
+
+func TestErrorClassifier(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		client.setErrorClassifier((status, code) => {
+			if (status === 429) return 9429;
+			if (status === 404) return 0;
+			if (status === 503 && code === 1503) return 9503;
+			if (status === 0) return 9000;
+		});
+		var tooMany = new fasthttp.Request("`+srv.URL+`/429");
+		var notFound = new fasthttp.Request("`+srv.URL+`/404");
+		var unavailable = new fasthttp.Request("`+srv.URL+`/503");
+		var refused = new fasthttp.Request("http://127.0.0.1:1");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var failed;
+		client.get(tooMany);
+		client.get(notFound);
+		// classified on the event loop though sent off it
+		client.getAsync(unavailable);
+		client.stream(tooMany, () => true);
+		failed = client.get(refused).error_code;
+	`)
+	require.NoError(t, err)
+	require.Equal(t, int64(9000), runtime.VU.Runtime().Get("failed").ToInteger())
+
+	errorCodes := map[string]string{}
+	for _, sample := range samplesNamed(samples, metrics.HTTPReqsName) {
+		status, _ := sample.Tags.Get("status")
+		errorCodes[status], _ = sample.Tags.Get("error_code")
+	}
+	require.Equal(t, map[string]string{"429": "9429", "404": "", "503": "9503", "0": "9000"}, errorCodes)
+
+	_, err = runtime.VU.Runtime().RunString(`client.setErrorClassifier("nope")`)
+	require.ErrorContains(t, err, "expects a function or null")
+}
+
+func TestResponseTrailers(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		if r.URL.Path == "/large" {
+			// streamed from the connection rather than read by fasthttp
+			_, _ = w.Write([]byte(strings.Repeat("a", 2*streamResponseBodyThreshold)))
+		} else {
+			_, _ = w.Write([]byte("a"))
+		}
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "13")
+		w.Header().Set("Grpc-Message", "internal")
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var small = new fasthttp.Request("`+srv.URL+`/small");
+		var large = new fasthttp.Request("`+srv.URL+`/large");
+	`)
+
+	for _, req := range []string{"small", "large"} {
+		res, err := runtime.VU.Runtime().RunString(`
+			var res = client.get(` + req + `);
+			[res.status, res.trailers["Grpc-Status"], res.trailers["Grpc-Message"], res.headers["Grpc-Status"]].join("|");
+		`)
+		require.NoError(t, err)
+		require.Equal(t, "200|13|internal|", res.String(), req)
+	}
+}
+
+func TestLargeResponseHeaders(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Set-Cookie", "jwt="+strings.Repeat("a", 10*1024))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var small = new fasthttp.Client({read_buffer_size: 4096});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(req).status`)
+	require.NoError(t, err)
+	require.EqualValues(t, 200, res.Export())
+
+	res, err = runtime.VU.Runtime().RunString(`small.get(req)`)
+	require.NoError(t, err)
+	resp, ok := res.Export().(*Response)
+	require.True(t, ok)
+	require.Equal(t, 1703, resp.ErrorCode)
+	require.Contains(t, resp.Error, "increase read_buffer_size")
+
+	// requests sent over connections of their own are read with the same buffer
+	res, err = runtime.VU.Runtime().RunString(`
+		var target = new fasthttp.Request("` + srv.URL + `", {request_target: "/"});
+		[client.get(target).status, small.get(target).error_code].join(",");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "200,1703", res.String())
+}
+
+func TestTransportErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	// closed straight away so the port refuses connections
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`");
+		var throwing = new fasthttp.Request("`+srv.URL+`", {throw: true});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(req)`)
+	require.NoError(t, err)
+	resp, ok := res.Export().(*Response)
+	require.True(t, ok)
+	require.Zero(t, resp.Status)
+	require.Equal(t, 1212, resp.ErrorCode)
+	require.Equal(t, "dial: connection refused", resp.Error)
+
+	_, err = runtime.VU.Runtime().RunString(`client.get(throwing)`)
+	require.Error(t, err)
+}
+
+func TestDeadline(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({max_idemponent_call_attempts: 1});
+		var req = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	_, err := runtime.RunOnEventLoop(`
+		var codes = [];
+		req.deadline = new Date(Date.now() + 100);
+		codes.push(client.get(req).error_code);
+		req.deadline = Date.now() - 1;
+		codes.push(client.get(req).error_code);
+		req.deadline = Date.now() + 5000;
+		codes.push(client.get(req).error_code);
+		req.deadline = Date.now() + 100;
+		client.getAsync(req).then((res) => { codes.push(res.error_code); });
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "1050,1050,0,1050", runtime.VU.Runtime().Get("codes").String())
+}
+
+func TestTimeoutErrors(t *testing.T) {
+	t.Parallel()
+
+	// answers once the read timeout has passed
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		_, _ = w.Write([]byte("late"))
+	}))
+	defer slow.Close()
+
+	// accepts connections but never reads requests, its small receive buffer soon filled
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*net.TCPConn).SetReadBuffer(1024)
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({read_timeout: 1, write_timeout: 1, max_idemponent_call_attempts: 1});
+		var read = new fasthttp.Request("`+slow.URL+`");
+		// large enough to fill the client's send buffer, of at most 4MB by default on Linux
+		var write = new fasthttp.Request("http://`+ln.Addr().String()+`", {body: "a".repeat(4 * 1024 * 1024)});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.get(read), client.post(write)].map((r) => r.error_code + ":" + r.error).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, "1230:read: timeout waiting for the response|1231:write: timeout sending the request", res.String())
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		_, _ = w.Write([]byte("report"))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({read_timeout: 1, max_idemponent_call_attempts: 1});
+		var fast = new fasthttp.Request("`+srv.URL+`");
+		var slow = new fasthttp.Request("`+srv.URL+`", {read_timeout: 3});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.get(fast).error_code, client.get(slow).body, client.get(fast).error_code].join(",");
+	`)
+	require.NoError(t, err)
+	// the slow endpoint's timeout doesn't change the client's
+	require.Equal(t, "1230,report,1230", res.String())
+}
+
+func TestRequestTimeoutsLimit(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var reqs = [1, 2, 3, 4, 5, 6, 7, 8, 9].map((i) => new fasthttp.Request("`+srv.URL+`", {read_timeout: i}));
+	`)
+
+	// each combination of timeouts pools connections of its own, so only so many are allowed
+	res, err := runtime.VU.Runtime().RunString(`reqs.slice(0, 8).map((req) => client.get(req).body).join(",")`)
+	require.NoError(t, err)
+	require.Equal(t, "ok,ok,ok,ok,ok,ok,ok,ok", res.String())
+
+	_, err = runtime.VU.Runtime().RunString(`client.get(reqs[8])`)
+	require.ErrorContains(t, err, "at most 8 combinations of read_timeout, write_timeout and insecure_skip_verify")
+	_, err = runtime.RunOnEventLoop(`var rejected; client.getAsync(reqs[8]).catch((e) => { rejected = String(e); });`)
+	require.NoError(t, err)
+	require.Contains(t, runtime.VU.Runtime().Get("rejected").String(), "at most 8 combinations")
+
+	res, err = runtime.VU.Runtime().RunString(`client.get(reqs[0]).body`)
+	require.NoError(t, err)
+	require.Equal(t, "ok", res.String())
+}
+
+func TestRequestTarget(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %s %s %s", r.Method, r.RequestURI, r.Host, body)
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var asterisk = new fasthttp.Request("`+srv.URL+`", {request_target: "*"});
+		var absolute = new fasthttp.Request("`+srv.URL+`", {request_target: "http://example.com/absolute?q=1", body: "data"});
+	`)
+
+	// net/http answers OPTIONS * itself, so the target is sent with another method
+	res, err := runtime.VU.Runtime().RunString(`[client.get(asterisk).body, client.post(absolute).body].join("|")`)
+	require.NoError(t, err)
+	require.Equal(t, "GET * "+host+" |POST http://example.com/absolute?q=1 example.com data", res.String())
+}
+
+func TestRequestTargetOverrides(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		_, _ = w.Write([]byte(r.RequestURI))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var verified = new fasthttp.Request("`+srv.URL+`", {request_target: "/verified"});
+		var skipped = new fasthttp.Request("`+srv.URL+`", {request_target: "/skipped", insecure_skip_verify: true});
+		var slow = new fasthttp.Request("`+srv.URL+`", {request_target: "/slow", insecure_skip_verify: true, read_timeout: 1});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`[client.get(verified).error_code > 0, client.get(skipped).body].join("|")`)
+	require.NoError(t, err)
+	require.Equal(t, "true|/skipped", res.String())
+
+	start := time.Now()
+	res, err = runtime.VU.Runtime().RunString(`client.get(slow).error`)
+	require.NoError(t, err)
+	require.NotEmpty(t, res.String())
+	require.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestExpectContinue(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %d", r.Header.Get("Expect"), len(body))
+	}))
+	defer srv.Close()
+
+	// rejects the request on its headers, counting what's sent after them until the client hangs up
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	bodySent := make(chan int64, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		r := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(r); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		n, _ := io.Copy(io.Discard, r)
+		bodySent <- n
+	}()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var body = "x".repeat(1 << 20);
+		var accept = new fasthttp.Request("`+srv.URL+`", {expect_continue: true, body: new fasthttp.FileStream(new ArrayBuffer(1 << 20))});
+		var reject = new fasthttp.Request("http://`+ln.Addr().String()+`", {expect_continue: true, body: body});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`[client.post(accept).body, client.post(reject).status].join("|")`)
+	require.NoError(t, err)
+	require.Equal(t, "100-continue 1048576|413", res.String())
+	require.Zero(t, <-bodySent)
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	// the accept key of the handshake example in RFC 6455 1.3
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", webSocketAccept([]byte("dGhlIHNhbXBsZSBub25jZQ==")))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		accept := webSocketAccept([]byte(r.Header.Get("Sec-WebSocket-Key")))
+		if r.URL.Path == "/bad" {
+			accept = "bad"
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+		_ = rw.Flush()
+		// held open until the client closes it
+		_, _ = io.Copy(io.Discard, conn)
+	}))
+	defer srv.Close()
+
+	wsURL := strings.Replace(srv.URL, "http://", "ws://", 1)
+	runtime, samples := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({read_timeout: 5});
+		var ok = new fasthttp.Request("`+wsURL+`");
+		var bad = new fasthttp.Request("`+wsURL+`/bad");
+		var plain = new fasthttp.Request("`+srv.URL+`");
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		var res = client.upgrade(ok);
+		[res.status, res.headers["Upgrade"], client.upgrade(bad).error, client.get(plain).status].join(",");
+	`)
+	require.NoError(t, err)
+	// the handshake's headers aren't sent by later requests
+	require.Equal(t, "101,websocket,"+errInvalidWebSocketAccept.Error()+",400", res.String())
+
+	require.Len(t, samplesNamed(samples, metrics.HTTPReqsName), 3)
+}
+
+func TestInternationalizedHosts(t *testing.T) {
+	t.Parallel()
+
+	for url, expected := range map[string]string{
+		"https://例え.jp/パス?q=値":                "https://xn--r8jz45g.jp/パス?q=値",
+		"http://user:p@ss@例え.jp:8080":         "http://user:p@ss@xn--r8jz45g.jp:8080",
+		"https://%E4%BE%8B%E3%81%88.jp/a%20b": "https://xn--r8jz45g.jp/a%20b",
+		"http://[fe80::1%25eth0]:8080/":       "http://[fe80::1%25eth0]:8080/",
+		"http://localhost:8080/%E4%BE%8B":     "http://localhost:8080/%E4%BE%8B",
+	} {
+		converted, err := asciiURL(url)
+		require.NoError(t, err)
+		require.Equal(t, expected, converted, url)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var req = new fasthttp.Request("`+srv.URL+`", {host: "例え.jp:8080"});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`client.get(req).body`)
+	require.NoError(t, err)
+	require.Equal(t, "xn--r8jz45g.jp:8080", res.String())
+}
+
+func TestBodyCutShort(t *testing.T) {
+	t.Parallel()
+
+	// declares twice the length of the body it sends before closing the connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				size := 100
+				if strings.Contains(line, "/large") {
+					// streamed rather than buffered by fasthttp
+					size = 256 * 1024
+				}
+				_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", size, strings.Repeat("a", size/2))
+			}()
+		}
+	}()
+
+	runtime, _ := newClientTestRuntime(t, `
+		var client = new fasthttp.Client({});
+		var small = new fasthttp.Request("http://`+ln.Addr().String()+`/");
+		var large = new fasthttp.Request("http://`+ln.Addr().String()+`/large");
+		var discarded = new fasthttp.Request("http://`+ln.Addr().String()+`/large", {response_type: "none"});
+	`)
+
+	res, err := runtime.VU.Runtime().RunString(`
+		[client.get(small), client.get(large), client.get(discarded)].map((r) => r.error_code + ":" + r.error).join("|");
+	`)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("1704:response body cut short|", 2)+"1704:response body cut short", res.String())
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package fasthttp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	keepAlive := func(tcpKeepAlive *int) int {
+		dial, err := newRawDialFunc(ClientConfig{TCPKeepAlive: tcpKeepAlive}, time.Second)
+		require.NoError(t, err)
+		conn, err := dial(ln.Addr().String())
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		require.NoError(t, err)
+		var opt int
+		require.NoError(t, raw.Control(func(fd uintptr) {
+			opt, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		}))
+		require.NoError(t, err)
+		return opt
+	}
+
+	disabled, enabled := 0, 30
+	require.NotZero(t, keepAlive(nil))
+	require.Zero(t, keepAlive(&disabled))
+	require.NotZero(t, keepAlive(&enabled))
+}
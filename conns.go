@@ -0,0 +1,74 @@
+package fasthttp
+
+import (
+	"net"
+	"sync"
+
+	http "github.com/valyala/fasthttp"
+)
+
+// openConns is the set of connections dialed by a client which haven't been closed yet, so they can
+// be closed whether idle or busy
+type openConns struct {
+	lock  *sync.Mutex
+	conns map[*openConn]struct{}
+}
+
+func newOpenConns() *openConns {
+	return &openConns{lock: &sync.Mutex{}, conns: make(map[*openConn]struct{})}
+}
+
+// dialFunc returns dial with every connection it establishes added to the set until it's closed
+func (o *openConns) dialFunc(dial http.DialFunc) http.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &openConn{Conn: conn, conns: o}
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		o.conns[c] = struct{}{}
+		return c, nil
+	}
+}
+
+// count returns the number of open connections
+func (o *openConns) count() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.conns)
+}
+
+// closeAll closes every open connection, requests in flight on them failing
+func (o *openConns) closeAll() {
+	o.lock.Lock()
+	conns := make([]*openConn, 0, len(o.conns))
+	for c := range o.conns {
+		conns = append(conns, c)
+	}
+	o.lock.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+type openConn struct {
+	net.Conn
+	conns *openConns
+}
+
+// Close implements the net.Conn interface
+func (c *openConn) Close() error {
+	c.conns.lock.Lock()
+	delete(c.conns.conns, c)
+	c.conns.lock.Unlock()
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection
+func (c *openConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,35 @@
+package fasthttp
+
+import (
+	"bytes"
+
+	"github.com/sirupsen/logrus"
+	http "github.com/valyala/fasthttp"
+)
+
+// logDump logs req and resp as they went on the wire for the client's debug option. body is the
+// response body as read, which isn't kept in resp. resp is nil when the request failed.
+func logDump(logger logrus.FieldLogger, req *http.Request, resp *http.Response, body interface{}) {
+	var dump bytes.Buffer
+	dump.Write(req.Header.Header())
+	if req.IsBodyStream() {
+		dump.WriteString("[streamed body]")
+	} else {
+		dump.Write(req.Body())
+	}
+	logger.Infof("Request:\n%s\n", dump.Bytes())
+
+	if resp == nil {
+		return
+	}
+
+	dump.Reset()
+	dump.Write(resp.Header.Header())
+	switch b := body.(type) {
+	case string:
+		dump.WriteString(b)
+	case []byte:
+		dump.Write(b)
+	}
+	logger.Infof("Response:\n%s\n", dump.Bytes())
+}
@@ -0,0 +1,93 @@
+package fasthttp
+
+import (
+	"os"
+
+	"github.com/grafana/sobek"
+	http "github.com/valyala/fasthttp"
+)
+
+// defaultDownloadHash is the algorithm downloads are hashed with unless another is given
+const defaultDownloadHash = "sha256"
+
+// DownloadResult is what's left of a download once its body is on disk
+type DownloadResult struct {
+	// Path is the file the body was saved to, empty when the temporary file was removed as the
+	// download failed
+	Path string
+	// Size is the number of bytes of the body saved
+	Size int
+	// Hash is the hex digest of the body, empty when the download failed
+	Hash   string
+	Status int
+	// Duration is the request's duration in milliseconds
+	Duration float64
+	// Error and ErrorCode are those of the response when the download failed
+	Error     string
+	ErrorCode int
+}
+
+// Download GETs r, a Request or a URL, saving the body to destPath, or a new temporary file when
+// it's empty, and hashing it with algo, sha256 by default, as it's read so it's never held in
+// memory. Its options are those of save_to_file and hash on the Request, which is otherwise sent as
+// it is, and its metrics are emitted as for any other request. A temporary file is removed when the
+// download fails.
+func (c *Client) Download(r sobek.Value, destPath string, algo ...string) (*DownloadResult, error) {
+	reqw, err := requestOrURL(r)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := defaultDownloadHash
+	if len(algo) > 0 && algo[0] != "" {
+		hash = algo[0]
+	}
+	if _, err := newDigest(hash); err != nil {
+		return nil, err
+	}
+
+	// whether the temporary file is removed, kept once the download succeeded
+	var removeTemp bool
+	if destPath == "" {
+		f, err := os.CreateTemp("", "xk6-fasthttp-download-*")
+		if err != nil {
+			return nil, err
+		}
+		destPath = f.Name()
+		removeTemp = true
+		defer func(path string) {
+			if removeTemp {
+				_ = os.Remove(path)
+			}
+		}(destPath)
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the Request's own save_to_file and hash are left as they are
+	download := reqw.copy()
+	download.SaveToFile = destPath
+	download.Hash = hash
+
+	resp, err := c.makeReq(download, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Release() }()
+
+	// the temporary file is only kept once the download succeeded
+	removeTemp = removeTemp && resp.Error != ""
+	if removeTemp {
+		destPath = ""
+	}
+	return &DownloadResult{
+		Path:      destPath,
+		Size:      resp.BodySize,
+		Hash:      resp.digest,
+		Status:    resp.Status,
+		Duration:  resp.Timings.Duration,
+		Error:     resp.Error,
+		ErrorCode: resp.ErrorCode,
+	}, nil
+}
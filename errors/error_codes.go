@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"runtime"
 	"syscall"
 
+	"github.com/valyala/fasthttp"
 	"golang.org/x/net/http2"
 
 	"go.k6.io/k6/lib/netext"
@@ -27,7 +29,12 @@ const (
 	defaultErrorCode          ErrCode = 1000
 	defaultNetNonTCPErrorCode ErrCode = 1010
 	invalidURLErrorCode       ErrCode = 1020
+	tooManyRedirectsErrorCode ErrCode = 1030
 	requestTimeoutErrorCode   ErrCode = 1050
+	requestCancelledErrorCode ErrCode = 1051
+	// fasthttp client errors
+	connPoolExhaustedErrorCode ErrCode = 1060
+	pipelineOverflowErrorCode  ErrCode = 1061
 	// DNS errors
 	defaultDNSErrorCode      ErrCode = 1100
 	dnsNoSuchHostErrorCode   ErrCode = 1101
@@ -42,9 +49,13 @@ const (
 	tcpDialRefusedErrorCode  ErrCode = 1212
 	tcpDialUnknownErrnoCode  ErrCode = 1213
 	tcpResetByPeerErrorCode  ErrCode = 1220
+	tcpConnClosedErrorCode   ErrCode = 1221
+	tcpReadTimeoutErrorCode  ErrCode = 1230
+	tcpWriteTimeoutErrorCode ErrCode = 1231
 	// TLS errors
 	defaultTLSErrorCode           ErrCode = 1300 //nolint:deadcode,varcheck // this is here to save the number
 	tlsHeaderErrorCode            ErrCode = 1301
+	tlsHandshakeTimeoutErrorCode  ErrCode = 1302
 	x509UnknownAuthorityErrorCode ErrCode = 1310
 	x509HostnameErrorCode         ErrCode = 1311
 
@@ -64,12 +75,17 @@ const (
 
 	// Custom k6 content errors, i.e. when the magic fails
 	// defaultContentError ErrCode = 1700 // reserved for future use
-	responseDecompressionErrorCode ErrCode = 1701
+	responseDecompressionErrorCode  ErrCode = 1701
+	responseBodyTooLargeErrorCode   ErrCode = 1702
+	responseHeaderTooLargeErrorCode ErrCode = 1703
+	responseBodyCutShortErrorCode   ErrCode = 1704
 )
 
 const (
 	tcpResetByPeerErrorCodeMsg  = "%s: connection reset by peer"
 	tcpDialTimeoutErrorCodeMsg  = "dial: i/o timeout"
+	tcpReadTimeoutErrorCodeMsg  = "read: timeout waiting for the response"
+	tcpWriteTimeoutErrorCodeMsg = "write: timeout sending the request"
 	tcpDialRefusedErrorCodeMsg  = "dial: connection refused"
 	tcpBrokenPipeErrorCodeMsg   = "%s: broken pipe"
 	netUnknownErrnoErrorCodeMsg = "%s: unknown errno `%d` on %s with message `%s`"
@@ -82,9 +98,22 @@ const (
 	x509HostnameErrorCodeMsg    = "x509: certificate doesn't match hostname"
 	x509UnknownAuthority        = "x509: unknown authority"
 	requestTimeoutErrorCodeMsg  = "request timeout"
+	requestCancelledMsg         = "request cancelled"
 	invalidURLErrorCodeMsg      = "invalid URL"
+	responseBodyTooLargeMsg     = "response body too large"
+	tooManyRedirectsMsg         = "too many redirects"
+	responseHeaderTooLargeMsg   = "response headers larger than read_buffer_size, increase read_buffer_size"
+	connPoolExhaustedMsg        = "connection pool exhausted"
+	pipelineOverflowMsg         = "pipeline queue overflowed"
+	tcpConnClosedMsg            = "connection closed by server"
+	tlsHandshakeTimeoutMsg      = "tls: handshake timeout"
+	responseBodyCutShortMsg     = "response body cut short"
 )
 
+// ErrBodyCutShort is wrapped by the errors of response bodies which ended before their
+// Content-Length or last chunk, told apart from other unexpected EOFs by their error code
+var ErrBodyCutShort = errors.New(responseBodyCutShortMsg)
+
 func http2ErrCodeOffset(code http2.ErrCode) ErrCode {
 	if code > http2.ErrCodeHTTP11Required {
 		return 0
@@ -98,10 +127,22 @@ func errorCodeForNetOpError(err *net.OpError) (ErrCode, string) {
 	// we should even check for *os.SyscallError in the main switch body in the
 	// parent errorCodeForError() function?
 
-	if err.Net != "tcp" && err.Net != "tcp6" {
+	// fasthttp dials tcp4 unless DialDualStack is set
+	if err.Net != "tcp" && err.Net != "tcp4" && err.Net != "tcp6" {
 		// TODO: figure out how this happens
 		return defaultNetNonTCPErrorCode, err.Error()
 	}
+	if err.Timeout() {
+		switch err.Op {
+		case "dial":
+			return tcpDialTimeoutErrorCode, tcpDialTimeoutErrorCodeMsg
+		case "read":
+			return tcpReadTimeoutErrorCode, tcpReadTimeoutErrorCodeMsg
+		case "write":
+			return tcpWriteTimeoutErrorCode, tcpWriteTimeoutErrorCodeMsg
+		}
+	}
+
 	if sErr, ok := err.Err.(*os.SyscallError); ok {
 		switch sErr.Unwrap() {
 		case syscall.ECONNRESET:
@@ -159,6 +200,18 @@ func ErrorCodeForError(err error) (ErrCode, string) {
 	// checking for the concrete error types first gives us the opportunity to
 	// also directly detect high-level errors, if we need to, even if they wrap
 	// a low level error inside.
+	if code, msg, ok := errorCodeForFasthttpError(err); ok {
+		return code, msg
+	}
+	switch {
+	case errors.Is(err, ErrBodyCutShort):
+		return responseBodyCutShortErrorCode, responseBodyCutShortMsg
+	case errors.Is(err, context.DeadlineExceeded):
+		return requestTimeoutErrorCode, requestTimeoutErrorCodeMsg
+	case errors.Is(err, context.Canceled):
+		return requestCancelledErrorCode, requestCancelledMsg
+	}
+
 	switch e := err.(type) {
 	case K6Error:
 		return e.Code, e.Message
@@ -201,6 +254,36 @@ func ErrorCodeForError(err error) (ErrCode, string) {
 	}
 }
 
+// errorCodeForFasthttpError maps the errors returned by fasthttp, most of which are plain sentinel
+// errors so can't be matched by type.
+func errorCodeForFasthttpError(err error) (ErrCode, string, bool) {
+	var smallBufferErr *fasthttp.ErrSmallBuffer
+	switch {
+	case errors.As(err, &smallBufferErr):
+		return responseHeaderTooLargeErrorCode, responseHeaderTooLargeMsg, true
+	case errors.Is(err, fasthttp.ErrBodyTooLarge):
+		return responseBodyTooLargeErrorCode, responseBodyTooLargeMsg, true
+	case errors.Is(err, fasthttp.ErrNoFreeConns):
+		return connPoolExhaustedErrorCode, connPoolExhaustedMsg, true
+	case errors.Is(err, fasthttp.ErrPipelineOverflow):
+		return pipelineOverflowErrorCode, pipelineOverflowMsg, true
+	case errors.Is(err, fasthttp.ErrConnectionClosed):
+		return tcpConnClosedErrorCode, tcpConnClosedMsg, true
+	case errors.Is(err, fasthttp.ErrTimeout):
+		// read and write timeouts are told apart by the traced connection, leaving the others such
+		// as the wait for a free connection or the pipeline's
+		return requestTimeoutErrorCode, requestTimeoutErrorCodeMsg, true
+	case errors.Is(err, fasthttp.ErrDialTimeout):
+		return tcpDialTimeoutErrorCode, tcpDialTimeoutErrorCodeMsg, true
+	case errors.Is(err, fasthttp.ErrTLSHandshakeTimeout):
+		return tlsHandshakeTimeoutErrorCode, tlsHandshakeTimeoutMsg, true
+	case errors.Is(err, fasthttp.ErrTooManyRedirects):
+		return tooManyRedirectsErrorCode, tooManyRedirectsMsg, true
+	default:
+		return 0, "", false
+	}
+}
+
 // K6Error is a helper struct that enhances Go errors with custom k6-specific
 // error-codes and more user-readable error messages.
 type K6Error struct {
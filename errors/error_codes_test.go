@@ -19,6 +19,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
 	"golang.org/x/net/http2"
 
 	"go.k6.io/k6/lib/netext"
@@ -31,6 +32,37 @@ func TestDefaultError(t *testing.T) {
 	testErrorCode(t, defaultErrorCode, fmt.Errorf("random error"))
 }
 
+func TestFasthttpErrors(t *testing.T) {
+	t.Parallel()
+	testTable := map[ErrCode]error{
+		responseBodyTooLargeErrorCode: fasthttp.ErrBodyTooLarge,
+		connPoolExhaustedErrorCode:    fasthttp.ErrNoFreeConns,
+		pipelineOverflowErrorCode:     fasthttp.ErrPipelineOverflow,
+		tcpConnClosedErrorCode:        fasthttp.ErrConnectionClosed,
+		requestTimeoutErrorCode:       fasthttp.ErrTimeout,
+		tcpDialTimeoutErrorCode:       fasthttp.ErrDialTimeout,
+		tlsHandshakeTimeoutErrorCode:  fasthttp.ErrTLSHandshakeTimeout,
+		tooManyRedirectsErrorCode:     fasthttp.ErrTooManyRedirects,
+	}
+	testMapOfErrorCodes(t, testTable)
+}
+
+func TestBodyCutShortError(t *testing.T) {
+	t.Parallel()
+	testErrorCode(t, responseBodyCutShortErrorCode, fmt.Errorf("received 1 of 2 bytes: %w", ErrBodyCutShort))
+	// only bodies are told apart, other unexpected EOFs keeping the default code
+	testErrorCode(t, defaultErrorCode, io.ErrUnexpectedEOF)
+}
+
+func TestContextErrors(t *testing.T) {
+	t.Parallel()
+	testTable := map[ErrCode]error{
+		requestTimeoutErrorCode:   context.DeadlineExceeded,
+		requestCancelledErrorCode: context.Canceled,
+	}
+	testMapOfErrorCodes(t, testTable)
+}
+
 func TestDNSErrors(t *testing.T) {
 	t.Parallel()
 	var (
@@ -86,9 +118,13 @@ func TestTCPErrors(t *testing.T) {
 		econnreset        = &net.OpError{Net: "tcp", Op: "write", Err: &os.SyscallError{Err: syscall.ECONNRESET}}
 		epipeerror        = &net.OpError{Net: "tcp", Op: "write", Err: &os.SyscallError{Err: syscall.EPIPE}}
 		econnrefused      = &net.OpError{Net: "tcp", Op: "dial", Err: &os.SyscallError{Err: syscall.ECONNREFUSED}}
+		econnrefusedTCP4  = &net.OpError{Net: "tcp4", Op: "dial", Err: &os.SyscallError{Err: syscall.ECONNREFUSED}}
 		errnounknown      = &net.OpError{Net: "tcp", Op: "dial", Err: &os.SyscallError{Err: syscall.E2BIG}}
 		tcperror          = &net.OpError{Net: "tcp", Err: errors.New("tcp error")}
 		notTimeoutedError = &net.OpError{Net: "tcp", Op: "dial", Err: timeoutError(false)}
+		dialTimeout       = &net.OpError{Net: "tcp", Op: "dial", Err: timeoutError(true)}
+		readTimeout       = &net.OpError{Net: "tcp", Op: "read", Err: timeoutError(true)}
+		writeTimeout      = &net.OpError{Net: "tcp", Op: "write", Err: timeoutError(true)}
 	)
 
 	testTable := map[ErrCode]error{
@@ -99,9 +135,13 @@ func TestTCPErrors(t *testing.T) {
 		tcpDialUnknownErrnoCode:   errnounknown,
 		defaultTCPErrorCode:       tcperror,
 		tcpDialErrorCode:          notTimeoutedError,
+		tcpDialTimeoutErrorCode:   dialTimeout,
+		tcpReadTimeoutErrorCode:   readTimeout,
+		tcpWriteTimeoutErrorCode:  writeTimeout,
 	}
 
 	testMapOfErrorCodes(t, testTable)
+	testErrorCode(t, tcpDialRefusedErrorCode, econnrefusedTCP4)
 }
 
 func testErrorCode(t *testing.T, code ErrCode, err error) {
@@ -0,0 +1,84 @@
+package fasthttp
+
+import (
+	"crypto/md5"  //nolint:gosec // used to verify content, not for security
+	"crypto/sha1" //nolint:gosec // used to verify content, not for security
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+
+	"github.com/grafana/sobek"
+	"go.k6.io/k6/js/common"
+)
+
+// newDigest returns the hash of the named algorithm, one of sha256, sha1, md5 or crc32
+func newDigest(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil //nolint:gosec // used to verify content, not for security
+	case "md5":
+		return md5.New(), nil //nolint:gosec // used to verify content, not for security
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash %q, expected sha256, sha1, md5 or crc32", algo)
+	}
+}
+
+// Hash returns the hex digest of the body with the named algorithm, one of sha256, sha1, md5 or
+// crc32. Bodies the request's hash option digested as they were read are returned without being
+// hashed again, which is the only way to hash bodies which weren't kept such as those saved to
+// file. That digest is of the bytes received, whole even when truncate_body cut the body short and
+// before any charset decoding, while other bodies are hashed as they're returned, truncated and,
+// for text, encoded as UTF-8.
+func (res *Response) Hash(algo string) (string, error) {
+	if res.released {
+		return "", errResponseReleased
+	}
+	if res.digest != "" && strings.EqualFold(algo, res.digestAlgo) {
+		return res.digest, nil
+	}
+	if res.Body == nil {
+		return "", fmt.Errorf("no body to hash, set the request's hash to %q to hash it as it's read", algo)
+	}
+
+	digest, err := newDigest(algo)
+	if err != nil {
+		return "", err
+	}
+	body, err := common.ToBytes(res.Body)
+	if err != nil {
+		return "", err
+	}
+	digest.Write(body)
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// CheckHash checks the hex digest of the response body with the named algorithm equals expected,
+// compared case-insensitively
+func (mi *ModuleInstance) CheckHash(r *sobek.Object, algo, expected string, extras ...sobek.Value) (bool, error) {
+	resp, err := mi.checkedResponse(r, "CheckHash")
+	if err != nil {
+		return false, err
+	}
+	if expected == "" {
+		return false, errors.New("expected digest required for CheckHash")
+	}
+
+	sum, err := resp.Hash(algo)
+	if err != nil {
+		return false, err
+	}
+	pass := strings.EqualFold(sum, expected)
+
+	if err := mi.emitCheck(fmt.Sprintf("body %s is %s", strings.ToLower(algo), expected), pass, extras); err != nil {
+		return false, err
+	}
+	return pass, nil
+}
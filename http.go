@@ -5,18 +5,32 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/domsolutions/xk6-fasthttp/metrics"
 	"github.com/grafana/sobek"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"go.k6.io/k6/js/common"
 	"go.k6.io/k6/js/modules"
-	"go.k6.io/k6/lib/netext/httpext"
 )
 
-type RootModule struct{}
+type RootModule struct {
+	// rate limiters, nil without a limit, shared by the clients of the same name, or unnamed ones
+	// created at the same point of the init code of every VU
+	rateLimiters *sync.Map
+	// requests in flight coalesced by the clients of the same name, or unnamed ones created at the
+	// same point of the init code of every VU
+	flights *sync.Map
+}
 
 // ModuleInstance represents an instance of the HTTP module for every VU.
 type ModuleInstance struct {
 	vu      modules.VU
+	root    *RootModule
 	exports *sobek.Object
+	metrics *metrics.ModuleMetrics
+	// number of unnamed clients created by the VU
+	clients int
+	// JSON Schemas compiled by checkschema, by the object or JSON text given, up to maxCachedSchemas
+	schemas map[interface{}]*jsonschema.Schema
 }
 
 var (
@@ -30,16 +44,23 @@ func init() {
 
 // New returns a pointer to a new HTTP RootModule.
 func New() *RootModule {
-	return &RootModule{}
+	return &RootModule{rateLimiters: &sync.Map{}, flights: &sync.Map{}}
 }
 
 // NewModuleInstance returns an HTTP module instance for each VU.
 func (r *RootModule) NewModuleInstance(vu modules.VU) modules.Instance {
 	rt := vu.Runtime()
 
+	moduleMetrics, err := metrics.RegisterMetrics(vu.InitEnv().Registry)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+
 	mi := &ModuleInstance{
 		vu:      vu,
+		root:    r,
 		exports: rt.NewObject(),
+		metrics: moduleMetrics,
 	}
 
 	mustExport := func(name string, value interface{}) {
@@ -52,6 +73,15 @@ func (r *RootModule) NewModuleInstance(vu modules.VU) modules.Instance {
 	mustExport("Client", mi.Client)
 	mustExport("Request", mi.Request)
 	mustExport("checkstatus", mi.CheckStatus)
+	mustExport("checkbody", mi.CheckBody)
+	mustExport("checkheader", mi.CheckHeader)
+	mustExport("checkjson", mi.CheckJSON)
+	mustExport("checkduration", mi.CheckDuration)
+	mustExport("checkcors", mi.CheckCORS)
+	mustExport("checkcontentlength", mi.CheckContentLength)
+	mustExport("checkschema", mi.CheckSchema)
+	mustExport("checkhash", mi.CheckHash)
+	mustExport("expectedStatuses", mi.ExpectedStatuses)
 
 	return mi
 }
@@ -62,26 +92,20 @@ func (mi *ModuleInstance) Request(call sobek.ConstructorCall, rt *sobek.Runtime)
 		common.Throw(mi.vu.Runtime(), errors.New("req constructor expects 1 or 2 args"))
 	}
 
-	var req RequestWrapper
-	req.Url = call.Arguments[0].String()
-	req.reqPool = &sync.Pool{}
+	req := newRequestWrapper(call.Arguments[0].String())
 
 	if len(call.Arguments) > 1 {
-		err := rt.ExportTo(call.Argument(1), &req)
+		err := rt.ExportTo(call.Argument(1), req)
 		if err != nil {
 			common.Throw(rt, fmt.Errorf("request constructor expects first argument to be RequestWrapper got error %v", err))
 		}
 
-		if req.ResponseType != "" {
-			responseType, err := httpext.ResponseTypeString(req.ResponseType)
-			if err != nil {
-				common.Throw(mi.vu.Runtime(), fmt.Errorf("Invalid response type %v", err))
-			}
-			req.responseType = responseType
+		if err := req.prepare(); err != nil {
+			common.Throw(rt, err)
 		}
 	}
 
-	return mi.vu.Runtime().ToValue(&req).ToObject(rt)
+	return mi.vu.Runtime().ToValue(req).ToObject(rt)
 }
 
 // Exports returns the JS values this module exports.
@@ -0,0 +1,257 @@
+package fasthttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+// errHTTP2NotNegotiated is returned when dialing a host which didn't select h2 during ALPN
+var errHTTP2NotNegotiated = errors.New("http2 not negotiated")
+
+// doer sends requests over one of the supported protocols, returning the remote address of the
+// connection the response was read from
+type doer interface {
+	Do(req *http.Request, resp *http.Response) (net.Addr, error)
+	// DoDeadline is Do failing with fasthttp.ErrTimeout, or a context.DeadlineExceeded over HTTP/2,
+	// when the response hasn't been read by deadline
+	DoDeadline(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error)
+	CloseIdleConnections()
+}
+
+// http1Client sends requests with fasthttp's own HTTP/1.1 client
+type http1Client struct {
+	*http.Client
+}
+
+func (c http1Client) Do(req *http.Request, resp *http.Response) (net.Addr, error) {
+	if err := c.Client.Do(req, resp); err != nil {
+		return nil, err
+	}
+	return resp.RemoteAddr(), nil
+}
+
+func (c http1Client) DoDeadline(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error) {
+	if err := c.Client.DoDeadline(req, resp, deadline); err != nil {
+		return nil, err
+	}
+	return resp.RemoteAddr(), nil
+}
+
+// http2Client sends requests to HTTPS hosts over HTTP/2 when negotiated through ALPN, falling back
+// to fasthttp's HTTP/1.1 client for plain HTTP and hosts which don't support it.
+type http2Client struct {
+	h1          http1Client
+	transport   *http2.Transport
+	userAgent   string
+	readTimeout time.Duration
+
+	// hosts which didn't negotiate h2, so are sent straight to h1
+	h1Hosts *sync.Map
+}
+
+func newHTTP2Client(h1 http1Client, dial http.DialFunc, timeout time.Duration, tlsConfig *tls.Config) *http2Client {
+	// protocols set by tls_config.next_protos are offered as they are, hosts not selecting h2 from
+	// them being sent over HTTP/1.1
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	dialTLS := newDialFunc(dial, timeout, tlsConfig, true)
+
+	// idle connections are closed after the same duration as HTTP/1.1 ones, the transport otherwise
+	// keeping them until the server closes them
+	idleConnTimeout := h1.MaxIdleConnDuration
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = http.DefaultMaxIdleConnDuration
+	}
+
+	return &http2Client{
+		h1: h1,
+		transport: &http2.Transport{
+			DialTLSContext: func(_ context.Context, _, addr string, _ *tls.Config) (net.Conn, error) {
+				conn, err := dialTLS(addr)
+				if err != nil {
+					return nil, err
+				}
+				if conn.(*tls.Conn).ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+					_ = conn.Close()
+					return nil, errHTTP2NotNegotiated
+				}
+				return conn, nil
+			},
+			IdleConnTimeout: idleConnTimeout,
+		},
+		userAgent:   h1.Name,
+		readTimeout: h1.ReadTimeout,
+		h1Hosts:     &sync.Map{},
+	}
+}
+
+func (c *http2Client) Do(req *http.Request, resp *http.Response) (net.Addr, error) {
+	return c.DoDeadline(req, resp, time.Time{})
+}
+
+// DoDeadline is Do without a deadline when it's zero
+func (c *http2Client) DoDeadline(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error) {
+	h1Do := func() (net.Addr, error) {
+		if deadline.IsZero() {
+			return c.h1.Do(req, resp)
+		}
+		return c.h1.DoDeadline(req, resp, deadline)
+	}
+
+	host := string(req.URI().Host())
+	if !bytes.Equal(req.URI().Scheme(), []byte("https")) {
+		return h1Do()
+	}
+	if _, ok := c.h1Hosts.Load(host); ok {
+		return h1Do()
+	}
+
+	addr, err := c.do(req, resp, deadline)
+	if errors.Is(err, errHTTP2NotNegotiated) {
+		c.h1Hosts.Store(host, struct{}{})
+		return h1Do()
+	}
+	return addr, err
+}
+
+func (c *http2Client) do(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error) {
+	ctx := context.Background()
+	if abort := abortOf(req); abort != nil {
+		if !abort.begin() {
+			return nil, context.Canceled
+		}
+		// the stream is reset when the request is abandoned before its response arrives
+		defer abort.end()
+		var interrupt context.CancelFunc
+		ctx, interrupt = context.WithCancel(ctx)
+		abort.started(interrupt)
+	}
+	cancel := context.CancelFunc(func() {})
+	// whichever of the read timeout and the deadline is sooner
+	if c.readTimeout > 0 && (deadline.IsZero() || time.Now().Add(c.readTimeout).Before(deadline)) {
+		ctx, cancel = context.WithTimeout(ctx, c.readTimeout)
+	} else if !deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+
+	var addr net.Addr
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			addr = info.Conn.RemoteAddr()
+		},
+	})
+
+	hreq, err := c.newRequest(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	hresp, err := c.transport.RoundTrip(hreq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Header.SetStatusCode(hresp.StatusCode)
+	resp.Header.SetProtocol([]byte(hresp.Proto))
+	for name, values := range hresp.Header {
+		for _, value := range values {
+			resp.Header.Add(name, value)
+		}
+	}
+	// trailers are declared up front, their values are known once the body has been read
+	for name := range hresp.Trailer {
+		_ = resp.Header.AddTrailer(name)
+	}
+	body := &cancelOnClose{ReadCloser: hresp.Body, cancel: cancel, onEOF: func() {
+		for name, values := range hresp.Trailer {
+			for _, value := range values {
+				resp.Header.Add(name, value)
+			}
+		}
+	}}
+	// the body is streamed like large HTTP/1.1 bodies, the request's context lasting until it's read
+	resp.SetBodyStream(body, int(hresp.ContentLength))
+
+	return addr, nil
+}
+
+func (c *http2Client) CloseIdleConnections() {
+	c.h1.CloseIdleConnections()
+	c.transport.CloseIdleConnections()
+}
+
+// newRequest converts the fasthttp request to its net/http equivalent
+func (c *http2Client) newRequest(ctx context.Context, req *http.Request) (*nethttp.Request, error) {
+	var body io.Reader
+	contentLength := int64(-1)
+	if req.IsBodyStream() {
+		body = req.BodyStream()
+		if n := req.Header.ContentLength(); n >= 0 {
+			contentLength = int64(n)
+		}
+	} else if b := req.Body(); len(b) > 0 {
+		body = bytes.NewReader(b)
+		contentLength = int64(len(b))
+	} else {
+		contentLength = 0
+	}
+
+	hreq, err := nethttp.NewRequestWithContext(ctx, string(req.Header.Method()), req.URI().String(), body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.ContentLength = contentLength
+	if req.UseHostHeader {
+		hreq.Host = string(req.Header.Host())
+	}
+
+	req.Header.VisitAll(func(key, value []byte) {
+		switch strings.ToLower(string(key)) {
+		// connection specific headers aren't allowed in HTTP/2
+		case "host", "content-length", "connection", "transfer-encoding":
+			return
+		}
+		hreq.Header.Add(string(key), string(value))
+	})
+	if hreq.Header.Get(http.HeaderUserAgent) == "" && c.userAgent != "" {
+		hreq.Header.Set(http.HeaderUserAgent, c.userAgent)
+	}
+
+	return hreq, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	onEOF  func()
+}
+
+func (c *cancelOnClose) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) && c.onEOF != nil {
+		c.onEOF()
+		c.onEOF = nil
+	}
+	return n, err
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
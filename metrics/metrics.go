@@ -4,7 +4,7 @@ import (
 	"context"
 	"net"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/domsolutions/xk6-fasthttp/errors"
 	"github.com/domsolutions/xk6-fasthttp/tracer"
@@ -14,6 +14,76 @@ import (
 	"go.k6.io/k6/metrics"
 )
 
+const (
+	tagTLSCipherSuite = "tls_cipher_suite"
+	// tagTLSResumed tells requests whose TLS handshake resumed an earlier session from full handshakes
+	tagTLSResumed = "tls_resumed"
+
+	// HTTPReqNewConnName is the rate of requests sent over a newly dialed connection rather than a
+	// pooled one
+	HTTPReqNewConnName = "fasthttp_req_new_conn"
+
+	// OpenConnsName is the number of connections held open by the client, idle or busy, when a
+	// request completes. Each VU's clients count their own connections, not those of the other VUs
+	OpenConnsName = "fasthttp_open_conns"
+
+	// TLSResumedName is the rate of TLS handshakes which resumed an earlier session rather than
+	// being full handshakes, emitted by the requests establishing a connection
+	TLSResumedName = "fasthttp_tls_resumed"
+
+	// HTTPReqRedirectsName is the number of redirects followed by a request
+	HTTPReqRedirectsName = "fasthttp_req_redirects"
+
+	// HTTPReqsCoalescedName is the number of requests which shared the response of an identical
+	// request in flight rather than being sent
+	HTTPReqsCoalescedName = "fasthttp_reqs_coalesced"
+
+	// HTTPRespBodySizeName is the number of bytes of the body of each response, as received
+	HTTPRespBodySizeName = "fasthttp_resp_body_size"
+)
+
+// ModuleMetrics are the metrics emitted on top of k6's builtin HTTP metrics
+type ModuleMetrics struct {
+	HTTPReqNewConn    *metrics.Metric
+	TLSResumed        *metrics.Metric
+	OpenConns         *metrics.Metric
+	HTTPReqRedirects  *metrics.Metric
+	HTTPReqsCoalesced *metrics.Metric
+	HTTPRespBodySize  *metrics.Metric
+}
+
+// RegisterMetrics registers the module's metrics, it must be called from the init context
+func RegisterMetrics(registry *metrics.Registry) (*ModuleMetrics, error) {
+	newConn, err := registry.NewMetric(HTTPReqNewConnName, metrics.Rate)
+	if err != nil {
+		return nil, err
+	}
+	tlsResumed, err := registry.NewMetric(TLSResumedName, metrics.Rate)
+	if err != nil {
+		return nil, err
+	}
+	openConns, err := registry.NewMetric(OpenConnsName, metrics.Gauge)
+	if err != nil {
+		return nil, err
+	}
+	redirects, err := registry.NewMetric(HTTPReqRedirectsName, metrics.Trend)
+	if err != nil {
+		return nil, err
+	}
+	coalesced, err := registry.NewMetric(HTTPReqsCoalescedName, metrics.Counter)
+	if err != nil {
+		return nil, err
+	}
+	bodySize, err := registry.NewMetric(HTTPRespBodySizeName, metrics.Trend, metrics.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &ModuleMetrics{
+		HTTPReqNewConn: newConn, TLSResumed: tlsResumed, OpenConns: openConns,
+		HTTPReqRedirects: redirects, HTTPReqsCoalesced: coalesced, HTTPRespBodySize: bodySize,
+	}, nil
+}
+
 // UnfinishedRequest stores the Request and the raw result returned from the
 // underlying http.RoundTripper, but before its body has been read
 type UnfinishedRequest struct {
@@ -22,6 +92,29 @@ type UnfinishedRequest struct {
 	Request  *http.Request
 	Response *http.Response
 	Err      error
+	// BodyErr is the error reading the response's body, which fails the request though its status
+	// was received
+	BodyErr error
+
+	// Name groups the request's metrics under the name and url tags instead of its URL
+	Name string
+
+	// Tags are the VU's tags and metadata when the request was made i.e. its scenario, group and
+	// iter, the dispatcher's are used when nil
+	Tags *metrics.TagsAndMeta
+
+	// OpenConns is the number of connections held open by the client once the request completed
+	OpenConns int
+
+	// Redirects is the number of redirects followed to the response
+	Redirects int
+
+	// BodySize is the number of bytes of the response's body read, emitted when the request didn't fail
+	BodySize int
+
+	// ClassifyError maps the status, 0 when the request failed, and the error code it was given, 0
+	// when none, to the error code to emit, the given one being kept when it returns false
+	ClassifyError func(status int, code errors.ErrCode) (errors.ErrCode, bool)
 }
 
 type FinishedRequest struct {
@@ -35,46 +128,20 @@ type FinishedRequest struct {
 type MetricDispatcher struct {
 	State            *lib.State
 	TagsAndMeta      *metrics.TagsAndMeta
-	responseCallback func(int) bool
-
-	lastRequest     *UnfinishedRequest
-	lastRequestLock *sync.Mutex
+	ResponseCallback func(int) bool
+	ModuleMetrics    *ModuleMetrics
+	// TLSTags is whether requests are tagged with tls_cipher_suite and tls_resumed
+	TLSTags bool
 }
 
 func NewMetricDispatcher(tags *metrics.TagsAndMeta, state *lib.State) *MetricDispatcher {
-	return &MetricDispatcher{TagsAndMeta: tags, State: state, lastRequestLock: &sync.Mutex{}}
+	return &MetricDispatcher{TagsAndMeta: tags, State: state}
 }
 
-func (t *MetricDispatcher) ProcessLastSavedRequest(ctx context.Context, lastErr error) *FinishedRequest {
-	t.lastRequestLock.Lock()
-	unprocessedRequest := t.lastRequest
-	t.lastRequest = nil
-	t.lastRequestLock.Unlock()
-
-	if unprocessedRequest != nil {
-		// We don't want to overwrite any previous errors, but if there were
-		// none and we (i.e. the MakeRequest() function) have one, save it
-		// before we emit the metrics.
-		if unprocessedRequest.Err == nil && lastErr != nil {
-			unprocessedRequest.Err = lastErr
-		}
-
-		return t.measureAndEmitMetrics(ctx, unprocessedRequest)
-	}
-	return nil
-}
-
-func (t *MetricDispatcher) SaveCurrentRequest(ctx context.Context, currentRequest *UnfinishedRequest) {
-	t.lastRequestLock.Lock()
-	unprocessedRequest := t.lastRequest
-	t.lastRequest = currentRequest
-	t.lastRequestLock.Unlock()
-
-	if unprocessedRequest != nil {
-		// This shouldn't happen, since we have one transport per Request, but just in case...
-		t.State.Logger.Warnf("TracerTransport: unexpected unprocessed Request for %s", unprocessedRequest.Request.URI().String())
-		t.measureAndEmitMetrics(ctx, unprocessedRequest)
-	}
+// EmitRequest measures and emits the metrics of a completed request. It must be called before the
+// request and response are released back to fasthttp, and is safe to call concurrently.
+func (t *MetricDispatcher) EmitRequest(ctx context.Context, req *UnfinishedRequest) *FinishedRequest {
+	return t.measureAndEmitMetrics(ctx, req)
 }
 
 // Helper method to finish the Tracer Trail, assemble the tag values and emits
@@ -89,40 +156,49 @@ func (t *MetricDispatcher) measureAndEmitMetrics(ctx context.Context, unfReq *Un
 		Trail:             trail,
 	}
 
-	tagsAndMeta := t.TagsAndMeta.Clone()
+	tagsAndMeta := t.requestTags(unfReq.Tags, unfReq.Request, unfReq.Name)
 	enabledTags := t.State.Options.SystemTags
-
-	// After k6 v0.41.0, the `name` and `url` tags have the exact same values:
-	nameTagValue, nameTagManuallySet := tagsAndMeta.Tags.Get(metrics.TagName.String())
-	if !nameTagManuallySet {
-		// If the user *didn't* manually set a `name` tag value and didn't use
-		// the http.url template literal helper to have k6 automatically set
-		// it (see `lib/netext/httpext.MakeRequest()`), we will use the cleaned
-		// URL value as the value of both `name` and `url` tags.
-		uri := unfReq.Request.URI().String()
-		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagName, uri)
-		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagURL, uri)
-	} else {
-		// However, if the user set the `name` tag value somehow, we will use
-		// whatever they set as the value of the `url` tags too, to prevent
-		// high-cardinality values in the indexed tags.
-		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagURL, nameTagValue)
-	}
-
-	tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagMethod, string(unfReq.Request.Header.Method()))
-
+	var status int
 	if unfReq.Err != nil {
 		result.ErrorCode, result.ErrorMsg = errors.ErrorCodeForError(unfReq.Err)
 		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagError, result.ErrorMsg)
-		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagErrorCode, strconv.Itoa(int(result.ErrorCode)))
 		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagStatus, "0")
 	} else {
-		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagStatus, strconv.Itoa(unfReq.Response.StatusCode()))
-		if unfReq.Response.StatusCode() >= 400 {
-			result.ErrorCode = errors.ErrCode(1000 + unfReq.Response.StatusCode())
-			tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagErrorCode, strconv.Itoa(int(result.ErrorCode)))
+		status = unfReq.Response.StatusCode()
+		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagStatus, strconv.Itoa(status))
+
+		// statuses the response callback expects aren't errors, i.e. a 404 from an API using it for a miss
+		if status >= 400 && (t.ResponseCallback == nil || !t.ResponseCallback(status)) {
+			result.ErrorCode = errors.ErrCode(1000 + status)
+		}
+		if unfReq.BodyErr != nil {
+			result.ErrorCode, result.ErrorMsg = errors.ErrorCodeForError(unfReq.BodyErr)
+			tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagError, result.ErrorMsg)
+		}
+
+		if trail.TLS != nil {
+			tlsInfo, _ := netext.ParseTLSConnState(trail.TLS)
+			tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagTLSVersion, tlsInfo.Version)
+			// k6 has no system tags for them so they're enabled on their own
+			if t.TLSTags {
+				tagsAndMeta.SetTag(tagTLSCipherSuite, tlsInfo.CipherSuite)
+				// only the request establishing the connection made the handshake
+				if trail.ConnNew.Bool {
+					tagsAndMeta.SetTag(tagTLSResumed, strconv.FormatBool(trail.TLS.DidResume))
+				}
+			}
+			result.TLSInfo = tlsInfo
+		}
+	}
+
+	if unfReq.ClassifyError != nil {
+		if code, ok := unfReq.ClassifyError(status, result.ErrorCode); ok {
+			result.ErrorCode = code
 		}
 	}
+	if result.ErrorCode != 0 {
+		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagErrorCode, strconv.Itoa(int(result.ErrorCode)))
+	}
 
 	if enabledTags.Has(metrics.TagIP) && trail.ConnRemoteAddr != nil {
 		if ip, _, err := net.SplitHostPort(trail.ConnRemoteAddr.String()); err == nil {
@@ -130,12 +206,13 @@ func (t *MetricDispatcher) measureAndEmitMetrics(ctx context.Context, unfReq *Un
 		}
 	}
 	var failed float64
-	if t.responseCallback != nil {
+	if t.ResponseCallback != nil {
 		var statusCode int
 		if unfReq.Err == nil {
 			statusCode = unfReq.Response.StatusCode()
 		}
-		expected := t.responseCallback(statusCode)
+		// a body which couldn't be read fails the request whatever its status
+		expected := unfReq.BodyErr == nil && t.ResponseCallback(statusCode)
 		if !expected {
 			failed = 1
 		}
@@ -144,7 +221,7 @@ func (t *MetricDispatcher) measureAndEmitMetrics(ctx context.Context, unfReq *Un
 	}
 
 	trail.SaveSamples(t.State.BuiltinMetrics, &tagsAndMeta)
-	if t.responseCallback != nil {
+	if t.ResponseCallback != nil {
 		trail.Failed.Valid = true
 		if failed == 1 {
 			trail.Failed.Bool = true
@@ -162,6 +239,130 @@ func (t *MetricDispatcher) measureAndEmitMetrics(ctx context.Context, unfReq *Un
 		)
 	}
 
+	if trail.ConnNew.Valid && t.ModuleMetrics != nil {
+		var newConn float64
+		if trail.ConnNew.Bool {
+			newConn = 1
+		}
+		trail.Samples = append(trail.Samples,
+			metrics.Sample{
+				TimeSeries: metrics.TimeSeries{
+					Metric: t.ModuleMetrics.HTTPReqNewConn,
+					Tags:   tagsAndMeta.Tags,
+				},
+				Time:     trail.EndTime,
+				Metadata: tagsAndMeta.Metadata,
+				Value:    newConn,
+			},
+		)
+	}
+
+	if trail.ConnNew.Bool && trail.TLS != nil && unfReq.Err == nil && t.ModuleMetrics != nil {
+		var resumed float64
+		if trail.TLS.DidResume {
+			resumed = 1
+		}
+		trail.Samples = append(trail.Samples,
+			metrics.Sample{
+				TimeSeries: metrics.TimeSeries{
+					Metric: t.ModuleMetrics.TLSResumed,
+					Tags:   tagsAndMeta.Tags,
+				},
+				Time:     trail.EndTime,
+				Metadata: tagsAndMeta.Metadata,
+				Value:    resumed,
+			},
+		)
+	}
+
+	if t.ModuleMetrics != nil {
+		trail.Samples = append(trail.Samples,
+			metrics.Sample{
+				TimeSeries: metrics.TimeSeries{
+					Metric: t.ModuleMetrics.OpenConns,
+					Tags:   tagsAndMeta.Tags,
+				},
+				Time:     trail.EndTime,
+				Metadata: tagsAndMeta.Metadata,
+				Value:    float64(unfReq.OpenConns),
+			},
+			metrics.Sample{
+				TimeSeries: metrics.TimeSeries{
+					Metric: t.ModuleMetrics.HTTPReqRedirects,
+					Tags:   tagsAndMeta.Tags,
+				},
+				Time:     trail.EndTime,
+				Metadata: tagsAndMeta.Metadata,
+				Value:    float64(unfReq.Redirects),
+			},
+		)
+		if unfReq.Err == nil {
+			trail.Samples = append(trail.Samples,
+				metrics.Sample{
+					TimeSeries: metrics.TimeSeries{
+						Metric: t.ModuleMetrics.HTTPRespBodySize,
+						Tags:   tagsAndMeta.Tags,
+					},
+					Time:     trail.EndTime,
+					Metadata: tagsAndMeta.Metadata,
+					Value:    float64(unfReq.BodySize),
+				},
+			)
+		}
+	}
+
 	metrics.PushIfNotDone(ctx, t.State.Samples, trail)
 	return result
 }
+
+// EmitCoalesced emits a request which shared the response of an identical request in flight rather
+// than being sent, tagged like the requests sent
+func (t *MetricDispatcher) EmitCoalesced(ctx context.Context, req *http.Request, name string, tags *metrics.TagsAndMeta) {
+	if t.ModuleMetrics == nil {
+		return
+	}
+	tagsAndMeta := t.requestTags(tags, req, name)
+	metrics.PushIfNotDone(ctx, t.State.Samples, metrics.Sample{
+		TimeSeries: metrics.TimeSeries{
+			Metric: t.ModuleMetrics.HTTPReqsCoalesced,
+			Tags:   tagsAndMeta.Tags,
+		},
+		Time:     time.Now(),
+		Metadata: tagsAndMeta.Metadata,
+		Value:    1,
+	})
+}
+
+// requestTags returns tags, the dispatcher's when nil, with the name, url and method tags of req
+func (t *MetricDispatcher) requestTags(tags *metrics.TagsAndMeta, req *http.Request, name string) metrics.TagsAndMeta {
+	if tags == nil {
+		tags = t.TagsAndMeta
+	}
+	tagsAndMeta := tags.Clone()
+	enabledTags := t.State.Options.SystemTags
+
+	// After k6 v0.41.0, the `name` and `url` tags have the exact same values:
+	nameTagValue, nameTagManuallySet := tagsAndMeta.Tags.Get(metrics.TagName.String())
+	if name != "" {
+		// a name given for the request takes precedence over one set on the VU
+		nameTagValue, nameTagManuallySet = name, true
+		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagName, nameTagValue)
+	}
+	if !nameTagManuallySet {
+		// If the user *didn't* manually set a `name` tag value and didn't use
+		// the http.url template literal helper to have k6 automatically set
+		// it (see `lib/netext/httpext.MakeRequest()`), we will use the cleaned
+		// URL value as the value of both `name` and `url` tags.
+		uri := req.URI().String()
+		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagName, uri)
+		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagURL, uri)
+	} else {
+		// However, if the user set the `name` tag value somehow, we will use
+		// whatever they set as the value of the `url` tags too, to prevent
+		// high-cardinality values in the indexed tags.
+		tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagURL, nameTagValue)
+	}
+
+	tagsAndMeta.SetSystemTagOrMetaIfEnabled(enabledTags, metrics.TagMethod, string(req.Header.Method()))
+	return tagsAndMeta
+}
@@ -0,0 +1,92 @@
+package fasthttp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	http "github.com/valyala/fasthttp"
+)
+
+type PipelineConfig struct {
+	MaxConns           int
+	MaxPendingRequests int
+}
+
+// pipelineClient pipelines HTTP/1.1 requests with a fasthttp PipelineClient per host. Responses
+// are read whole by fasthttp so aren't streamed. Connections are dialed and traced as the default
+// client's, though requests aren't timed by phase as those in flight on a connection can't be told
+// apart.
+type pipelineClient struct {
+	config    ClientConfig
+	dial      http.DialFunc
+	timeout   time.Duration
+	tlsConfig *tls.Config
+
+	clients *sync.Map
+}
+
+func newPipelineClient(config ClientConfig, dial http.DialFunc, timeout time.Duration, tlsConfig *tls.Config) *pipelineClient {
+	return &pipelineClient{config: config, dial: dial, timeout: timeout, tlsConfig: tlsConfig, clients: &sync.Map{}}
+}
+
+func (c *pipelineClient) Do(req *http.Request, resp *http.Response) (net.Addr, error) {
+	if err := c.hostClient(req.URI()).Do(req, resp); err != nil {
+		return nil, err
+	}
+	return resp.RemoteAddr(), nil
+}
+
+func (c *pipelineClient) DoDeadline(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error) {
+	if err := c.hostClient(req.URI()).DoDeadline(req, resp, deadline); err != nil {
+		return nil, err
+	}
+	return resp.RemoteAddr(), nil
+}
+
+// CloseIdleConnections drops the host clients without pending requests so later requests dial new
+// connections, pipelined connections are closed by fasthttp once they've been idle for
+// max_idle_conn_duration
+func (c *pipelineClient) CloseIdleConnections() {
+	c.clients.Range(func(key, pc interface{}) bool {
+		if pc.(*http.PipelineClient).PendingRequests() == 0 {
+			c.clients.Delete(key)
+		}
+		return true
+	})
+}
+
+func (c *pipelineClient) hostClient(uri *http.URI) *http.PipelineClient {
+	isTLS := bytes.Equal(uri.Scheme(), []byte("https"))
+	addr := string(uri.Host())
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if isTLS {
+			addr += ":443"
+		} else {
+			addr += ":80"
+		}
+	}
+
+	key := string(uri.Scheme()) + "://" + addr
+	if pc, ok := c.clients.Load(key); ok {
+		return pc.(*http.PipelineClient)
+	}
+
+	pc, _ := c.clients.LoadOrStore(key, &http.PipelineClient{
+		Addr:                          addr,
+		Name:                          c.config.UserAgent,
+		MaxConns:                      c.config.Pipeline.MaxConns,
+		MaxPendingRequests:            c.config.Pipeline.MaxPendingRequests,
+		MaxIdleConnDuration:           time.Duration(c.config.MaxIdleConnDuration) * time.Second,
+		ReadBufferSize:                c.config.ReadBufferSize,
+		WriteBufferSize:               c.config.WriteBufferSize,
+		ReadTimeout:                   time.Duration(c.config.ReadTimeout) * time.Second,
+		WriteTimeout:                  time.Duration(c.config.WriteTimeout) * time.Second,
+		DisableHeaderNamesNormalizing: !c.config.NormalizeHeaders,
+		// TLS is handshaked by the dialer so connections are traced the same as the default client
+		Dial: newDialFunc(c.dial, c.timeout, c.tlsConfig, isTLS),
+	})
+	return pc.(*http.PipelineClient)
+}
@@ -0,0 +1,315 @@
+package fasthttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/sobek"
+	http "github.com/valyala/fasthttp"
+	"go.k6.io/k6/js/common"
+)
+
+// defaultRawSendTimeout is how long sendRaw waits for a response without a read_timeout, as servers
+// may never answer the malformed requests it's meant for
+const defaultRawSendTimeout = 10 * time.Second
+
+// rawSender writes raw requests for Client.SendRaw over connections of their own, dialed like the
+// client's other connections
+type rawSender struct {
+	dial        http.DialFunc
+	dialTimeout time.Duration
+	// 0 waits for the response until the VU's context is done
+	readTimeout time.Duration
+	// 0 waits for the request to be written until the VU's context is done
+	writeTimeout time.Duration
+	// sendTimeout is how long sendRaw, which blocks the event loop, waits for a response: the
+	// read_timeout, otherwise defaultRawSendTimeout
+	sendTimeout time.Duration
+	// readBufferSize is the client's read_buffer_size, which response headers must fit in
+	readBufferSize int
+	tlsConfig      *tls.Config
+	// flippedTLSConfig is tlsConfig with InsecureSkipVerify flipped, for requests overriding it
+	flippedTLSConfig *tls.Config
+}
+
+// SendRaw writes data to a new connection to target as it is, without any checks or changes, and
+// returns the raw bytes of the response. target is a host:port dialed without TLS, or an http or
+// https URL. It's meant for testing how servers handle malformed requests, so no metrics are
+// emitted. The response is waited for up to read_timeout, or 10 seconds without one.
+func (c *Client) SendRaw(target string, data sobek.Value) (sobek.ArrayBuffer, error) {
+	rt := c.vu.Runtime()
+	if c.vu.State() == nil {
+		return sobek.ArrayBuffer{}, errors.New("sendRaw can't be used in the init context")
+	}
+
+	addr, isTLS, err := rawTarget(target)
+	if err != nil {
+		return sobek.ArrayBuffer{}, err
+	}
+	if data == nil || sobek.IsUndefined(data) || sobek.IsNull(data) {
+		return sobek.ArrayBuffer{}, errors.New("raw request required for sendRaw")
+	}
+	req, err := common.ToBytes(data.Export())
+	if err != nil {
+		return sobek.ArrayBuffer{}, err
+	}
+
+	resp, err := c.raw.send(c.vu.Context(), addr, isTLS, req)
+	if err != nil {
+		return sobek.ArrayBuffer{}, err
+	}
+	return rt.NewArrayBuffer(resp), nil
+}
+
+// rawTarget returns the address to dial for target and whether it's over TLS
+func rawTarget(target string) (string, bool, error) {
+	if !strings.Contains(target, "://") {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return "", false, fmt.Errorf("invalid sendRaw target %q; %w", target, err)
+		}
+		return target, false, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false, err
+	}
+	var isTLS bool
+	switch u.Scheme {
+	case "http":
+	case "https":
+		isTLS = true
+	default:
+		return "", false, fmt.Errorf("unsupported sendRaw scheme %q", u.Scheme)
+	}
+	port := u.Port()
+	if port == "" && isTLS {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port), isTLS, nil
+}
+
+// send writes req to a new connection to addr, returning the bytes read until one response was
+// parsed, the server closed the connection or reading timed out. Responses which can't be parsed
+// are returned as far as they were read, as they're what's being tested.
+func (s *rawSender) send(ctx context.Context, addr string, isTLS bool, req []byte) ([]byte, error) {
+	conn, err := newDialFunc(s.dial, s.dialTimeout, s.tlsConfig, isTLS)(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the read is stopped along with the iteration
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(s.sendTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	resp := http.AcquireResponse()
+	defer http.ReleaseResponse(resp)
+	err = resp.Read(bufio.NewReaderSize(io.TeeReader(conn, &raw), s.readBufferSize))
+	if err != nil && raw.Len() == 0 {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
+
+// roundTrip sends req over a new connection, dialed for its URL like the client's other
+// connections, writing it with write by the sooner of deadline and write_timeout and reading resp
+// by the sooner of deadline and read_timeout.
+// The connection is closed once the response is read.
+func (s *rawSender) roundTrip(
+	req *http.Request, resp *http.Response, deadline time.Time, write func(*bufio.Writer) error,
+) (net.Addr, error) {
+	var isTLS bool
+	switch string(req.URI().Scheme()) {
+	case "http", "ws":
+	case "https", "wss":
+		isTLS = true
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", req.URI().Scheme())
+	}
+	addr := http.AddMissingPort(string(req.URI().Host()), isTLS)
+
+	conn, err := newDialFunc(s.dial, s.dialTimeout, s.tlsConfig, isTLS)(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	readDeadline, writeDeadline := deadline, deadline
+	if s.readTimeout > 0 && (deadline.IsZero() || time.Now().Add(s.readTimeout).Before(deadline)) {
+		readDeadline = time.Now().Add(s.readTimeout)
+	}
+	if s.writeTimeout > 0 && (deadline.IsZero() || time.Now().Add(s.writeTimeout).Before(deadline)) {
+		writeDeadline = time.Now().Add(s.writeTimeout)
+	}
+	if err := conn.SetReadDeadline(readDeadline); err != nil {
+		return nil, err
+	}
+	if err := conn.SetWriteDeadline(writeDeadline); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(conn, s.readBufferSize)
+	var out io.Writer = conn
+	if req.MayContinue() && (req.IsBodyStream() || len(req.Body()) > 0) {
+		out = &continueGate{conn: conn, r: r, deadline: readDeadline}
+	}
+	w := bufio.NewWriter(out)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	// a final status in place of 100 Continue is read as the response, the body left unsent
+	if err != nil && !errors.Is(err, errNotContinued) {
+		return conn.RemoteAddr(), err
+	}
+	if err := resp.Read(r); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = http.ErrTimeout
+		}
+		return conn.RemoteAddr(), err
+	}
+	return conn.RemoteAddr(), nil
+}
+
+// expectContinueTimeout is how long a request with Expect: 100-continue waits for the server to
+// answer its headers before sending the body anyway, as servers unaware of the header never do
+const expectContinueTimeout = time.Second
+
+// errNotContinued is returned by writes of a body the server answered with a final status
+var errNotContinued = errors.New("server answered with a final status instead of 100 Continue")
+
+// continueGate writes a request with Expect: 100-continue to conn, holding the body back once the
+// headers are written until the server answers them. A 100 Continue is left to be read along with
+// the response as fasthttp skips it, while any other status fails the write with errNotContinued.
+type continueGate struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	deadline time.Time
+	// tail is the end of what was written of the headers, which may end in the next write
+	tail []byte
+	sent bool
+}
+
+func (g *continueGate) Write(p []byte) (int, error) {
+	if g.sent {
+		return g.conn.Write(p)
+	}
+
+	written := append(g.tail, p...)
+	end := bytes.Index(written, []byte("\r\n\r\n"))
+	if end < 0 {
+		g.tail = written[max(len(written)-3, 0):]
+		return g.conn.Write(p)
+	}
+	end += 4 - len(g.tail)
+	n, err := g.conn.Write(p[:end])
+	if err != nil {
+		return n, err
+	}
+	if err := g.wait(); err != nil {
+		return n, err
+	}
+	g.sent = true
+	m, err := g.conn.Write(p[end:])
+	return n + m, err
+}
+
+// wait waits for the server to answer the headers, returning errNotContinued when it answered with
+// a final status and nil when it sent 100 Continue or nothing within expectContinueTimeout
+func (g *continueGate) wait() error {
+	timeout := time.Now().Add(expectContinueTimeout)
+	if !g.deadline.IsZero() && g.deadline.Before(timeout) {
+		timeout = g.deadline
+	}
+	if err := g.conn.SetReadDeadline(timeout); err != nil {
+		return err
+	}
+	status, err := g.r.Peek(len("HTTP/1.1 100"))
+	if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() || g.r.Buffered() > 0 {
+			return err
+		}
+	}
+	if err := g.conn.SetReadDeadline(g.deadline); err != nil {
+		return err
+	}
+	if len(status) > 0 && !bytes.HasSuffix(status, []byte(" 100")) {
+		return errNotContinued
+	}
+	return nil
+}
+
+// targetDoer sends requests with target as the request line's request-target verbatim, such as
+// the asterisk-form "*", the absolute-form or the authority-form, which fasthttp would normalize to
+// the URL's path. Each is sent over a connection of its own as the raw sender's requests are. With
+// no target the request line is fasthttp's own, for requests waiting for 100 Continue.
+type targetDoer struct {
+	raw    *rawSender
+	target string
+}
+
+func (t targetDoer) Do(req *http.Request, resp *http.Response) (net.Addr, error) {
+	return t.DoDeadline(req, resp, time.Time{})
+}
+
+// DoDeadline sends the request, reading the response by the sooner of deadline and read_timeout
+func (t targetDoer) DoDeadline(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error) {
+	// a HEAD response has no body whatever its headers say
+	resp.SkipBody = req.Header.IsHead()
+	return t.raw.roundTrip(req, resp, deadline, func(w *bufio.Writer) error {
+		if t.target == "" {
+			return req.Write(w)
+		}
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		if err := req.Write(bw); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		// the request line written is swapped for one with the target
+		head := buf.Bytes()
+		end := bytes.Index(head, []byte("\r\n"))
+		if end < 0 {
+			return errors.New("request line not written")
+		}
+		if _, err := fmt.Fprintf(w, "%s %s HTTP/1.1", req.Header.Method(), t.target); err != nil {
+			return err
+		}
+		_, err := w.Write(head[end:])
+		return err
+	})
+}
+
+// CloseIdleConnections does nothing as no connection outlives its request
+func (t targetDoer) CloseIdleConnections() {}
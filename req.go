@@ -1,21 +1,288 @@
 package fasthttp
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
 
-	"github.com/valyala/fasthttp"
+	"github.com/grafana/sobek"
+	"go.k6.io/k6/js/common"
 	"go.k6.io/k6/lib/netext/httpext"
+	"golang.org/x/net/html/charset"
 )
 
 type RequestWrapper struct {
 	Throw            bool
 	DisableKeepAlive bool
 	Url              string
+	Name             string
 	Host             string
 	Headers          map[string]string
 	Body             interface{}
-	req              *fasthttp.Request
+	RawBody          interface{}
+	BodyTemplate     string
+	AllowBodyOnGet   bool
+	Chunked          bool
 	reqPool          *sync.Pool
+	inFlight         *inFlight
 	ResponseType     string
+	Charset          string
+	SaveToFile       string
+	MaxBodySize      int
+	TruncateBody     bool
+	BasicAuth        *BasicAuth
+	BearerToken      string
+	AWSSig4          *AWSSig4 `js:"aws_sig4"`
 	responseType     httpext.ResponseType
+	rawBody          []byte
+	template         *template
+	vars             map[string]string
+	// DisableAutoHost sends the Host header only when set by host or headers rather than from the
+	// URL, the other headers fasthttp sets itself being sent as regular ones
+	DisableAutoHost bool
+	// OrderedHeaders are [name, value] pairs sent before any other header, in the order given
+	OrderedHeaders [][]string
+	// ContentLength sends a FileStream body with this Content-Length rather than chunked, only this
+	// many bytes of it being sent
+	ContentLength *int
+	// InsecureSkipVerify overrides the client's TLS verification for this request when set
+	InsecureSkipVerify *bool
+	// MaxRedirects overrides the client's max_redirects for this request when set
+	MaxRedirects *int
+	// ReadTimeout and WriteTimeout in seconds override the client's for this request when set
+	ReadTimeout  int
+	WriteTimeout int
+	// Deadline is the Unix time in milliseconds every send must have completed by, 0 for none
+	Deadline int64
+	// Hash is the algorithm the body is hashed with as it's read, for Response.hash
+	Hash string
+	// RequestTarget is sent verbatim in the request line in place of the URL's path, the URL
+	// still being the one connected to
+	RequestTarget string
+	// ExpectContinue sends the request with Expect: 100-continue, holding its body back until the
+	// server accepts it
+	ExpectContinue bool
+}
+
+func newRequestWrapper(url string) *RequestWrapper {
+	return &RequestWrapper{Url: url, reqPool: &sync.Pool{}, inFlight: newInFlight()}
+}
+
+// prepare checks the request's options, deriving what's sent from them
+func (reqw *RequestWrapper) prepare() error {
+	reqw.responseType = httpext.ResponseType(0)
+	if reqw.ResponseType != "" {
+		responseType, err := httpext.ResponseTypeString(reqw.ResponseType)
+		if err != nil {
+			return fmt.Errorf("Invalid response type %v", err)
+		}
+		reqw.responseType = responseType
+	}
+
+	if reqw.Charset != "" {
+		if enc, _ := charset.Lookup(reqw.Charset); enc == nil {
+			return fmt.Errorf("unknown charset %q", reqw.Charset)
+		}
+	}
+
+	for _, h := range reqw.OrderedHeaders {
+		if len(h) != 2 {
+			return fmt.Errorf("ordered_headers expects [name, value] pairs, got %q", h)
+		}
+	}
+
+	if reqw.Hash != "" {
+		if _, err := newDigest(reqw.Hash); err != nil {
+			return err
+		}
+	}
+
+	reqw.rawBody = nil
+	if reqw.RawBody != nil {
+		rawBody, err := rawBodyBytes(reqw.RawBody)
+		if err != nil {
+			return err
+		}
+		reqw.rawBody = rawBody
+	}
+
+	if reqw.ContentLength != nil {
+		if _, ok := reqw.Body.(*FileStream); !ok || reqw.Chunked || reqw.rawBody != nil {
+			return errors.New("content_length only applies to FileStream bodies, other bodies being sent with their own length")
+		}
+		if *reqw.ContentLength < 0 {
+			return fmt.Errorf("invalid content_length %d", *reqw.ContentLength)
+		}
+	}
+
+	reqw.template = nil
+	if reqw.BodyTemplate != "" {
+		if reqw.Body != nil || reqw.rawBody != nil || reqw.Chunked {
+			return errors.New("body_template can't be combined with body, raw_body or chunked")
+		}
+		tmpl, err := parseTemplate("body_template", reqw.BodyTemplate)
+		if err != nil {
+			return err
+		}
+		reqw.template = tmpl
+	}
+	return nil
+}
+
+// copy returns a copy of the request to send on its behalf with some options changed, sharing
+// nothing with it but a FileStream body and its cancellation. The copy builds and pools its own
+// requests as what's pooled depends on the options.
+func (reqw *RequestWrapper) copy() *RequestWrapper {
+	c := *reqw
+	c.reqPool = &sync.Pool{}
+
+	if reqw.Headers != nil {
+		c.Headers = maps.Clone(reqw.Headers)
+	}
+	if reqw.OrderedHeaders != nil {
+		c.OrderedHeaders = make([][]string, len(reqw.OrderedHeaders))
+		for i, h := range reqw.OrderedHeaders {
+			c.OrderedHeaders[i] = slices.Clone(h)
+		}
+	}
+	if reqw.vars != nil {
+		c.vars = maps.Clone(reqw.vars)
+	}
+	if reqw.ContentLength != nil {
+		contentLength := *reqw.ContentLength
+		c.ContentLength = &contentLength
+	}
+	if reqw.BasicAuth != nil {
+		auth := *reqw.BasicAuth
+		c.BasicAuth = &auth
+	}
+	if reqw.AWSSig4 != nil {
+		sig := *reqw.AWSSig4
+		c.AWSSig4 = &sig
+	}
+	if reqw.InsecureSkipVerify != nil {
+		insecureSkipVerify := *reqw.InsecureSkipVerify
+		c.InsecureSkipVerify = &insecureSkipVerify
+	}
+	if reqw.MaxRedirects != nil {
+		maxRedirects := *reqw.MaxRedirects
+		c.MaxRedirects = &maxRedirects
+	}
+	return &c
+}
+
+// Clone returns a copy of the request with options given as its argument replacing the copied
+// ones, so variants can be derived from a base request. The copy builds and pools its own requests,
+// sharing nothing with the original but a FileStream body, and isn't cancelled along with it.
+func (reqw *RequestWrapper) Clone(call sobek.FunctionCall, rt *sobek.Runtime) sobek.Value {
+	clone := reqw.copy()
+	// a Request of its own rather than one sent on the original's behalf
+	clone.inFlight = newInFlight()
+
+	if opts := call.Argument(0); !sobek.IsUndefined(opts) && !sobek.IsNull(opts) {
+		if err := rt.ExportTo(opts, clone); err != nil {
+			common.Throw(rt, fmt.Errorf("clone expects its argument to be Request options got error %v", err))
+		}
+		if err := clone.prepare(); err != nil {
+			common.Throw(rt, err)
+		}
+	}
+	return rt.ToValue(clone).ToObject(rt)
+}
+
+// hasHeader reports whether the request sets the named header itself, matched case-insensitively as
+// names aren't normalized
+func (reqw *RequestWrapper) hasHeader(name string) bool {
+	if hasHeader(reqw.Headers, name) {
+		return true
+	}
+	for _, h := range reqw.OrderedHeaders {
+		if strings.EqualFold(h[0], name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancel aborts every send of the request still in progress, failing them with a cancelled error
+func (reqw *RequestWrapper) Cancel() {
+	reqw.inFlight.cancelAll()
+}
+
+// SetVars sets the values filling the body_template's placeholders from the next send on
+func (reqw *RequestWrapper) SetVars(vars map[string]string) {
+	reqw.vars = vars
+}
+
+// rawBodyBytes returns the bytes of a raw_body, which are sent as they are without being copied
+func rawBodyBytes(body interface{}) ([]byte, error) {
+	switch b := body.(type) {
+	case sobek.ArrayBuffer:
+		return b.Bytes(), nil
+	case []byte:
+		return b, nil
+	default:
+		return nil, fmt.Errorf("raw_body expects an ArrayBuffer or Uint8Array got %T", body)
+	}
+}
+
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// authorization returns the Authorization header value for the request's auth options, falling back
+// to the client's default bearer token, or an empty string if none are set
+func (reqw *RequestWrapper) authorization(defaultBearerToken string) string {
+	switch {
+	case reqw.BearerToken != "":
+		return "Bearer " + reqw.BearerToken
+	case reqw.BasicAuth != nil:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(reqw.BasicAuth.Username+":"+reqw.BasicAuth.Password))
+	case defaultBearerToken != "":
+		return "Bearer " + defaultBearerToken
+	}
+	return ""
+}
+
+// inFlight tracks the sends of a request in progress so they can be cancelled
+type inFlight struct {
+	lock    *sync.Mutex
+	next    uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{lock: &sync.Mutex{}, cancels: make(map[uint64]context.CancelFunc)}
+}
+
+// add derives a cancellable context for a send, done must be called once it's finished
+func (f *inFlight) add(parent context.Context) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(parent)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	id := f.next
+	f.next++
+	f.cancels[id] = cancel
+
+	return ctx, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		delete(f.cancels, id)
+		cancel()
+	}
+}
+
+func (f *inFlight) cancelAll() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, cancel := range f.cancels {
+		cancel()
+	}
 }
@@ -1,21 +1,55 @@
 package fasthttp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"os"
 
+	e "github.com/domsolutions/xk6-fasthttp/errors"
+	"github.com/sirupsen/logrus"
 	http "github.com/valyala/fasthttp"
 	"go.k6.io/k6/lib/netext/httpext"
+	"golang.org/x/net/html/charset"
 )
 
-func readResponseBody(respType httpext.ResponseType, resp *http.Response) (interface{}, error) {
-	// Ensure that the entire response body is read and closed so conn can be reused
+// readResponseBody reads the body as respType, or into saveToFile when set. Bodies over maxBodySize
+// fail with fasthttp.ErrBodyTooLarge, or are cut short when truncate is set, 0 meaning unlimited.
+// Text is decoded to UTF-8 from bodyCharset, or the charset of the Content-Type header when empty.
+// Bodies ending before contentLength fail with errors.ErrBodyCutShort, -1 being a body without a
+// length to verify. The body is also written to digest as it's read, when not nil. The number of
+// bytes of the body read is returned along with it.
+func readResponseBody(
+	respType httpext.ResponseType, saveToFile, bodyCharset string, maxBodySize int, truncate bool,
+	logger logrus.FieldLogger, resp *http.Response, contentLength int, digest io.Writer,
+) (_ interface{}, _ int, err error) {
 	defer func() {
-		_ = resp.Body()
+		if errors.Is(err, http.ErrBodyTooLarge) {
+			// the rest of a body over the limit isn't read, its connection being closed instead
+			resp.SetConnectionClose()
+		} else {
+			// Ensure that the entire response body is read and closed so conn can be reused,
+			// discarding what's left without buffering it
+			_ = resp.BodyWriteTo(io.Discard)
+		}
 		resp.CloseBodyStream()
 	}()
 
+	if maxBodySize > 0 && !truncate && resp.Header.ContentLength() > maxBodySize {
+		return nil, 0, http.ErrBodyTooLarge
+	}
+
+	if saveToFile != "" {
+		n, err := saveResponseBody(saveToFile, maxBodySize, truncate, resp, contentLength, digest)
+		return nil, n, err
+	}
+
 	if respType == httpext.ResponseTypeNone {
-		return nil, nil
+		// streamed bodies are discarded as they're read, so never held in memory
+		n, err := writeBody(resp, io.Discard, contentLength, digest)
+		return nil, n, err
 	}
 
 	if (resp.StatusCode() >= 100 && resp.StatusCode() <= 199) || // 1xx
@@ -23,19 +57,205 @@ func readResponseBody(respType httpext.ResponseType, resp *http.Response) (inter
 		// for all three of this status code there is always no content
 		// https://www.rfc-editor.org/rfc/rfc9110.html#section-6.4.1-8
 		// this also prevents trying to read
-		return nil, nil //nolint:nilnil
+		return nil, 0, nil
+	}
+
+	// copy the body out as the response is released back to fasthttp's pool, reading through
+	// BodyWriteTo so errors on a streamed body aren't swallowed into the body itself
+	var body bytes.Buffer
+	if n := resp.Header.ContentLength(); n > 0 && (maxBodySize <= 0 || n <= maxBodySize) {
+		body.Grow(n)
+	}
+	n, err := writeBody(resp, limitWriter(&body, maxBodySize, truncate), contentLength, digest)
+	if err != nil {
+		return nil, n, err
 	}
 
 	var result interface{}
 	// Binary or string
 	switch respType {
 	case httpext.ResponseTypeText:
-		result = string(resp.Body())
+		if bodyCharset == "" {
+			bodyCharset = contentTypeCharset(resp)
+		}
+		text, err := decodeText(body.Bytes(), bodyCharset)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to decode response body, returning it as binary")
+			return body.Bytes(), n, nil
+		}
+		result = text
 	case httpext.ResponseTypeBinary:
-		result = resp.Body()
+		result = body.Bytes()
 	default:
-		return nil, fmt.Errorf("unknown responseType %s", respType)
+		return nil, n, fmt.Errorf("unknown responseType %s", respType)
+	}
+
+	return result, n, nil
+}
+
+// streamResponseBody hands onChunk a copy of each piece of the body as it's read, until the body
+// ends or onChunk returns false, returning the number of bytes handed over. Chunked bodies and
+// those over streamResponseBodyThreshold arrive as they're read from the connection, smaller ones
+// in a single chunk.
+func streamResponseBody(resp *http.Response, onChunk func([]byte) bool) (int, error) {
+	body := resp.BodyStream()
+	if body == nil {
+		defer resp.CloseBodyStream()
+		b := resp.Body()
+		if len(b) > 0 {
+			onChunk(bytes.Clone(b))
+		}
+		return len(b), nil
+	}
+
+	defer resp.CloseBodyStream()
+
+	buf := make([]byte, 32*1024)
+	var read int
+	for {
+		n, err := body.Read(buf)
+		read += n
+		if n > 0 && !onChunk(bytes.Clone(buf[:n])) {
+			// what's left of the body can't be told apart from the next response, so the connection
+			// is closed rather than reused
+			resp.SetConnectionClose()
+			return read, nil
+		}
+		if errors.Is(err, io.EOF) {
+			return read, nil
+		}
+		if err != nil {
+			resp.SetConnectionClose()
+			return read, err
+		}
+	}
+}
+
+// contentTypeCharset returns the charset parameter of the Content-Type header, if any
+func contentTypeCharset(resp *http.Response) string {
+	_, params, err := mime.ParseMediaType(string(resp.Header.ContentType()))
+	if err != nil {
+		return ""
+	}
+	return params["charset"]
+}
+
+// decodeText transcodes body from the named charset to UTF-8, bodies without a charset are taken
+// to be UTF-8 already
+func decodeText(body []byte, label string) (string, error) {
+	if label == "" {
+		return string(body), nil
+	}
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		return "", fmt.Errorf("unknown charset %q", label)
+	}
+	if name == "utf-8" {
+		return string(body), nil
+	}
+	text, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s body; %w", name, err)
+	}
+	return string(text), nil
+}
+
+// saveResponseBody writes the body to path as it's read from the connection, returning the number
+// of bytes read. Large bodies are streamed by the client so they're never held in memory.
+func saveResponseBody(
+	path string, maxBodySize int, truncate bool, resp *http.Response, contentLength int, digest io.Writer,
+) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
 	}
 
-	return result, nil
+	n, err := writeBody(resp, limitWriter(f, maxBodySize, truncate), contentLength, digest)
+	if err != nil {
+		_ = f.Close()
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// writeBody writes the body to w, and to digest in full when not nil, returning the number of bytes
+// read. It fails with errors.ErrBodyCutShort when fewer than contentLength bytes were read or a
+// chunk is cut short. fasthttp only tells a body cut short of its length apart when it isn't
+// streamed, ending streamed ones when the connection is closed as if they were complete.
+func writeBody(resp *http.Response, w io.Writer, contentLength int, digest io.Writer) (int, error) {
+	if digest != nil {
+		w = io.MultiWriter(digest, w)
+	}
+	counted := &countingWriter{w: w}
+	if err := resp.BodyWriteTo(counted); err != nil {
+		return counted.n, bodyCutShort(err)
+	}
+	if contentLength > 0 && counted.n < contentLength {
+		return counted.n, fmt.Errorf(
+			"received %d of the %d bytes of Content-Length; %w", counted.n, contentLength, e.ErrBodyCutShort)
+	}
+	return counted.n, nil
+}
+
+// bodyCutShort returns err, that of reading a body, as errors.ErrBodyCutShort when it's an
+// unexpected EOF, the connection having ended before the body did
+func bodyCutShort(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", e.ErrBodyCutShort, err)
+	}
+	return err
+}
+
+// bodyLength returns the Content-Length resp's body is verified against, -1 for a response to a
+// HEAD request or with a status without a body, whose Content-Length isn't that of a body read
+func bodyLength(req *http.Request, resp *http.Response) int {
+	status := resp.StatusCode()
+	if req.Header.IsHead() || (status >= 100 && status <= 199) ||
+		status == http.StatusNoContent || status == http.StatusNotModified {
+		return -1
+	}
+	return resp.Header.ContentLength()
+}
+
+// countingWriter counts the bytes written through it, including those a limitWriter discards
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// limitWriter returns a writer which fails with fasthttp.ErrBodyTooLarge once more than n bytes are
+// written to it, or discards them when truncate is set, or w itself if n is 0
+func limitWriter(w io.Writer, n int, truncate bool) io.Writer {
+	if n <= 0 {
+		return w
+	}
+	return &limitedWriter{w: w, remaining: n, truncate: truncate}
+}
+
+type limitedWriter struct {
+	w         io.Writer
+	remaining int
+	truncate  bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.remaining && l.truncate {
+		// the rest is still read so the connection can be reused
+		if _, err := l.w.Write(p[:l.remaining]); err != nil {
+			return 0, err
+		}
+		l.remaining = 0
+		return len(p), nil
+	}
+	if len(p) > l.remaining {
+		return 0, http.ErrBodyTooLarge
+	}
+	l.remaining -= len(p)
+	return l.w.Write(p)
 }
@@ -1,12 +1,17 @@
 package fasthttp
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
+	e "github.com/domsolutions/xk6-fasthttp/errors"
 	http "github.com/valyala/fasthttp"
 
 	"github.com/grafana/sobek"
@@ -22,8 +27,155 @@ type Response struct {
 	*httpext.Response `js:"-"`
 	client            *Client
 
+	// Trailers are the headers sent after the body, declared by the Trailer header
+	Trailers map[string]string
+
+	// FinalURL is the URL the response was read from once redirects were followed, URL being the
+	// one requested
+	FinalURL string
+
+	// RemoteAddr is the host:port the response was read from, the proxy's when connecting through one
+	RemoteAddr string
+	// LocalAddr is the host:port of the client's end of the connection
+	LocalAddr string
+	// Proxied is whether the connection was dialed through the client's proxy rather than directly
+	Proxied bool
+	// NegotiatedProtocol is the protocol the server selected through ALPN, empty when it selected
+	// none or the connection isn't TLS
+	NegotiatedProtocol string
+
+	// BodySize is the number of bytes of the body read, as received without undoing its
+	// Content-Encoding, whether or not the body was kept
+	BodySize int
+
+	// tls is the state negotiated on the connection the response was read from, nil for plain ones
+	tls *tls.ConnectionState
+
+	// digest is the hex digest of the body taken with digestAlgo as it was read, empty when the
+	// request didn't ask for one
+	digest     string
+	digestAlgo string
+
 	cachedJSON    interface{}
 	validatedJSON bool
+
+	// headers is k6's response's headers map, pooled along with it
+	headers map[string]string
+	// pooled holds the headers while they're in the pool, nil for responses not made from it
+	pooled   *pooledResponse
+	released bool
+}
+
+// pooledResponse is what's reused of a released response. The Response and k6's response aren't
+// pooled as the script may still hold them, so new ones are handed out every time with the pooled
+// headers, which grow with every response read into them.
+type pooledResponse struct {
+	headers map[string]string
+}
+
+var responsePool = sync.Pool{
+	New: func() interface{} {
+		return &pooledResponse{headers: make(map[string]string)}
+	},
+}
+
+// errResponseReleased fails using a response once it's released, including releasing it again, as
+// its parts may already be in use by another request
+var errResponseReleased = errors.New("response already released")
+
+// acquireResponse returns an empty response made of parts from the pool, which are put back by
+// Release
+func acquireResponse(c *Client) *Response {
+	pooled := responsePool.Get().(*pooledResponse)
+	return &Response{Response: &httpext.Response{}, client: c, headers: pooled.headers, pooled: pooled}
+}
+
+// Release returns the response's parts to the pool to be reused by later requests, leaving it empty
+// for any reference the script kept to it. Responses which aren't released are garbage collected
+// as usual.
+func (res *Response) Release() error {
+	if res.released {
+		return errResponseReleased
+	}
+
+	pooled := res.pooled
+	if pooled == nil {
+		pooled = &pooledResponse{}
+	}
+	pooled.headers = res.headers
+	clear(pooled.headers)
+	*res.Response = httpext.Response{}
+	*res = Response{Response: res.Response, client: res.client, released: true}
+	if pooled.headers != nil {
+		responsePool.Put(pooled)
+	}
+	return nil
+}
+
+// Clone returns a copy of the response which doesn't share its headers or body, so stays the same
+// once the response is released and reused
+func (res *Response) Clone() *Response {
+	if res.released {
+		common.Throw(res.client.vu.Runtime(), errResponseReleased)
+	}
+	r := *res.Response
+	clone := &Response{
+		Response: &r, client: res.client, FinalURL: res.FinalURL,
+		RemoteAddr: res.RemoteAddr, LocalAddr: res.LocalAddr, Proxied: res.Proxied,
+		NegotiatedProtocol: res.NegotiatedProtocol, tls: res.tls,
+		BodySize: res.BodySize, digest: res.digest, digestAlgo: res.digestAlgo,
+	}
+	if res.Headers != nil {
+		clone.headers = make(map[string]string, len(res.Headers))
+		for k, v := range res.Headers {
+			clone.headers[k] = v
+		}
+		r.Headers = clone.headers
+	} else {
+		clone.headers = make(map[string]string)
+	}
+	if res.Trailers != nil {
+		clone.Trailers = make(map[string]string, len(res.Trailers))
+		for k, v := range res.Trailers {
+			clone.Trailers[k] = v
+		}
+	}
+	switch body := res.Body.(type) {
+	case []byte:
+		r.Body = append([]byte(nil), body...)
+	case sobek.ArrayBuffer:
+		r.Body = res.client.vu.Runtime().NewArrayBuffer(bytes.Clone(body.Bytes()))
+	}
+	return clone
+}
+
+// wrapBinaryBody hands a binary body to JS as an ArrayBuffer over the bytes read, without copying
+// them as they belong to the response alone. It must be called on the event loop.
+func (res *Response) wrapBinaryBody(rt *sobek.Runtime) {
+	if body, ok := res.Body.([]byte); ok {
+		res.Body = rt.NewArrayBuffer(body)
+	}
+}
+
+// header returns the value of the named header, matching the name case-insensitively as header
+// names are kept as received from the server
+func (res *Response) header(name string) (string, bool) {
+	if v, ok := res.Headers[name]; ok {
+		return v, true
+	}
+	for k, v := range res.Headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// setError sets the k6 error code and message for err
+func (res *Response) setError(err error) {
+	code, msg := e.ErrorCodeForError(err)
+	res.ErrorCode = int(code)
+	res.Error = msg
 }
 
 type jsonError struct {
@@ -40,6 +192,9 @@ func (j jsonError) Error() string {
 // HTML returns the body as an html.Selection
 func (res *Response) HTML(selector ...string) html.Selection {
 	rt := res.client.vu.Runtime()
+	if res.released {
+		common.Throw(rt, errResponseReleased)
+	}
 	if res.Body == nil {
 		err := fmt.Errorf("the body is null so we can't transform it to HTML" +
 			" - this likely was because of a request error getting the response")
@@ -65,6 +220,9 @@ func (res *Response) HTML(selector ...string) html.Selection {
 // JSON parses the body of a response as JSON and returns it to the goja VM.
 func (res *Response) JSON(selector ...string) sobek.Value {
 	rt := res.client.vu.Runtime()
+	if res.released {
+		common.Throw(rt, errResponseReleased)
+	}
 
 	if res.Body == nil {
 		err := fmt.Errorf("the body is null so we can't transform it to JSON" +
@@ -111,6 +269,67 @@ func (res *Response) JSON(selector ...string) sobek.Value {
 	return rt.ToValue(res.cachedJSON)
 }
 
+// Extract returns a capture group, the first unless given, of the first match of a RegExp or pattern
+// in the body, or null when there's no match
+func (res *Response) Extract(pattern sobek.Value, group ...int) (sobek.Value, error) {
+	rt := res.client.vu.Runtime()
+	if res.released {
+		return nil, errResponseReleased
+	}
+	if res.Body == nil {
+		return sobek.Null(), nil
+	}
+
+	regexp, ok := asRegExp(pattern)
+	if !ok {
+		var err error
+		if regexp, err = rt.New(rt.Get("RegExp"), pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := common.ToString(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	match, err := execRegExp(rt, regexp, body)
+	if err != nil || sobek.IsNull(match) {
+		return sobek.Null(), err
+	}
+
+	n := 1
+	if len(group) > 0 {
+		n = group[0]
+	}
+	value := match.ToObject(rt).Get(strconv.Itoa(n))
+	if value == nil || sobek.IsUndefined(value) {
+		return sobek.Null(), nil
+	}
+	return value, nil
+}
+
+// GraphqlErrors returns the errors of a GraphQL response's body, or null when there are none
+func (res *Response) GraphqlErrors() sobek.Value {
+	rt := res.client.vu.Runtime()
+	if res.released {
+		common.Throw(rt, errResponseReleased)
+	}
+	if res.Body == nil {
+		return sobek.Null()
+	}
+
+	body, err := common.ToBytes(res.Body)
+	if err != nil {
+		common.Throw(rt, err)
+	}
+
+	errs := gjson.GetBytes(body, "errors")
+	if !errs.IsArray() || len(errs.Array()) == 0 {
+		return sobek.Null()
+	}
+	return rt.ToValue(errs.Value())
+}
+
 func checkErrorInJSON(input []byte, offset int, err error) error {
 	lf := '\n'
 	str := string(input)
@@ -137,6 +356,9 @@ func checkErrorInJSON(input []byte, offset int, err error) error {
 // TODO: document the actual arguments that can be provided
 func (res *Response) SubmitForm(args ...sobek.Value) (*Response, error) {
 	rt := res.client.vu.Runtime()
+	if res.released {
+		common.Throw(rt, errResponseReleased)
+	}
 
 	formSelector := "form"
 	submitSelector := "[type=\"submit\"]"
@@ -212,16 +434,12 @@ func (res *Response) SubmitForm(args ...sobek.Value) (*Response, error) {
 		}
 		requestURL.RawQuery = q.Encode()
 
-		reqWrapper := &RequestWrapper{
-			Url: requestURL.String(),
-		}
+		reqWrapper := newRequestWrapper(requestURL.String())
 
 		return res.client.makeReq(reqWrapper, http.MethodGet)
 	}
 
-	reqWrapper := &RequestWrapper{
-		Url: requestURL.String(),
-	}
+	reqWrapper := newRequestWrapper(requestURL.String())
 
 	return res.client.makeReq(reqWrapper, requestMethod)
 }
@@ -230,6 +448,9 @@ func (res *Response) SubmitForm(args ...sobek.Value) (*Response, error) {
 // clicked
 func (res *Response) ClickLink(args ...sobek.Value) (*Response, error) {
 	rt := res.client.vu.Runtime()
+	if res.released {
+		common.Throw(rt, errResponseReleased)
+	}
 
 	selector := "a[href]"
 	if len(args) > 0 {
@@ -261,9 +482,93 @@ func (res *Response) ClickLink(args ...sobek.Value) (*Response, error) {
 	}
 	requestURL := responseURL.ResolveReference(hrefURL)
 
-	reqWrapper := &RequestWrapper{
-		Url: requestURL.String(),
+	reqWrapper := newRequestWrapper(requestURL.String())
+
+	return res.client.makeReq(reqWrapper, http.MethodGet)
+}
+
+// Revalidate requests the response's URL again with If-None-Match and If-Modified-Since set from its
+// ETag and Last-Modified headers, so an unchanged resource is answered with a 304 and a null body.
+// The options of a Request, when given, are used for the conditional request instead.
+func (res *Response) Revalidate(args ...sobek.Value) (*Response, error) {
+	rt := res.client.vu.Runtime()
+	if res.released {
+		common.Throw(rt, errResponseReleased)
 	}
 
+	conditional := make(map[string]string, 2)
+	if etag, ok := res.header(http.HeaderETag); ok {
+		conditional[http.HeaderIfNoneMatch] = etag
+	}
+	if lastModified, ok := res.header(http.HeaderLastModified); ok {
+		conditional[http.HeaderIfModifiedSince] = lastModified
+	}
+	if len(conditional) == 0 {
+		common.Throw(rt, fmt.Errorf("no ETag or Last-Modified header found in response '%s'", res.URL))
+	}
+
+	reqWrapper := newRequestWrapper(res.URL)
+	if len(args) > 0 && !common.IsNullish(args[0]) {
+		orig, ok := args[0].Export().(*RequestWrapper)
+		if !ok {
+			common.Throw(rt, errors.New("revalidate expects a Request"))
+		}
+		// copied so the conditional headers aren't kept on the script's request
+		reqWrapper = orig.copy()
+	}
+
+	headers := make(map[string]string, len(reqWrapper.Headers)+len(conditional))
+	for field, val := range reqWrapper.Headers {
+		// header names aren't normalized so the request's own are matched case-insensitively
+		if !hasHeader(conditional, field) {
+			headers[field] = val
+		}
+	}
+	for field, val := range conditional {
+		headers[field] = val
+	}
+	reqWrapper.Headers = headers
+
 	return res.client.makeReq(reqWrapper, http.MethodGet)
 }
+
+// PeerCertificate is a certificate presented by the server during the TLS handshake
+type PeerCertificate struct {
+	Subject string
+	Issuer  string
+	// NotBefore and NotAfter are in milliseconds since the epoch, as taken by the Date constructor
+	NotBefore       int64
+	NotAfter        int64
+	SubjectAltNames []string
+}
+
+// PeerCertificates returns the certificate chain presented by the server, leaf first, or none when the
+// response wasn't read over TLS. The chain is the one of the connection's handshake, so is the same
+// for every response read from a reused connection.
+func (res *Response) PeerCertificates() []PeerCertificate {
+	if res.tls == nil {
+		return nil
+	}
+
+	certs := make([]PeerCertificate, 0, len(res.tls.PeerCertificates))
+	for _, cert := range res.tls.PeerCertificates {
+		sans := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses)+len(cert.EmailAddresses)+len(cert.URIs))
+		sans = append(sans, cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		sans = append(sans, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			sans = append(sans, uri.String())
+		}
+
+		certs = append(certs, PeerCertificate{
+			Subject:         cert.Subject.String(),
+			Issuer:          cert.Issuer.String(),
+			NotBefore:       cert.NotBefore.UnixMilli(),
+			NotAfter:        cert.NotAfter.UnixMilli(),
+			SubjectAltNames: sans,
+		})
+	}
+	return certs
+}
@@ -0,0 +1,161 @@
+package fasthttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	e "github.com/domsolutions/xk6-fasthttp/errors"
+	"github.com/grafana/sobek"
+	"go.k6.io/k6/js/common"
+)
+
+// matches k6/http where 2xx and 3xx responses are the expected ones
+var defaultExpectedStatuses = expectedStatuses{
+	minmax: [][2]int{{200, 399}},
+}
+
+// expectedStatuses is kept unexported so it can only be created from JS with ExpectedStatuses and
+// handed to Client.SetResponseCallback
+type expectedStatuses struct {
+	minmax [][2]int
+	exact  []int
+}
+
+func (e expectedStatuses) match(status int) bool {
+	for _, v := range e.exact {
+		if v == status {
+			return true
+		}
+	}
+
+	for _, v := range e.minmax {
+		if v[0] <= status && status <= v[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpectedStatuses returns an expectedStatuses object based on the provided arguments which must be
+// either integers or objects like `{min: <integer>, max: <integer>}`
+func (mi *ModuleInstance) ExpectedStatuses(args ...sobek.Value) *expectedStatuses {
+	rt := mi.vu.Runtime()
+
+	if len(args) == 0 {
+		common.Throw(rt, errors.New("no arguments"))
+	}
+	var result expectedStatuses
+
+	jsIsInt, _ := sobek.AssertFunction(rt.GlobalObject().Get("Number").ToObject(rt).Get("isInteger"))
+	isInt := func(a sobek.Value) bool {
+		v, err := jsIsInt(sobek.Undefined(), a)
+		return err == nil && v.ToBoolean()
+	}
+
+	errMsg := "argument number %d to expectedStatuses was neither an integer nor an object like {min:100, max:329}"
+	for i, arg := range args {
+		o := arg.ToObject(rt)
+		if o == nil {
+			common.Throw(rt, fmt.Errorf(errMsg, i+1))
+		}
+
+		if isInt(arg) {
+			result.exact = append(result.exact, int(o.ToInteger()))
+		} else {
+			minValue := o.Get("min")
+			maxValue := o.Get("max")
+			if minValue == nil || maxValue == nil {
+				common.Throw(rt, fmt.Errorf(errMsg, i+1))
+			}
+			if !(isInt(minValue) && isInt(maxValue)) {
+				common.Throw(rt, fmt.Errorf("both min and max need to be integers for argument number %d", i+1))
+			}
+
+			result.minmax = append(result.minmax, [2]int{int(minValue.ToInteger()), int(maxValue.ToInteger())})
+		}
+	}
+	return &result
+}
+
+// SetResponseCallback sets the callback deciding which responses are expected. Supported values are
+// an expectedStatuses object or `null` which stops tagging requests with expected_response and
+// emitting http_req_failed
+func (c *Client) SetResponseCallback(val sobek.Value) {
+	if val != nil && !sobek.IsNull(val) {
+		// ExportTo exports functions to empty structs without an error so a type assertion is used
+		es, ok := val.Export().(*expectedStatuses)
+		if !ok {
+			common.Throw(c.vu.Runtime(), errors.New("unsupported argument, expected expectedStatuses"))
+		}
+		c.responseCallback = es.match
+	} else {
+		c.responseCallback = nil
+	}
+
+	if c.metrics != nil {
+		c.metrics.ResponseCallback = c.responseCallback
+	}
+}
+
+// SetErrorClassifier sets a function called with the status, 0 when the request failed, and the
+// error_code of every request, 0 when none, before its metrics are emitted. A number returned is
+// used as the error_code instead, 0 dropping it, while anything else keeps the default. `null`
+// removes the classifier.
+func (c *Client) SetErrorClassifier(val sobek.Value) {
+	if val == nil || sobek.IsNull(val) || sobek.IsUndefined(val) {
+		c.errorClassifier = nil
+		return
+	}
+	fn, ok := sobek.AssertFunction(val)
+	if !ok {
+		common.Throw(c.vu.Runtime(), errors.New("setErrorClassifier expects a function or null"))
+	}
+	c.errorClassifier = fn
+}
+
+// classifyError returns the error classifier of a request, nil when the script set none. Requests
+// sent on the event loop, without a queue, call it straight away, while the others wait for it to
+// run on the loop through their queue, keeping the default code once ctx is done.
+func (c *Client) classifyError(ctx context.Context, queue *loopQueue) func(int, e.ErrCode) (e.ErrCode, bool) {
+	fn := c.errorClassifier
+	if fn == nil {
+		return nil
+	}
+
+	classify := func(status int, code e.ErrCode) (e.ErrCode, bool) {
+		rt := c.vu.Runtime()
+		v, err := fn(sobek.Undefined(), rt.ToValue(status), rt.ToValue(int(code)))
+		if err != nil {
+			c.vu.State().Logger.WithError(err).Warn("Error classifier failed")
+			return 0, false
+		}
+		if _, ok := v.Export().(int64); !ok || v.ToInteger() < 0 {
+			return 0, false
+		}
+		return e.ErrCode(v.ToInteger()), true
+	}
+	if queue == nil {
+		return classify
+	}
+
+	return func(status int, code e.ErrCode) (e.ErrCode, bool) {
+		type result struct {
+			code e.ErrCode
+			ok   bool
+		}
+		classified := make(chan result, 1)
+		queue.run(func() error {
+			code, ok := classify(status, code)
+			classified <- result{code: code, ok: ok}
+			return nil
+		})
+
+		select {
+		case r := <-classified:
+			return r.code, r.ok
+		case <-ctx.Done():
+			return 0, false
+		}
+	}
+}
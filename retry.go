@@ -0,0 +1,83 @@
+package fasthttp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	http "github.com/valyala/fasthttp"
+)
+
+// RetryAfterConfig is the client's retry_after, retrying requests answered with a 429 or 503 once
+// the wait their Retry-After asks for is over
+type RetryAfterConfig struct {
+	MaxRetries int
+	MaxWait    int
+	// Jitter randomizes the wait so retries of many VUs are spread out, never retrying before the
+	// Retry-After: "full" waiting anywhere up to twice it and "equal" up to half as long again
+	Jitter string
+}
+
+const (
+	fullJitter  = "full"
+	equalJitter = "equal"
+
+	// maxRetryAfter is the longest wait a Retry-After is taken to ask for, so the wait stays in
+	// range of a time.Duration once jittered up to twice it, in whole seconds like delta-seconds
+	maxRetryAfter = math.MaxInt64 / 2 / time.Second * time.Second
+)
+
+// validate checks the jitter is a known one
+func (r *RetryAfterConfig) validate() error {
+	switch r.Jitter {
+	case "", fullJitter, equalJitter:
+		return nil
+	default:
+		return fmt.Errorf("unknown retry_after jitter %q, expected %q or %q", r.Jitter, fullJitter, equalJitter)
+	}
+}
+
+// jittered returns wait randomized as configured by jitter, the jitter being added to wait as it's the
+// least the server asked to be waited for
+func jittered(wait time.Duration, jitter string) time.Duration {
+	if wait <= 0 {
+		return wait
+	}
+	switch jitter {
+	case fullJitter:
+		return wait + rand.N(wait+1)
+	case equalJitter:
+		return wait + rand.N(wait/2+1)
+	default:
+		return wait
+	}
+}
+
+// retryAfter returns how long resp asks to be waited for before the request is retried, false when
+// it isn't a 429 or 503 with a Retry-After of delta-seconds or an HTTP-date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode() != http.StatusTooManyRequests && resp.StatusCode() != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Peek(http.HeaderRetryAfter)
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	// delays too large for an int64 are parsed as its largest and clamped like other huge ones
+	if seconds, err := strconv.ParseInt(string(value), 10, 64); err == nil || errors.Is(err, strconv.ErrRange) {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(min(seconds, int64(maxRetryAfter/time.Second))) * time.Second, true
+	}
+	date, err := http.ParseHTTPDate(value)
+	if err != nil {
+		return 0, false
+	}
+	// dates in the past ask for an immediate retry
+	return min(max(date.Sub(now), 0), maxRetryAfter), true
+}
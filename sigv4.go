@@ -0,0 +1,183 @@
+package fasthttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	http "github.com/valyala/fasthttp"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+)
+
+// AWSSig4 holds the credentials requests are signed with using AWS Signature Version 4
+type AWSSig4 struct {
+	AccessKey    string
+	SecretKey    string
+	Region       string
+	Service      string
+	SessionToken string
+}
+
+// sign sets the Authorization header of req, signed over its method, URL, headers and body at t.
+// A streamed body is read to hash it, then rewound to be sent.
+func (s *AWSSig4) sign(req *http.Request, t time.Time) error {
+	payloadHash, err := hashPayload(req)
+	if err != nil {
+		return err
+	}
+
+	t = t.UTC()
+	amzDate := t.Format(sigV4TimeFormat)
+	req.Header.Del(http.HeaderAuthorization)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	// S3 requires the payload hash as a header, other services only use it in the canonical request
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		string(req.Header.Method()),
+		canonicalPath(req, s.Service != "s3"),
+		canonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{t.Format(sigV4DateFormat), s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format(sigV4DateFormat))
+	for _, part := range []string{s.Region, s.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set(http.HeaderAuthorization, sigV4Algorithm+" Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+
+// hashPayload returns the hex SHA256 of the body, rewinding a streamed body after reading it
+func hashPayload(req *http.Request) (string, error) {
+	if !req.IsBodyStream() {
+		return hexSHA256(req.Body()), nil
+	}
+
+	stream, ok := req.BodyStream().(io.ReadSeeker)
+	if !ok {
+		return "", errors.New("aws_sig4 can only sign bodies which can be rewound")
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, stream); err != nil {
+		return "", err
+	}
+	if _, err := stream.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// canonicalPath URI encodes the path, twice for all services but S3
+func canonicalPath(req *http.Request, doubleEncode bool) string {
+	path := string(req.URI().Path())
+	if path == "" {
+		return "/"
+	}
+	path = uriEncode(path, false)
+	if doubleEncode {
+		path = uriEncode(path, false)
+	}
+	return path
+}
+
+// canonicalQuery returns the URI encoded query parameters sorted by name then value
+func canonicalQuery(req *http.Request) string {
+	var params []string
+	req.URI().QueryArgs().VisitAll(func(key, value []byte) {
+		params = append(params, uriEncode(string(key), true)+"="+uriEncode(string(value), true))
+	})
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// canonicalHeaders returns the names of the signed headers and their canonical form. Headers which
+// may be changed on the way to the server aren't signed.
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := string(req.Header.Host())
+	if !req.UseHostHeader || host == "" {
+		host = string(req.URI().Host())
+	}
+	values := map[string][]string{"host": {host}}
+
+	req.Header.VisitAll(func(key, value []byte) {
+		name := strings.ToLower(string(key))
+		switch name {
+		case "host", "authorization", "user-agent", "connection", "content-length", "transfer-encoding", "expect":
+			return
+		}
+		values[name] = append(values[name], strings.Join(strings.Fields(string(value)), " "))
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.Join(values[name], ",") + "\n")
+	}
+	return strings.Join(names, ";"), canonical.String()
+}
+
+// uriEncode percent encodes everything but unreserved characters, and slashes unless encodeSlash
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
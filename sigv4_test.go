@@ -0,0 +1,58 @@
+package fasthttp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	http "github.com/valyala/fasthttp"
+)
+
+func TestAWSSig4Sign(t *testing.T) {
+	t.Parallel()
+
+	// cases from the AWS Signature Version 4 test suite
+	signer := &AWSSig4{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+	}
+	signedAt := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	credential := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "
+
+	testCases := map[string]struct {
+		method, url, expected string
+	}{
+		"get-vanilla": {
+			method:   http.MethodGet,
+			url:      "http://example.amazonaws.com/",
+			expected: "SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		"get-vanilla-query-order-key-case": {
+			method:   http.MethodGet,
+			url:      "http://example.amazonaws.com/?Param2=value2&Param1=value1",
+			expected: "SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		"post-vanilla": {
+			method:   http.MethodPost,
+			url:      "http://example.amazonaws.com/",
+			expected: "SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			req := http.AcquireRequest()
+			defer http.ReleaseRequest(req)
+			req.Header.SetMethod(tc.method)
+			req.SetRequestURI(tc.url)
+
+			require.NoError(t, signer.sign(req, signedAt))
+			require.Equal(t, "20150830T123600Z", string(req.Header.Peek("X-Amz-Date")))
+			require.Equal(t, credential+tc.expected, string(req.Header.Peek(http.HeaderAuthorization)))
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package fasthttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/valyala/fasthttp"
+	k6metrics "go.k6.io/k6/metrics"
+)
+
+// flights coalesces identical GET and HEAD requests in flight at the same time, shared by the
+// clients created at the same point of the init code of every VU
+type flights struct {
+	lock    *sync.Mutex
+	pending map[string]*flight
+}
+
+func newFlights() *flights {
+	return &flights{lock: &sync.Mutex{}, pending: make(map[string]*flight)}
+}
+
+// flight is a request sent on behalf of every identical request made while it's in flight
+type flight struct {
+	done chan struct{}
+	// resp is a copy of the response kept for the coalesced requests to copy in turn, nil when the
+	// request failed without one
+	resp *Response
+	err  error
+	// abandoned is whether the request sent was cancelled or passed its deadline, which belong to
+	// its caller alone, so the coalesced requests must be sent again
+	abandoned bool
+}
+
+// join returns the flight of key, along with whether it was started by the caller who must then
+// land it
+func (f *flights) join(key string) (*flight, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if fl, ok := f.pending[key]; ok {
+		return fl, false
+	}
+	fl := &flight{done: make(chan struct{})}
+	f.pending[key] = fl
+	return fl, true
+}
+
+// land hands resp and err to the requests coalesced into fl, later requests starting a new flight.
+// resp is copied as the caller may release it while others are still copying it.
+func (f *flights) land(key string, fl *flight, resp *Response, err error, abandoned bool) {
+	f.lock.Lock()
+	delete(f.pending, key)
+	f.lock.Unlock()
+
+	if abandoned {
+		fl.abandoned = true
+		close(fl.done)
+		return
+	}
+	if resp != nil {
+		fl.resp = resp.Clone()
+	}
+	fl.err = err
+	close(fl.done)
+}
+
+// coalesces reports whether req can share the response of an identical request, only those
+// without a body being identical by their method and URL
+func coalesces(req *http.Request) bool {
+	return (req.Header.IsGet() || req.Header.IsHead()) && len(req.Body()) == 0 && !req.IsBodyStream()
+}
+
+// flightKey returns the key of the flight of req, made of everything it's sent with and what's
+// read of its response, so requests are only coalesced with those which would be answered the same,
+// i.e. made as the same user with the same Accept and Range, and read the same way
+func (c *Client) flightKey(reqw *RequestWrapper, req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(req.URI().String())
+	req.Header.VisitAll(func(name, value []byte) {
+		key.WriteString("\n")
+		key.Write(name)
+		key.WriteString(": ")
+		key.Write(value)
+	})
+	maxRedirects := c.maxRedirects
+	if reqw.MaxRedirects != nil {
+		maxRedirects = *reqw.MaxRedirects
+	}
+	fmt.Fprintf(&key, "\n%q %q %d %t %q %d %d %t %d %q", reqw.ResponseType, reqw.Charset, reqw.MaxBodySize,
+		reqw.TruncateBody, reqw.Hash, reqw.ReadTimeout, reqw.WriteTimeout, c.flipsVerify(reqw), maxRedirects,
+		reqw.RequestTarget)
+	return key.String()
+}
+
+// doCoalesced sends req with do, unless the client coalesces requests and an identical one is in
+// flight, in which case the request waits for its response and is handed a copy of it instead.
+// Coalesced requests aren't timed as they're not sent, only counted by fasthttp_reqs_coalesced.
+func (c *Client) doCoalesced(
+	ctx, sendCtx context.Context, fhc doer, reqw *RequestWrapper, req *http.Request, tags *k6metrics.TagsAndMeta,
+	queue *loopQueue,
+) (*Response, error) {
+	// bodies saved to file are each written to their own
+	if c.flights == nil || reqw.SaveToFile != "" || !coalesces(req) {
+		return c.do(ctx, sendCtx, fhc, reqw, req, tags, queue, nil)
+	}
+
+	// the request's own deadline, which it's given up on by whether it's sent or coalesced
+	callerCtx := sendCtx
+	if reqw.Deadline > 0 {
+		var cancel context.CancelFunc
+		callerCtx, cancel = context.WithDeadline(sendCtx, time.UnixMilli(reqw.Deadline))
+		defer cancel()
+	}
+
+	key := c.flightKey(reqw, req)
+	var resp *Response
+	var err error
+	for resp == nil && err == nil {
+		fl, first := c.flights.join(key)
+		if first {
+			resp, err := c.do(ctx, sendCtx, fhc, reqw, req, tags, queue, nil)
+			c.flights.land(key, fl, resp, err, callerCtx.Err() != nil)
+			return resp, err
+		}
+
+		select {
+		case <-fl.done:
+			if fl.abandoned {
+				// one of the coalesced requests is sent instead
+				continue
+			}
+			c.metrics.EmitCoalesced(ctx, req, reqw.Name, tags)
+			err = fl.err
+			if fl.resp != nil {
+				resp = fl.resp.Clone()
+				resp.client = c
+			}
+		case <-callerCtx.Done():
+			// as with a request cancelled or timing out before it was sent
+			err = callerCtx.Err()
+			resp = acquireResponse(c)
+			resp.URL = req.URI().String()
+			resp.FinalURL = resp.URL
+			resp.setError(err)
+		}
+	}
+
+	// the request which was sent may not have thrown
+	if err == nil && resp != nil && resp.Error != "" {
+		err = errors.New(resp.Error)
+	}
+	if !reqw.Throw {
+		return resp, nil
+	}
+	return resp, err
+}
@@ -1,15 +1,35 @@
 package fasthttp
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/grafana/sobek"
 	"go.k6.io/k6/js/common"
 )
 
+// FileStream is a seekable request body, read from a file on disk, an in-memory ArrayBuffer or a
+// reader given by another extension
 type FileStream struct {
-	*os.File
+	io.ReadSeeker
+	// contentType is sent when the request sets no Content-Type, blank when it couldn't be told
+	contentType string
+	// contentEncoding is sent when the request sets no Content-Encoding, blank when the bytes aren't
+	// encoded
+	contentEncoding string
+}
+
+// FileStreamOptions are given as the last argument of the FileStream constructor
+type FileStreamOptions struct {
+	// ContentEncoding the stream's bytes are already encoded with i.e. "gzip", sent as they are
+	ContentEncoding string
 }
 
 func (s *FileStream) Close() error {
@@ -19,15 +39,190 @@ func (s *FileStream) Close() error {
 }
 
 func (mi *ModuleInstance) FileStream(call sobek.ConstructorCall, rt *sobek.Runtime) *sobek.Object {
-	if len(call.Arguments) != 1 {
-		common.Throw(rt, errors.New("one arg required of file path for stream"))
+	args := call.Arguments
+	var opts FileStreamOptions
+	if len(args) > 0 {
+		if _, ok := args[len(args)-1].Export().(map[string]interface{}); ok {
+			if err := rt.ExportTo(args[len(args)-1], &opts); err != nil {
+				common.Throw(rt, fmt.Errorf("invalid FileStream options; %w", err))
+			}
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		common.Throw(rt, errors.New("at least one arg required of file path, ArrayBuffer or reader for stream"))
 	}
 
-	f, err := os.Open(call.Argument(0).String())
-	if err != nil {
-		mi.vu.State().Logger.WithError(err).Errorf("Failed to open file %s", call.Argument(0).String())
+	streams := make([]io.ReadSeeker, 0, len(args))
+	// files opened before one of the args fails are closed rather than left open
+	var opened []*os.File
+	throw := func(err error) {
+		for _, f := range opened {
+			_ = f.Close()
+		}
 		common.Throw(rt, err)
 	}
+	var contentType string
+	for i, arg := range args {
+		var path string
+		switch v := arg.Export().(type) {
+		case sobek.ArrayBuffer:
+			// copy so later changes to the ArrayBuffer in JS don't alter the body mid request
+			streams = append(streams, bytes.NewReader(bytes.Clone(v.Bytes())))
+		case io.ReadSeeker:
+			streams = append(streams, v)
+		case io.Reader:
+			streams = append(streams, &onceReader{r: v})
+		default:
+			path = arg.String()
+			f, err := os.Open(path)
+			if err != nil {
+				mi.vu.State().Logger.WithError(err).Errorf("Failed to open file %s", path)
+				throw(err)
+			}
+			opened = append(opened, f)
+			streams = append(streams, f)
+		}
+
+		// the body is typed by what it starts with
+		switch {
+		case i > 0:
+		case opts.ContentEncoding != "":
+			// encoded bytes only tell their encoding apart, so the type is of the extension before the
+			// encoding's i.e. payload.json.gz
+			contentType = mime.TypeByExtension(filepath.Ext(strings.TrimSuffix(path, filepath.Ext(path))))
+		default:
+			var err error
+			if contentType, err = sniffContentType(path, streams[0]); err != nil {
+				throw(err)
+			}
+		}
+	}
+
+	stream := &FileStream{contentType: contentType, contentEncoding: opts.ContentEncoding}
+	if len(streams) == 1 {
+		stream.ReadSeeker = streams[0]
+	} else {
+		stream.ReadSeeker = &multiReadSeeker{streams: streams}
+	}
+	return rt.ToValue(stream).ToObject(rt)
+}
+
+// sniffContentType returns the media type of the file extension of path, otherwise the type
+// http.DetectContentType sniffs from the first 512 bytes of s, which is rewound afterwards. Readers
+// which can't seek aren't sniffed as what's read couldn't be sent.
+func sniffContentType(path string, s io.ReadSeeker) (string, error) {
+	if ext := filepath.Ext(path); ext != "" {
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType, nil
+		}
+	}
+	if _, ok := s.(*onceReader); ok {
+		return "", nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(s, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// errStreamAlreadyRead is returned when resending a body read from a reader which can't seek
+var errStreamAlreadyRead = errors.New("stream of a reader which can't seek can only be sent once")
+
+// onceReader lets a reader which can't seek be used as a request body, which is sent once
+type onceReader struct {
+	r    io.Reader
+	read bool
+}
+
+func (o *onceReader) Read(p []byte) (int, error) {
+	o.read = true
+	return o.r.Read(p)
+}
+
+// Seek only supports rewinding to the start before anything is read, as done before the first send
+func (o *onceReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("stream of a reader can only seek to the start")
+	}
+	if o.read {
+		return 0, errStreamAlreadyRead
+	}
+	return 0, nil
+}
+
+// limitedStream reads no more than the first n bytes of a stream, so a body sent with a
+// Content-Length never runs past it
+type limitedStream struct {
+	s       io.ReadSeeker
+	n, left int64
+}
+
+func newLimitedStream(s io.ReadSeeker, n int64) *limitedStream {
+	return &limitedStream{s: s, n: n, left: n}
+}
+
+func (l *limitedStream) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.s.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// Seek only supports rewinding to the start, which is all that's needed to resend the body
+func (l *limitedStream) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("stream with a content_length can only seek to the start")
+	}
+	if _, err := l.s.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	l.left = l.n
+	return 0, nil
+}
 
-	return rt.ToValue(&FileStream{f}).ToObject(rt)
+// multiReadSeeker reads its streams back-to-back as one continuous body
+type multiReadSeeker struct {
+	streams []io.ReadSeeker
+	current int
+}
+
+func (m *multiReadSeeker) Read(p []byte) (int, error) {
+	for m.current < len(m.streams) {
+		n, err := m.streams[m.current].Read(p)
+		if errors.Is(err, io.EOF) {
+			m.current++
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Seek only supports rewinding to the start, which is all that's needed to resend the body
+func (m *multiReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("stream of multiple files can only seek to the start")
+	}
+
+	for _, s := range m.streams {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	m.current = 0
+	return 0, nil
 }
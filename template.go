@@ -0,0 +1,73 @@
+package fasthttp
+
+import (
+	"fmt"
+	"strings"
+
+	http "github.com/valyala/fasthttp"
+)
+
+// template is a body_template, or a value of the client's identity_headers, compiled once when
+// the Request or Client is created, so sending it only copies its parts and the values of its
+// {{placeholders}} into the request
+type template struct {
+	// option names the template in errors
+	option string
+	// literals surround the placeholders, so there's always one more of them than names
+	literals [][]byte
+	names    []string
+}
+
+func parseTemplate(option, text string) (*template, error) {
+	t := &template{option: option}
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			t.literals = append(t.literals, []byte(text))
+			return t, nil
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("%s has an unclosed {{", option)
+		}
+		name := strings.TrimSpace(text[start+2 : start+end])
+		if name == "" {
+			return nil, fmt.Errorf("%s has an empty placeholder", option)
+		}
+
+		t.literals = append(t.literals, []byte(text[:start]))
+		t.names = append(t.names, name)
+		text = text[start+end+2:]
+	}
+}
+
+// fill sets the body of req to the template with its placeholders replaced by vars, which are
+// inserted as they are without any escaping
+func (t *template) fill(req *http.Request, vars map[string]string) error {
+	req.ResetBody()
+	for i, name := range t.names {
+		val, ok := vars[name]
+		if !ok {
+			return fmt.Errorf("no value for %s placeholder %q", t.option, name)
+		}
+		req.AppendBody(t.literals[i])
+		req.AppendBodyString(val)
+	}
+	req.AppendBody(t.literals[len(t.literals)-1])
+	return nil
+}
+
+// expand returns the template with its placeholders replaced by vars
+func (t *template) expand(vars map[string]string) (string, error) {
+	var sb strings.Builder
+	for i, name := range t.names {
+		val, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("no value for %s placeholder %q", t.option, name)
+		}
+		sb.Write(t.literals[i])
+		sb.WriteString(val)
+	}
+	sb.Write(t.literals[len(t.literals)-1])
+	return sb.String(), nil
+}
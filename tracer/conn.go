@@ -0,0 +1,172 @@
+package tracer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo holds the details of an established connection which are shared by
+// every request sent over it.
+type ConnInfo struct {
+	// Time spent establishing the TCP connection
+	Connecting time.Duration
+
+	// Time spent on the TLS handshake, zero for plain connections
+	TLSHandshaking time.Duration
+
+	// Negotiated TLS state, nil for plain connections
+	TLS *tls.ConnectionState
+
+	// Local address the connection was established from
+	LocalAddr net.Addr
+
+	// Whether the connection was dialed through the proxy rather than to the host directly
+	Proxied bool
+
+	used atomic.Bool
+
+	phasesLock *sync.Mutex
+	phases     Phases
+	// readTimeout is the error of the last read if it hit the connection's deadline
+	readTimeout error
+}
+
+// Phases holds when the last request sent over a connection was written and
+// when the first byte of its response arrived.
+type Phases struct {
+	WriteStart time.Time
+	WriteEnd   time.Time
+	FirstRead  time.Time
+}
+
+// NewConnInfo returns a ConnInfo for a connection established in the given times
+func NewConnInfo(connecting, tlsHandshaking time.Duration) *ConnInfo {
+	return &ConnInfo{Connecting: connecting, TLSHandshaking: tlsHandshaking, phasesLock: &sync.Mutex{}}
+}
+
+// MarkUsed flags the connection as having served a request, returning whether
+// it already had i.e. the connection was reused.
+func (i *ConnInfo) MarkUsed() bool {
+	return i.used.Swap(true)
+}
+
+// Phases returns the phases of the last request sent over the connection
+func (i *ConnInfo) Phases() Phases {
+	i.phasesLock.Lock()
+	defer i.phasesLock.Unlock()
+	return i.phases
+}
+
+func (i *ConnInfo) wrote(start, end time.Time) {
+	i.phasesLock.Lock()
+	defer i.phasesLock.Unlock()
+	// a write after the previous response started arriving belongs to a new request
+	if i.phases.WriteStart.IsZero() || !i.phases.FirstRead.IsZero() {
+		i.phases = Phases{WriteStart: start}
+	}
+	i.phases.WriteEnd = end
+}
+
+// ReadTimeout returns the error of the connection's last read if it hit the read deadline, nil
+// otherwise, telling read timeouts apart from the others fasthttp returns as ErrTimeout
+func (i *ConnInfo) ReadTimeout() error {
+	i.phasesLock.Lock()
+	defer i.phasesLock.Unlock()
+	return i.readTimeout
+}
+
+func (i *ConnInfo) read(t time.Time, err error) {
+	i.phasesLock.Lock()
+	defer i.phasesLock.Unlock()
+	if err != nil {
+		i.readTimeout = err
+		return
+	}
+	i.readTimeout = nil
+	if !i.phases.WriteStart.IsZero() && i.phases.FirstRead.IsZero() {
+		i.phases.FirstRead = t
+	}
+}
+
+// Addr wraps the remote address of a traced connection so its ConnInfo can be
+// recovered from fasthttp's Response.RemoteAddr() once a request has completed.
+type Addr struct {
+	net.Addr
+	Info *ConnInfo
+	conn net.Conn
+}
+
+// Close closes the connection the address was obtained from, failing the request sent over it
+func (a *Addr) Close() error {
+	return a.conn.Close()
+}
+
+// Conn is a net.Conn which reports its ConnInfo through RemoteAddr() and
+// records the phases of each request sent over it.
+type Conn struct {
+	net.Conn
+	addr *Addr
+}
+
+// NewConn wraps conn so the given info travels with every response read from it
+func NewConn(conn net.Conn, info *ConnInfo) *Conn {
+	info.LocalAddr = conn.LocalAddr()
+	return &Conn{Conn: conn, addr: &Addr{Addr: conn.RemoteAddr(), Info: info, conn: conn}}
+}
+
+// Read implements the net.Conn interface, recording reads which hit the deadline on its ConnInfo
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	var netErr net.Error
+	switch {
+	case n > 0:
+		c.addr.Info.read(time.Now(), nil)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.addr.Info.read(time.Now(), err)
+	}
+	return n, err
+}
+
+// Write implements the net.Conn interface, write timeouts are returned as a WriteTimeoutError
+func (c *Conn) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.Conn.Write(b)
+	c.addr.Info.wrote(start, time.Now())
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = &WriteTimeoutError{Err: err}
+	}
+	return n, err
+}
+
+// WriteTimeoutError wraps the error of a write which hit the connection's deadline. It hides the
+// timeout so fasthttp returns it as is, rather than as the ErrTimeout it also returns for reads.
+type WriteTimeoutError struct {
+	Err error
+}
+
+func (e *WriteTimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *WriteTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// RemoteAddr implements the net.Conn interface
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// ConnInfoFromAddr returns the ConnInfo of the connection the address was
+// obtained from, or nil if the connection wasn't traced.
+func ConnInfoFromAddr(addr net.Addr) *ConnInfo {
+	if a, ok := addr.(*Addr); ok {
+		return a.Info
+	}
+	return nil
+}
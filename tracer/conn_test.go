@@ -0,0 +1,115 @@
+package tracer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrailAddConnInfo(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	info := NewConnInfo(10*time.Millisecond, 20*time.Millisecond)
+	conn := NewConn(client, info)
+	defer func() { _ = conn.Close() }()
+
+	go func() {
+		buf := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(server, buf); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			if _, err := server.Write([]byte("pong")); err != nil {
+				return
+			}
+		}
+	}()
+
+	// queued is how long the request waits for the connection before it's written
+	roundTrip := func(queued time.Duration) *Trail {
+		start := time.Now()
+		time.Sleep(queued)
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		require.NoError(t, err)
+
+		end := time.Now()
+		tr := &Trail{Duration: end.Sub(start)}
+		tr.AddConnInfo(ConnInfoFromAddr(conn.RemoteAddr()), start, end, true)
+		return tr
+	}
+
+	first := roundTrip(0)
+	assert.True(t, first.ConnNew.Bool)
+	assert.Equal(t, 10*time.Millisecond, first.Connecting)
+	assert.Equal(t, 20*time.Millisecond, first.TLSHandshaking)
+	assert.Equal(t, 30*time.Millisecond, first.ConnDuration)
+	assert.GreaterOrEqual(t, first.Waiting, 5*time.Millisecond)
+	// the connect time isn't taken for time waiting on the connection
+	assert.Zero(t, first.Blocked)
+
+	second := roundTrip(20 * time.Millisecond)
+	assert.False(t, second.ConnNew.Bool)
+	assert.True(t, second.ConnNew.Valid)
+	assert.Zero(t, second.Connecting)
+	assert.Zero(t, second.TLSHandshaking)
+	assert.GreaterOrEqual(t, second.Waiting, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, second.Blocked, 20*time.Millisecond)
+	assert.Less(t, second.Duration, 20*time.Millisecond)
+}
+
+func TestConnWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	conn := NewConn(client, NewConnInfo(0, 0))
+	defer func() { _ = conn.Close() }()
+
+	// nothing reads from the server end so the write blocks until the deadline
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := conn.Write([]byte("ping"))
+
+	var timeoutErr *WriteTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	_, isTimeout := err.(interface{ Timeout() bool })
+	assert.False(t, isTimeout)
+
+	var opErr *net.OpError
+	require.ErrorAs(t, err, &opErr)
+	assert.True(t, opErr.Timeout())
+}
+
+func TestConnReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	info := NewConnInfo(0, 0)
+	conn := NewConn(client, info)
+	defer func() { _ = conn.Close() }()
+
+	// nothing is written from the server end so the read blocks until the deadline
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 4))
+	require.Error(t, err)
+	assert.Equal(t, err, info.ReadTimeout())
+
+	// a read going through afterwards clears it
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	go func() { _, _ = server.Write([]byte("pong")) }()
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	require.NoError(t, err)
+	assert.NoError(t, info.ReadTimeout())
+}
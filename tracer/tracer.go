@@ -1,6 +1,7 @@
 package tracer
 
 import (
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -13,13 +14,33 @@ import (
 type Trail struct {
 	EndTime time.Time
 
+	// Time waiting to send the request, i.e. on the client's rate limit or for a free connection
+	Blocked time.Duration
+
 	// Total connect time (Connecting + TLSHandshaking)
 	ConnDuration time.Duration
 
 	// Total request duration, excluding DNS lookup and connect time.
 	Duration time.Duration
 
+	// Detailed connection timings, zero when an existing connection was reused
+	Connecting     time.Duration
+	TLSHandshaking time.Duration
+
+	// Detailed request phase timings
+	Sending   time.Duration // Writing the request
+	Waiting   time.Duration // Waiting for the first byte of the response
+	Receiving time.Duration // Reading the response
+	// whether the phases were timed, they aren't when the connection's reads and writes can't be
+	// told apart by request
+	phased bool
+
 	ConnRemoteAddr net.Addr
+	// Whether the request was sent over a newly dialed connection, invalid when unknown
+	ConnNew null.Bool
+
+	// TLS state negotiated when the connection was established, nil for plain connections
+	TLS *tls.ConnectionState
 
 	Failed null.Bool
 	// Populated by SaveSamples()
@@ -28,11 +49,46 @@ type Trail struct {
 	Samples  []metrics.Sample
 }
 
+// AddConnInfo fills in the timings recorded on the connection the request was sent over, start
+// being when the request was handed to the client and end when the response was fully read. The
+// time between them before the request was written, other than to connect, was spent waiting for a
+// free connection so is moved from Duration to Blocked. A zero start leaves both as they are.
+// phased is whether the connection's reads and writes are the request's alone, the phases being
+// left untimed when they're not, e.g. for pipelined requests in flight alongside others.
+func (tr *Trail) AddConnInfo(info *ConnInfo, start, end time.Time, phased bool) {
+	// TLS state is captured once per connection so reused connections report the original handshake
+	tr.TLS = info.TLS
+	tr.ConnNew = null.BoolFrom(!info.MarkUsed())
+	if tr.ConnNew.Bool {
+		tr.Connecting = info.Connecting
+		tr.TLSHandshaking = info.TLSHandshaking
+		tr.ConnDuration = info.Connecting + info.TLSHandshaking
+	}
+
+	if !phased {
+		return
+	}
+	phases := info.Phases()
+	if phases.WriteStart.IsZero() || phases.FirstRead.IsZero() {
+		return
+	}
+	if !start.IsZero() {
+		if queued := phases.WriteStart.Sub(start) - tr.ConnDuration; queued > 0 {
+			tr.Blocked += queued
+			tr.Duration -= queued
+		}
+	}
+	tr.Sending = phases.WriteEnd.Sub(phases.WriteStart)
+	tr.Waiting = phases.FirstRead.Sub(phases.WriteEnd)
+	tr.Receiving = end.Sub(phases.FirstRead)
+	tr.phased = true
+}
+
 // SaveSamples populates the Trail's sample slice so they're accesible via GetSamples()
 func (tr *Trail) SaveSamples(builtinMetrics *metrics.BuiltinMetrics, ctm *metrics.TagsAndMeta) {
 	tr.Tags = ctm.Tags
 	tr.Metadata = ctm.Metadata
-	tr.Samples = make([]metrics.Sample, 0, 2) // this is with 1 more for a possible HTTPReqFailed
+	tr.Samples = make([]metrics.Sample, 0, 7) // this is with 2 more for a possible HTTPReqFailed and new conn
 	tr.Samples = append(tr.Samples, []metrics.Sample{
 		{
 			TimeSeries: metrics.TimeSeries{
@@ -52,7 +108,40 @@ func (tr *Trail) SaveSamples(builtinMetrics *metrics.BuiltinMetrics, ctm *metric
 			Metadata: ctm.Metadata,
 			Value:    metrics.D(tr.Duration),
 		},
+		{
+			TimeSeries: metrics.TimeSeries{
+				Metric: builtinMetrics.HTTPReqBlocked,
+				Tags:   ctm.Tags,
+			},
+			Time:     tr.EndTime,
+			Metadata: ctm.Metadata,
+			Value:    metrics.D(tr.Blocked),
+		},
 	}...)
+
+	// the time to first byte and the time to read the rest are told apart for large downloads
+	if tr.phased {
+		tr.Samples = append(tr.Samples, []metrics.Sample{
+			{
+				TimeSeries: metrics.TimeSeries{
+					Metric: builtinMetrics.HTTPReqWaiting,
+					Tags:   ctm.Tags,
+				},
+				Time:     tr.EndTime,
+				Metadata: ctm.Metadata,
+				Value:    metrics.D(tr.Waiting),
+			},
+			{
+				TimeSeries: metrics.TimeSeries{
+					Metric: builtinMetrics.HTTPReqReceiving,
+					Tags:   ctm.Tags,
+				},
+				Time:     tr.EndTime,
+				Metadata: ctm.Metadata,
+				Value:    metrics.D(tr.Receiving),
+			},
+		}...)
+	}
 }
 
 // GetSamples implements the metrics.SampleContainer interface.
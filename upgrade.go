@@ -0,0 +1,107 @@
+package fasthttp
+
+import (
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // mandated by the WebSocket protocol
+	"encoding/base64"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/grafana/sobek"
+	http "github.com/valyala/fasthttp"
+)
+
+// webSocketGUID is appended to the handshake's key to derive Sec-WebSocket-Accept, RFC 6455 1.3
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Upgrade sends r as a WebSocket opening handshake, setting its Upgrade, Connection,
+// Sec-WebSocket-Version and a random Sec-WebSocket-Key header, and returns the response once it's
+// read. A 101 response whose Sec-WebSocket-Accept doesn't match the key fails the request, other
+// statuses are returned as they are. The connection is closed straight after the handshake as no
+// messages are exchanged over it.
+func (c *Client) Upgrade(r *sobek.Object) (*Response, error) {
+	c.verifyReq(r)
+	reqw := r.Export().(*RequestWrapper)
+
+	req, err := c.acquireReq(reqw, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	defer reqw.reqPool.Put(req)
+
+	// the handshake's headers aren't kept on the request reused by other sends
+	handshake := http.AcquireRequest()
+	defer http.ReleaseRequest(handshake)
+	req.CopyTo(handshake)
+	if err := setWebSocketHeaders(handshake); err != nil {
+		return nil, err
+	}
+
+	c.setupMetrics()
+	tags := c.vu.State().Tags.GetCurrentValues()
+
+	sendCtx, done := reqw.inFlight.add(c.vu.Context())
+	defer done()
+
+	var fhc doer = upgradeDoer{raw: c.rawFor(reqw)}
+	if reqw.Deadline > 0 {
+		fhc = deadlineDoer{doer: fhc, deadline: time.UnixMilli(reqw.Deadline)}
+	}
+	resp, err := c.do(c.vu.Context(), sendCtx, fhc, reqw, handshake, &tags, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.wrapBinaryBody(c.vu.Runtime())
+	return resp, nil
+}
+
+// setWebSocketHeaders sets the headers asking to switch req's connection to the WebSocket protocol
+func setWebSocketHeaders(req *http.Request) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req.Header.Set(http.HeaderUpgrade, "websocket")
+	req.Header.Set(http.HeaderConnection, "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(nonce))
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	return nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept a server answers the handshake's key with
+func webSocketAccept(key []byte) string {
+	h := sha1.New() //nolint:gosec // mandated by the WebSocket protocol
+	h.Write(key)
+	h.Write([]byte(webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// errInvalidWebSocketAccept fails a handshake switching protocols without proving it read the key
+var errInvalidWebSocketAccept = errors.New("invalid Sec-WebSocket-Accept in the WebSocket handshake")
+
+// upgradeDoer sends WebSocket handshakes over connections of their own, dialed like the client's
+// other connections, which are closed once the response is read as they're no longer HTTP
+type upgradeDoer struct {
+	raw *rawSender
+}
+
+func (u upgradeDoer) Do(req *http.Request, resp *http.Response) (net.Addr, error) {
+	return u.DoDeadline(req, resp, time.Time{})
+}
+
+// DoDeadline sends the handshake, reading the response by the sooner of deadline and read_timeout
+func (u upgradeDoer) DoDeadline(req *http.Request, resp *http.Response, deadline time.Time) (net.Addr, error) {
+	addr, err := u.raw.roundTrip(req, resp, deadline, req.Write)
+	if err != nil {
+		return addr, err
+	}
+	if resp.StatusCode() == http.StatusSwitchingProtocols &&
+		string(resp.Header.Peek("Sec-WebSocket-Accept")) != webSocketAccept(req.Header.Peek("Sec-WebSocket-Key")) {
+		return addr, errInvalidWebSocketAccept
+	}
+	return addr, nil
+}
+
+// CloseIdleConnections does nothing as no connection outlives its handshake
+func (u upgradeDoer) CloseIdleConnections() {}